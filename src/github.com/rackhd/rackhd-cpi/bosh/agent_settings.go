@@ -28,6 +28,13 @@ type Network struct {
 	DNS             []string               `json:"dns,omitempty"`
 	CloudProperties map[string]interface{} `json:"cloud_properties"`
 	MAC             string                 `json:"mac"`
+	Bond            *NetworkBond           `json:"bond,omitempty"`
+	VLANID          int                    `json:"vlan_id,omitempty"`
+}
+
+type NetworkBond struct {
+	Mode    string   `json:"mode"`
+	Members []string `json:"members"`
 }
 
 type AgentEnv struct {
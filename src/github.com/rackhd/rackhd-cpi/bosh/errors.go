@@ -0,0 +1,66 @@
+package bosh
+
+import "fmt"
+
+const (
+	VMNotFoundErrorType       = "Bosh::Clouds::VMNotFound"
+	DiskNotFoundErrorType     = "Bosh::Clouds::DiskNotFound"
+	DiskNotAttachedErrorType  = "Bosh::Clouds::DiskNotAttached"
+	VMCreationFailedErrorType = "Bosh::Clouds::VMCreationFailed"
+	NoDiskSpaceErrorType      = "Bosh::Clouds::NoDiskSpace"
+	NotSupportedErrorType     = "Bosh::Clouds::NotSupported"
+)
+
+// CloudError is an error the director can act on: Type names the
+// Bosh::Clouds error class it raises and OkToRetry whether the director may
+// retry the call. Errors of any other type are reported as a CloudError that
+// is not ok to retry.
+type CloudError struct {
+	Type      string
+	OkToRetry bool
+	Err       error
+}
+
+func (e CloudError) Error() string {
+	return e.Err.Error()
+}
+
+// Wrap prefixes the message of the error, keeping its type and retry flag
+func (e CloudError) Wrap(prefix string) CloudError {
+	e.Err = fmt.Errorf("%s: %s", prefix, e.Err)
+	return e
+}
+
+func NewVMNotFoundError(err error) CloudError {
+	return CloudError{Type: VMNotFoundErrorType, OkToRetry: false, Err: err}
+}
+
+func NewDiskNotFoundError(err error) CloudError {
+	return CloudError{Type: DiskNotFoundErrorType, OkToRetry: false, Err: err}
+}
+
+func NewDiskNotAttachedError(err error, okToRetry bool) CloudError {
+	return CloudError{Type: DiskNotAttachedErrorType, OkToRetry: okToRetry, Err: err}
+}
+
+func NewVMCreationFailedError(err error, okToRetry bool) CloudError {
+	return CloudError{Type: VMCreationFailedErrorType, OkToRetry: okToRetry, Err: err}
+}
+
+func NewNoDiskSpaceError(err error, okToRetry bool) CloudError {
+	return CloudError{Type: NoDiskSpaceErrorType, OkToRetry: okToRetry, Err: err}
+}
+
+func NewNotSupportedError(err error) CloudError {
+	return CloudError{Type: NotSupportedErrorType, OkToRetry: false, Err: err}
+}
+
+// BuildCloudErrorResponse reports err with its cloud error type and retry
+// flag, falling back to a default error that is not ok to retry
+func BuildCloudErrorResponse(err error, logOutput string) string {
+	if cloudErr, ok := err.(CloudError); ok {
+		return BuildErrorResponse(cloudErr, cloudErr.Type, cloudErr.OkToRetry, logOutput)
+	}
+
+	return BuildDefaultErrorResponse(err, false, logOutput)
+}
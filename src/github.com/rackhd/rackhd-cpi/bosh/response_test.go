@@ -53,6 +53,33 @@ var _ = Describe("response handling", func() {
 		})
 	})
 
+	Describe("exiting with a cloud error", func() {
+		It("reports the cloud error type and retry flag", func() {
+			testErr := bosh.NewVMCreationFailedError(errors.New("a test error"), true).Wrap("Error running CreateVM")
+			errResp := bosh.BuildCloudErrorResponse(testErr, "")
+
+			targetResponse := bosh.CpiResponse{}
+			err := json.Unmarshal([]byte(errResp), &targetResponse)
+			Expect(err).ToNot(HaveOccurred())
+
+			targetResponseErr := targetResponse.Error
+			Expect(targetResponseErr.Type).To(Equal(bosh.VMCreationFailedErrorType))
+			Expect(targetResponseErr.Message).To(Equal("Error running CreateVM: a test error"))
+			Expect(targetResponseErr.Retryable).To(BeTrue())
+		})
+
+		It("reports other errors as default errors that are not ok to retry", func() {
+			errResp := bosh.BuildCloudErrorResponse(errors.New("a test error"), "")
+
+			targetResponse := bosh.CpiResponse{}
+			err := json.Unmarshal([]byte(errResp), &targetResponse)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(targetResponse.Error.Type).To(Equal(bosh.DefaultErrorType))
+			Expect(targetResponse.Error.Retryable).To(BeFalse())
+		})
+	})
+
 	Describe("exiting successfully", func() {
 		It("wraps the response in a CpiResponse", func() {
 			resultMsg := "successful result"
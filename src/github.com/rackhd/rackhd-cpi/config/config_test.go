@@ -69,6 +69,130 @@ var _ = Describe("Creating a config", func() {
 		})
 	})
 
+	Context("when claim_timeout is not set", func() {
+		It("sets a default claim timeout", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}}`)
+			c, err := config.New(jsonReader, request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.ClaimTimeoutSeconds).To(BeEquivalentTo(30 * 60))
+		})
+
+		It("returns an error if the claim timeout is negative", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "claim_timeout": -1}`)
+			_, err := config.New(jsonReader, request)
+			Expect(err).To(MatchError("Invalid config. ClaimTimeoutSeconds cannot be negative"))
+		})
+	})
+
+	Context("when reservation_lease_ttl is not set", func() {
+		It("sets a default lease ttl", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}}`)
+			c, err := config.New(jsonReader, request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.ReservationLeaseTTLSeconds).To(BeEquivalentTo(60 * 60))
+		})
+	})
+
+	Context("when excluded_node_ids is set", func() {
+		It("excludes only the listed nodes", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "excluded_node_ids": ["55e79ea54e66816f6152fff9"]}`)
+			c, err := config.New(jsonReader, request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.IsNodeExcluded("55e79ea54e66816f6152fff9")).To(BeTrue())
+			Expect(c.IsNodeExcluded("55e79eb14e66816f6152fffb")).To(BeFalse())
+		})
+	})
+
+	Context("when availability_zones is set", func() {
+		It("maps nodes to availability zones by id or tags", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "availability_zones": {"z1": {"node_ids": ["55e79ea54e66816f6152fff9"]}, "z2": {"tags": ["az-2", "ssd"]}}}`)
+			c, err := config.New(jsonReader, request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.AvailabilityZoneOf("55e79ea54e66816f6152fff9", nil)).To(Equal("z1"))
+			Expect(c.AvailabilityZoneOf("55e79eb14e66816f6152fffb", []string{"ssd", "az-2"})).To(Equal("z2"))
+			Expect(c.AvailabilityZoneOf("55e79eb14e66816f6152fffb", []string{"az-2"})).To(Equal(""))
+		})
+
+		It("returns an error if an availability zone selects no nodes", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "availability_zones": {"z1": {}}}`)
+			_, err := config.New(jsonReader, request)
+			Expect(err).To(MatchError("Invalid config. Availability zone z1 has neither tags nor node_ids"))
+		})
+	})
+
+	Context("when request timeouts and retries are not set", func() {
+		It("sets defaults", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}}`)
+			c, err := config.New(jsonReader, request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.ConnectTimeoutSeconds).To(BeEquivalentTo(10))
+			Expect(c.ReadTimeoutSeconds).To(BeEquivalentTo(60))
+			Expect(c.RequestTimeoutSeconds).To(BeEquivalentTo(300))
+			Expect(c.MaxRequestRetries).To(Equal(3))
+			Expect(c.MaxConcurrentNodeChecks).To(Equal(8))
+		})
+
+		It("returns an error if node_page_size is negative", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "node_page_size": -1}`)
+			_, err := config.New(jsonReader, request)
+			Expect(err).To(MatchError("Invalid config. NodePageSize cannot be negative"))
+		})
+
+		It("returns an error if request_timeout is negative", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "request_timeout": -1}`)
+			_, err := config.New(jsonReader, request)
+			Expect(err).To(MatchError("Invalid config. RequestTimeoutSeconds cannot be negative"))
+		})
+
+		It("returns an error if max_request_retries is negative", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "max_request_retries": -1}`)
+			_, err := config.New(jsonReader, request)
+			Expect(err).To(MatchError("Invalid config. MaxRequestRetries cannot be negative"))
+		})
+
+		It("returns an error if amqp_url is not an amqp url", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "amqp_url": "http://localhost:5672"}`)
+			_, err := config.New(jsonReader, request)
+			Expect(err).To(MatchError("Invalid config. AMQPURL http://localhost:5672 must use the amqp or amqps scheme"))
+		})
+	})
+
+	Context("when api_version is set", func() {
+		It("defaults to the 1.1 API", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}}`)
+			c, err := config.New(jsonReader, request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.ApiVersion).To(Equal(config.ApiVersion1))
+		})
+
+		It("accepts the 2.0 API", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "api_version": "2.0"}`)
+			c, err := config.New(jsonReader, request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.ApiVersion).To(Equal(config.ApiVersion2))
+		})
+
+		It("returns an error for an unsupported version", func() {
+			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "api_version": "1.0"}`)
+			_, err := config.New(jsonReader, request)
+			Expect(err).To(MatchError("Invalid config. ApiVersion 1.0 is not supported, expecting 1.1 or 2.0"))
+		})
+	})
+
+	Context("when TLS and credentials are set", func() {
+		It("returns an error if a client certificate has no key", func() {
+			jsonReader := strings.NewReader(`{"api_url":"https://localhost:8443", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "tls": {"client_cert": "cert"}}`)
+			_, err := config.New(jsonReader, request)
+			Expect(err).To(MatchError("Invalid config. TLS client_cert and client_key must be set together"))
+		})
+
+		It("returns an error if a password has no username", func() {
+			jsonReader := strings.NewReader(`{"api_url":"https://localhost:8443", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}, "password": "secret"}`)
+			_, err := config.New(jsonReader, request)
+			Expect(err).To(MatchError("Invalid config. Password is set without a username"))
+		})
+	})
+
 	Context("when uuid is not set", func() {
 		It("generates a new one", func() {
 			jsonReader := strings.NewReader(`{"api_url":"http://localhost:8080", "agent":{"blobstore": {"provider": "local", "some": "options"}, "mbus":"localhost"}}`)
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -14,16 +16,94 @@ import (
 )
 
 const (
-	defaultMaxReserveNodeAttempts    = 5
-	defaultRunWorkflowTimeoutSeconds = 20 * 60
+	defaultMaxReserveNodeAttempts     = 5
+	defaultRunWorkflowTimeoutSeconds  = 20 * 60
+	defaultClaimTimeoutSeconds        = 30 * 60
+	defaultReservationLeaseTTLSeconds = 60 * 60
+	defaultConnectTimeoutSeconds      = 10
+	defaultReadTimeoutSeconds         = 60
+	defaultRequestTimeoutSeconds      = 5 * 60
+	defaultMaxRequestRetries          = 3
+	defaultMaxConcurrentNodeChecks    = 8
+)
+
+const (
+	ApiVersion1 = "1.1"
+	ApiVersion2 = "2.0"
 )
 
 type Cpi struct {
-	ApiServer                 string        `json:"api_url"`
-	Agent                     AgentConfig   `json:"agent"`
-	MaxReserveNodeAttempts    int           `json:"max_reserve_node_attempts"`
-	RunWorkflowTimeoutSeconds time.Duration `json:"run_workflow_timeout"`
-	RequestID                 string        `json:"request_id"`
+	ApiServer                  string                      `json:"api_url"`
+	ApiVersion                 string                      `json:"api_version"`
+	TLS                        TLSConfig                   `json:"tls"`
+	Username                   string                      `json:"username"`
+	Password                   string                      `json:"password"`
+	Agent                      AgentConfig                 `json:"agent"`
+	MaxReserveNodeAttempts     int                         `json:"max_reserve_node_attempts"`
+	RunWorkflowTimeoutSeconds  time.Duration               `json:"run_workflow_timeout"`
+	ClaimTimeoutSeconds        time.Duration               `json:"claim_timeout"`
+	ReservationLeaseTTLSeconds time.Duration               `json:"reservation_lease_ttl"`
+	ExcludedNodeIDs            []string                    `json:"excluded_node_ids"`
+	Topology                   map[string]NodeLocation     `json:"topology"`
+	AvailabilityZones          map[string]AvailabilityZone `json:"availability_zones"`
+	ConnectTimeoutSeconds      time.Duration               `json:"connect_timeout"`
+	ReadTimeoutSeconds         time.Duration               `json:"read_timeout"`
+	RequestTimeoutSeconds      time.Duration               `json:"request_timeout"`
+	MaxRequestRetries          int                         `json:"max_request_retries"`
+	NodePageSize               int                         `json:"node_page_size"`
+	MaxConcurrentNodeChecks    int                         `json:"max_concurrent_node_checks"`
+	AMQPURL                    string                      `json:"amqp_url"`
+	RequestID                  string                      `json:"request_id"`
+}
+
+// TLSConfig secures connections to an HTTPS api_url. Certificates and keys
+// are PEM encoded.
+type TLSConfig struct {
+	CACert             string `json:"ca_cert"`
+	ClientCert         string `json:"client_cert"`
+	ClientKey          string `json:"client_key"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// NodeLocation places a node in its physical failure domains. Nodes missing
+// from the topology fall back to the enclosure RackHD relates them to.
+type NodeLocation struct {
+	Rack    string `json:"rack"`
+	Chassis string `json:"chassis"`
+}
+
+// AvailabilityZone is the group of nodes a BOSH availability zone maps to: the
+// nodes listed by id and the nodes carrying all of the tags
+type AvailabilityZone struct {
+	Tags    []string `json:"tags"`
+	NodeIDs []string `json:"node_ids"`
+}
+
+func (az AvailabilityZone) Includes(nodeID string, nodeTags []string) bool {
+	for _, id := range az.NodeIDs {
+		if id == nodeID {
+			return true
+		}
+	}
+
+	if len(az.Tags) == 0 {
+		return false
+	}
+
+	for _, tag := range az.Tags {
+		found := false
+		for _, nodeTag := range nodeTags {
+			if nodeTag == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
 }
 
 type AgentConfig struct {
@@ -34,6 +114,34 @@ type AgentConfig struct {
 
 func DefaultMaxReserveNodeAttempts() int { return defaultMaxReserveNodeAttempts }
 
+// AvailabilityZoneOf returns the name of the first availability zone, in name
+// order, that includes the node, or an empty string if none does
+func (c Cpi) AvailabilityZoneOf(nodeID string, nodeTags []string) string {
+	names := make([]string, 0, len(c.AvailabilityZones))
+	for name := range c.AvailabilityZones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if c.AvailabilityZones[name].Includes(nodeID, nodeTags) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func (c Cpi) IsNodeExcluded(nodeID string) bool {
+	for _, excludedID := range c.ExcludedNodeIDs {
+		if excludedID == nodeID {
+			return true
+		}
+	}
+
+	return false
+}
+
 func GetNewRandomSeed() int64 { return time.Now().UnixNano() }
 
 func New(config io.Reader, request bosh.CpiRequest) (Cpi, error) {
@@ -52,6 +160,23 @@ func New(config io.Reader, request bosh.CpiRequest) (Cpi, error) {
 		return Cpi{}, errors.New("ApiServer IP is not set")
 	}
 
+	switch cpi.ApiVersion {
+	case "":
+		log.Info(fmt.Sprintf("No ApiVersion was set, set to default value %s", ApiVersion1))
+		cpi.ApiVersion = ApiVersion1
+	case ApiVersion1, ApiVersion2:
+	default:
+		return Cpi{}, fmt.Errorf("Invalid config. ApiVersion %s is not supported, expecting %s or %s", cpi.ApiVersion, ApiVersion1, ApiVersion2)
+	}
+
+	if (cpi.TLS.ClientCert == "") != (cpi.TLS.ClientKey == "") {
+		return Cpi{}, errors.New("Invalid config. TLS client_cert and client_key must be set together")
+	}
+
+	if cpi.Password != "" && cpi.Username == "" {
+		return Cpi{}, errors.New("Invalid config. Password is set without a username")
+	}
+
 	if cpi.MaxReserveNodeAttempts < 0 {
 		return Cpi{}, errors.New("Invalid config. MaxReserveNodeAttempts cannot be negative")
 	}
@@ -66,6 +191,83 @@ func New(config io.Reader, request bosh.CpiRequest) (Cpi, error) {
 		cpi.RunWorkflowTimeoutSeconds = defaultRunWorkflowTimeoutSeconds
 	}
 
+	if cpi.ClaimTimeoutSeconds < 0 {
+		return Cpi{}, errors.New("Invalid config. ClaimTimeoutSeconds cannot be negative")
+	}
+
+	if cpi.ClaimTimeoutSeconds == 0 {
+		log.Info(fmt.Sprintf("No ClaimTimeoutSeconds was set, set to default value %d", defaultClaimTimeoutSeconds))
+		cpi.ClaimTimeoutSeconds = defaultClaimTimeoutSeconds
+	}
+
+	if cpi.ReservationLeaseTTLSeconds < 0 {
+		return Cpi{}, errors.New("Invalid config. ReservationLeaseTTLSeconds cannot be negative")
+	}
+
+	if cpi.ReservationLeaseTTLSeconds == 0 {
+		log.Info(fmt.Sprintf("No ReservationLeaseTTLSeconds was set, set to default value %d", defaultReservationLeaseTTLSeconds))
+		cpi.ReservationLeaseTTLSeconds = defaultReservationLeaseTTLSeconds
+	}
+
+	if cpi.ConnectTimeoutSeconds < 0 {
+		return Cpi{}, errors.New("Invalid config. ConnectTimeoutSeconds cannot be negative")
+	}
+
+	if cpi.ConnectTimeoutSeconds == 0 {
+		log.Info(fmt.Sprintf("No ConnectTimeoutSeconds was set, set to default value %d", defaultConnectTimeoutSeconds))
+		cpi.ConnectTimeoutSeconds = defaultConnectTimeoutSeconds
+	}
+
+	if cpi.ReadTimeoutSeconds < 0 {
+		return Cpi{}, errors.New("Invalid config. ReadTimeoutSeconds cannot be negative")
+	}
+
+	if cpi.ReadTimeoutSeconds == 0 {
+		log.Info(fmt.Sprintf("No ReadTimeoutSeconds was set, set to default value %d", defaultReadTimeoutSeconds))
+		cpi.ReadTimeoutSeconds = defaultReadTimeoutSeconds
+	}
+
+	if cpi.RequestTimeoutSeconds < 0 {
+		return Cpi{}, errors.New("Invalid config. RequestTimeoutSeconds cannot be negative")
+	}
+
+	if cpi.RequestTimeoutSeconds == 0 {
+		log.Info(fmt.Sprintf("No RequestTimeoutSeconds was set, set to default value %d", defaultRequestTimeoutSeconds))
+		cpi.RequestTimeoutSeconds = defaultRequestTimeoutSeconds
+	}
+
+	if cpi.MaxRequestRetries < 0 {
+		return Cpi{}, errors.New("Invalid config. MaxRequestRetries cannot be negative")
+	}
+
+	if cpi.MaxRequestRetries == 0 {
+		log.Info(fmt.Sprintf("No MaxRequestRetries was set, set to default value %d", defaultMaxRequestRetries))
+		cpi.MaxRequestRetries = defaultMaxRequestRetries
+	}
+
+	if cpi.NodePageSize < 0 {
+		return Cpi{}, errors.New("Invalid config. NodePageSize cannot be negative")
+	}
+
+	if cpi.MaxConcurrentNodeChecks < 0 {
+		return Cpi{}, errors.New("Invalid config. MaxConcurrentNodeChecks cannot be negative")
+	}
+
+	if cpi.MaxConcurrentNodeChecks == 0 {
+		log.Info(fmt.Sprintf("No MaxConcurrentNodeChecks was set, set to default value %d", defaultMaxConcurrentNodeChecks))
+		cpi.MaxConcurrentNodeChecks = defaultMaxConcurrentNodeChecks
+	}
+
+	if cpi.AMQPURL != "" && !strings.HasPrefix(cpi.AMQPURL, "amqp://") && !strings.HasPrefix(cpi.AMQPURL, "amqps://") {
+		return Cpi{}, fmt.Errorf("Invalid config. AMQPURL %s must use the amqp or amqps scheme", cpi.AMQPURL)
+	}
+
+	for name, az := range cpi.AvailabilityZones {
+		if len(az.Tags) == 0 && len(az.NodeIDs) == 0 {
+			return Cpi{}, fmt.Errorf("Invalid config. Availability zone %s has neither tags nor node_ids", name)
+		}
+	}
+
 	if cpi.RequestID == "" {
 		uuid, err := uuid.NewV4()
 		if err != nil {
@@ -27,11 +27,24 @@ func AttachDisk(c config.Cpi, extInput bosh.MethodArguments) error {
 
 	node, err := rackhdapi.GetNodeByVMCID(c, vmCID)
 	if err != nil {
-		return fmt.Errorf("VM: %s not found\n", vmCID)
+		return asVMNotFound(err)
+	}
+
+	if len(c.AvailabilityZones) > 0 {
+		diskNode, err := rackhdapi.GetNodeByDiskCID(c, diskCID)
+		if err != nil {
+			return asDiskNotFound(err)
+		}
+
+		vmAZ := nodeAvailabilityZone(c, node)
+		diskAZ := nodeAvailabilityZone(c, diskNode)
+		if vmAZ != diskAZ {
+			return fmt.Errorf("Disk: %s is in %s and cannot be attached to VM: %s in %s", diskCID, describeAvailabilityZone(diskAZ), vmCID, describeAvailabilityZone(vmAZ))
+		}
 	}
 
 	if node.PersistentDisk.DiskCID == "" {
-		return fmt.Errorf("Disk: %s not found on VM: %s", diskCID, vmCID)
+		return bosh.NewDiskNotFoundError(fmt.Errorf("Disk: %s not found on VM: %s", diskCID, vmCID))
 	}
 
 	if node.PersistentDisk.DiskCID != diskCID {
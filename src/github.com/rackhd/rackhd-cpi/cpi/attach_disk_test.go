@@ -182,4 +182,91 @@ var _ = Describe("AttachDisk", func() {
 			Expect(len(server.ReceivedRequests())).To(Equal(1))
 		})
 	})
+
+	Context("given a disk CID in another availability zone", func() {
+		It("returns an error naming both availability zones", func() {
+			cpiConfig.AvailabilityZones = map[string]config.AvailabilityZone{
+				"z1": config.AvailabilityZone{NodeIDs: []string{"55e79ea54e66816f6152fff9"}},
+				"z2": config.AvailabilityZone{Tags: []string{"az-2"}},
+			}
+			extInput := bosh.MethodArguments{"vm-1", "disk-2"}
+
+			nodes := []rackhdapi.Node{
+				rackhdapi.Node{ID: "55e79ea54e66816f6152fff9", CID: "vm-1", PersistentDisk: rackhdapi.PersistentDiskSettings{DiskCID: "disk-1", IsAttached: true}},
+				rackhdapi.Node{ID: "55e79eb14e66816f6152fffb", Tags: []string{"az-2"}, PersistentDisk: rackhdapi.PersistentDiskSettings{DiskCID: "disk-2"}},
+			}
+			nodesData, err := json.Marshal(nodes)
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, nodesData),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, nodesData),
+				),
+			)
+
+			err = AttachDisk(cpiConfig, extInput)
+			Expect(err).To(MatchError("Disk: disk-2 is in availability zone z2 and cannot be attached to VM: vm-1 in availability zone z1"))
+			Expect(len(server.ReceivedRequests())).To(Equal(2))
+		})
+
+		It("returns the error even when the VM has no disk", func() {
+			cpiConfig.AvailabilityZones = map[string]config.AvailabilityZone{
+				"z1": config.AvailabilityZone{NodeIDs: []string{"55e79ea54e66816f6152fff9"}},
+				"z2": config.AvailabilityZone{Tags: []string{"az-2"}},
+			}
+			extInput := bosh.MethodArguments{"vm-1", "disk-2"}
+
+			nodes := []rackhdapi.Node{
+				rackhdapi.Node{ID: "55e79ea54e66816f6152fff9", CID: "vm-1"},
+				rackhdapi.Node{ID: "55e79eb14e66816f6152fffb", Tags: []string{"az-2"}, PersistentDisk: rackhdapi.PersistentDiskSettings{DiskCID: "disk-2"}},
+			}
+			nodesData, err := json.Marshal(nodes)
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, nodesData),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, nodesData),
+				),
+			)
+
+			err = AttachDisk(cpiConfig, extInput)
+			Expect(err).To(MatchError("Disk: disk-2 is in availability zone z2 and cannot be attached to VM: vm-1 in availability zone z1"))
+			Expect(len(server.ReceivedRequests())).To(Equal(2))
+		})
+
+		It("returns an error if the disk cannot be looked up", func() {
+			cpiConfig.AvailabilityZones = map[string]config.AvailabilityZone{
+				"z1": config.AvailabilityZone{NodeIDs: []string{"55e79ea54e66816f6152fff9"}},
+			}
+			extInput := bosh.MethodArguments{"vm-1", "disk-2"}
+
+			nodes := []rackhdapi.Node{
+				rackhdapi.Node{ID: "55e79ea54e66816f6152fff9", CID: "vm-1", PersistentDisk: rackhdapi.PersistentDiskSettings{DiskCID: "disk-1", IsAttached: true}},
+			}
+			nodesData, err := json.Marshal(nodes)
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, nodesData),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusNotFound, []byte("not found")),
+				),
+			)
+
+			err = AttachDisk(cpiConfig, extInput)
+			Expect(err).To(MatchError(HavePrefix("Failed getting nodes with status: 404")))
+			Expect(len(server.ReceivedRequests())).To(Equal(2))
+		})
+	})
 })
@@ -0,0 +1,59 @@
+package cpi
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+// parseAvailabilityZone reads availability_zone from vm or disk cloud
+// properties and checks that the cpi config maps it to nodes
+func parseAvailabilityZone(c config.Cpi, cloudProperties map[string]interface{}) (string, error) {
+	azInput, exists := cloudProperties["availability_zone"]
+	if !exists || azInput == nil {
+		return "", nil
+	}
+
+	az, ok := azInput.(string)
+	if !ok {
+		return "", fmt.Errorf("availability zone has unexpected type: %s. Expecting a string", reflect.TypeOf(azInput))
+	}
+
+	if az == "" {
+		return "", nil
+	}
+
+	if _, configured := c.AvailabilityZones[az]; !configured {
+		return "", fmt.Errorf("availability zone %s is not configured in availability_zones", az)
+	}
+
+	return az, nil
+}
+
+func nodeAvailabilityZone(c config.Cpi, node rackhdapi.Node) string {
+	return c.AvailabilityZoneOf(node.ID, node.Tags)
+}
+
+func describeAvailabilityZone(az string) string {
+	if az == "" {
+		return "no availability zone"
+	}
+
+	return fmt.Sprintf("availability zone %s", az)
+}
+
+func (f Filter) FilterBasedOnAvailabilityZone(c config.Cpi, node rackhdapi.Node) (bool, string, error) {
+	az, ok := f.data.(string)
+	if !ok {
+		return false, "", errors.New("error converting availability zone: availability zone must be convertible to string")
+	}
+
+	if !c.AvailabilityZones[az].Includes(node.ID, node.Tags) {
+		return false, fmt.Sprintf("is not in availability zone %s", az), nil
+	}
+
+	return true, "", nil
+}
@@ -0,0 +1,53 @@
+package cpi
+
+import (
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Availability zones", func() {
+	var c config.Cpi
+
+	BeforeEach(func() {
+		c = config.Cpi{AvailabilityZones: map[string]config.AvailabilityZone{
+			"z1": config.AvailabilityZone{Tags: []string{"az-1"}},
+			"z2": config.AvailabilityZone{NodeIDs: []string{"55e79eb14e66816f6152fffb"}},
+		}}
+	})
+
+	It("only selects nodes in the availability zone", func() {
+		nodes := []rackhdapi.Node{
+			rackhdapi.Node{ID: "55e79ea54e66816f6152fff9", Status: rackhdapi.Available, Tags: []string{"az-1"}},
+			rackhdapi.Node{ID: "55e79eb14e66816f6152fffb", Status: rackhdapi.Available},
+		}
+
+		_, err := randomSelectAvailableNode(c, nodes[1:], Filter{"z1", FilterBasedOnAvailabilityZoneMethod})
+		Expect(err).To(MatchError("no available node meets the requirements: node 55e79eb14e66816f6152fffb is not in availability zone z1"))
+
+		valid, reason, err := Filter{"z1", FilterBasedOnAvailabilityZoneMethod}.Run(c, nodes[0])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(valid).To(BeTrue())
+		Expect(reason).To(BeEmpty())
+	})
+
+	Describe("parseAvailabilityZone", func() {
+		It("reads the availability zone from cloud properties", func() {
+			az, err := parseAvailabilityZone(c, map[string]interface{}{"availability_zone": "z2"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(az).To(Equal("z2"))
+		})
+
+		It("returns an error if the availability zone is not configured", func() {
+			_, err := parseAvailabilityZone(c, map[string]interface{}{"availability_zone": "z3"})
+			Expect(err).To(MatchError("availability zone z3 is not configured in availability_zones"))
+		})
+
+		It("returns an error if the availability zone is not a string", func() {
+			_, err := parseAvailabilityZone(c, map[string]interface{}{"availability_zone": 1})
+			Expect(err).To(MatchError("availability zone has unexpected type: int. Expecting a string"))
+		})
+	})
+})
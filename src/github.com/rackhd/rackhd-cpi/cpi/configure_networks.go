@@ -8,5 +8,5 @@ import (
 )
 
 func ConfigureNetworks(c config.Cpi, extInput bosh.MethodArguments) error {
-	return errors.New("not supported")
+	return bosh.NewNotSupportedError(errors.New("not supported"))
 }
@@ -11,7 +11,12 @@ import (
 )
 
 func CreateDisk(c config.Cpi, extInput bosh.MethodArguments) (string, error) {
-	diskSizeInMB, vmCID, err := parseCreateDiskInput(extInput)
+	diskSizeInMB, vmCID, cloudProperties, err := parseCreateDiskInput(extInput)
+	if err != nil {
+		return "", err
+	}
+
+	az, err := parseAvailabilityZone(c, cloudProperties)
 	if err != nil {
 		return "", err
 	}
@@ -25,17 +30,24 @@ func CreateDisk(c config.Cpi, extInput bosh.MethodArguments) (string, error) {
 	if vmCID != "" {
 		node, err = rackhdapi.GetNodeByVMCID(c, vmCID)
 		if err != nil {
-			return "", err
+			return "", asVMNotFound(err)
 		}
 
 		if node.PersistentDisk.DiskCID != "" {
 			return "", fmt.Errorf("error creating disk: VM %s already has a persistent disk", vmCID)
 		}
 
-		valid, err := filter.Run(c, node)
-		if !valid || err != nil {
+		if az != "" && !c.AvailabilityZones[az].Includes(node.ID, node.Tags) {
+			return "", fmt.Errorf("error creating disk: VM %s is not in availability zone %s", vmCID, az)
+		}
+
+		valid, reason, err := filter.Run(c, node)
+		if err != nil {
 			return "", fmt.Errorf("error creating disk: %v", err)
 		}
+		if !valid {
+			return "", bosh.NewNoDiskSpaceError(fmt.Errorf("error creating disk with size %vMB: node %s %s", diskSizeInMB, node.ID, reason), false)
+		}
 
 		if node.PersistentDisk.PregeneratedDiskCID == "" {
 			return "", fmt.Errorf("error creating disk: can not find pregenerated disk cid for VM %s", vmCID)
@@ -43,7 +55,12 @@ func CreateDisk(c config.Cpi, extInput bosh.MethodArguments) (string, error) {
 		diskCID = node.PersistentDisk.PregeneratedDiskCID
 
 	} else {
-		node.ID, err = TryReservationWithFilter(c, "", filter, SelectNodeFromRackHD, ReserveNodeFromRackHD)
+		reservationFilter := filter
+		if az != "" {
+			reservationFilter = AllFilters(Filter{az, FilterBasedOnAvailabilityZoneMethod}, filter)
+		}
+
+		node.ID, err = TryReservationWithFilter(c, "", reservationFilter, SelectNodeFromRackHD, ReserveNodeFromRackHD)
 		if err != nil {
 			return "", err
 		}
@@ -71,17 +88,26 @@ func CreateDisk(c config.Cpi, extInput bosh.MethodArguments) (string, error) {
 	return container.PersistentDisk.DiskCID, nil
 }
 
-func parseCreateDiskInput(extInput bosh.MethodArguments) (int, string, error) {
+func parseCreateDiskInput(extInput bosh.MethodArguments) (int, string, map[string]interface{}, error) {
 	diskSizeInput := extInput[0]
 	diskSizeInMB := int(diskSizeInput.(float64))
 
+	cloudProperties := map[string]interface{}{}
+	if extInput[1] != nil {
+		var ok bool
+		cloudProperties, ok = extInput[1].(map[string]interface{})
+		if !ok {
+			return 0, "", nil, fmt.Errorf("cloud properties has unexpected type: %s. Expecting a map to interface", reflect.TypeOf(extInput[1]))
+		}
+	}
+
 	vmCIDInput := extInput[2]
 	var vmCID string
 	if reflect.TypeOf(vmCID) != reflect.TypeOf(vmCIDInput) {
-		return 0, "", fmt.Errorf("vmCIDInput is unexpected type")
+		return 0, "", nil, fmt.Errorf("vmCIDInput is unexpected type")
 	}
 
 	vmCID = vmCIDInput.(string)
 
-	return diskSizeInMB, vmCID, nil
+	return diskSizeInMB, vmCID, cloudProperties, nil
 }
@@ -12,6 +12,7 @@ import (
 	"github.com/rackhd/rackhd-cpi/config"
 	"github.com/rackhd/rackhd-cpi/cpi"
 	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
 )
 
 var _ = Describe("CreateDisk", func() {
@@ -89,6 +90,40 @@ var _ = Describe("CreateDisk", func() {
 		})
 	})
 
+	Context("If the VM is outside the availability zone of the disk", func() {
+		It("returns error", func() {
+			cpiConfig.AvailabilityZones = map[string]config.AvailabilityZone{
+				"z1": config.AvailabilityZone{Tags: []string{"az-1"}},
+			}
+			extInput := bosh.MethodArguments{25000.0, map[string]interface{}{"availability_zone": "z1"}, "vm-1"}
+
+			nodes := []rackhdapi.Node{
+				rackhdapi.Node{ID: "55e79ea54e66816f6152fff9", CID: "vm-1", Tags: []string{"az-2"}},
+			}
+			nodesData, err := json.Marshal(nodes)
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, nodesData),
+				),
+			)
+
+			diskCID, err := cpi.CreateDisk(cpiConfig, extInput)
+			Expect(err).To(MatchError("error creating disk: VM vm-1 is not in availability zone z1"))
+			Expect(diskCID).To(Equal(""))
+		})
+	})
+
+	Context("If the availability zone is not configured", func() {
+		It("returns error", func() {
+			extInput := bosh.MethodArguments{25000.0, map[string]interface{}{"availability_zone": "z9"}, "vm-1"}
+
+			_, err := cpi.CreateDisk(cpiConfig, extInput)
+			Expect(err).To(MatchError("availability zone z9 is not configured in availability_zones"))
+		})
+	})
+
 	Context("there is an available disk", func() {
 		Context("without enough disk space", func() {
 			It("returns an error", func() {
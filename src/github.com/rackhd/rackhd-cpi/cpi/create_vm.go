@@ -5,42 +5,110 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 
+	log "github.com/Sirupsen/logrus"
+
 	"github.com/rackhd/rackhd-cpi/bosh"
 	"github.com/rackhd/rackhd-cpi/config"
 	"github.com/rackhd/rackhd-cpi/rackhdapi"
 	"github.com/rackhd/rackhd-cpi/workflows"
 )
 
-func CreateVM(c config.Cpi, extInput bosh.MethodArguments) (string, error) {
+func CreateVM(c config.Cpi, extInput bosh.MethodArguments) (vmCID string, err error) {
 	agentID, stemcellCID, publicKey, boshNetworks, nodeID, err := parseCreateVMInput(extInput)
 	if err != nil {
 		return "", err
 	}
 
-	nodeID, err = TryReservation(c, nodeID, SelectNodeFromRackHD, ReserveNodeFromRackHD)
+	agentEnv, err := parseCreateVMEnv(extInput)
 	if err != nil {
 		return "", err
 	}
 
-	var netSpec bosh.Network
-	var netName string
-	for k, v := range boshNetworks {
-		netName = k
-		netSpec = v
+	netProperties, err := parseNetworkCloudProperties(extInput)
+	if err != nil {
+		return "", err
 	}
 
-	nodeCatalog, err := rackhdapi.GetNodeCatalog(c, nodeID)
+	vmProperties, err := parseVMCloudProperties(extInput)
 	if err != nil {
 		return "", err
 	}
 
-	if netSpec.NetworkType == bosh.ManualNetworkType {
-		netSpec, err = attachMAC(nodeCatalog.Data.NetworkData.Networks, netSpec)
+	az, err := parseAvailabilityZone(c, extInput[2].(map[string]interface{}))
+	if err != nil {
+		return "", err
+	}
+
+	if nodeID != "" && az != "" {
+		diskNode, err := rackhdapi.GetNode(c, nodeID)
 		if err != nil {
 			return "", err
 		}
+		if !c.AvailabilityZones[az].Includes(diskNode.ID, diskNode.Tags) {
+			return "", fmt.Errorf("error creating vm: persistent disk is on node %s, which is not in availability zone %s", nodeID, az)
+		}
+	}
+
+	var filters []Filter
+	if az != "" {
+		filters = append(filters, Filter{az, FilterBasedOnAvailabilityZoneMethod})
+	}
+	if vmProperties.SKU != "" {
+		sku, err := rackhdapi.GetSKU(c, vmProperties.SKU)
+		if err != nil {
+			return "", err
+		}
+		filters = append(filters, Filter{sku.ID, FilterBasedOnSKUMethod})
+	}
+	if vmProperties.Tags.required() {
+		filters = append(filters, Filter{vmProperties.Tags, FilterBasedOnTagsMethod})
+	}
+	if vmProperties.Hardware.required() {
+		filters = append(filters, Filter{vmProperties.Hardware, FilterBasedOnHardwareMethod})
+	}
+
+	diskNodeID := nodeID
+	nodeID, err = TryReservationWithFilter(c, nodeID, AllFilters(filters...), SpreadAcrossFailureDomains(parsePlacementGroup(agentEnv)), ReserveNodeFromRackHD)
+	if err != nil {
+		return "", bosh.NewVMCreationFailedError(err, false)
+	}
+
+	var createdDiskCID bool
+	rollback := func() error {
+		return rollbackCreateVM(c, nodeID, diskNodeID != "", createdDiskCID)
+	}
+	defer rackhdapi.OnInterrupt(fmt.Sprintf("roll back node %s", nodeID), rollback)()
+	defer func() {
+		if err != nil {
+			err = withRollbackError(err, rollback())
+		}
+	}()
+
+	nodeCatalog, err := rackhdapi.GetNodeCatalog(c, nodeID)
+	if err != nil {
+		return "", err
+	}
+
+	networks := map[string]bosh.Network{}
+	unboundNetworks := map[string]bosh.Network{}
+	for netName, netSpec := range boshNetworks {
+		if netSpec.NetworkType == bosh.ManualNetworkType || len(boshNetworks) > 1 || netProperties[netName].bindsInterface() {
+			unboundNetworks[netName] = netSpec
+		} else {
+			networks[netName] = netSpec
+		}
+	}
+
+	boundNetworks, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, unboundNetworks, netProperties)
+	if err != nil {
+		return "", err
+	}
+	for netName, netSpec := range boundNetworks {
+		networks[netName] = netSpec
 	}
 
 	node, err := rackhdapi.GetNode(c, nodeID)
@@ -67,6 +135,7 @@ func CreateVM(c config.Cpi, extInput bosh.MethodArguments) (string, error) {
 		if err != nil {
 			return "", err
 		}
+		createdDiskCID = true
 	} else {
 		diskCID = node.PersistentDisk.DiskCID
 	}
@@ -87,8 +156,9 @@ func CreateVM(c config.Cpi, extInput bosh.MethodArguments) (string, error) {
 			"system":     "/dev/sda",
 			"persistent": persistentMetadata,
 		},
+		Env:      agentEnv,
 		Mbus:     c.Agent.Mbus,
-		Networks: map[string]bosh.Network{netName: netSpec},
+		Networks: networks,
 		NTP:      c.Agent.Ntp,
 		VM: map[string]string{
 			"id":   nodeID,
@@ -102,11 +172,26 @@ func CreateVM(c config.Cpi, extInput bosh.MethodArguments) (string, error) {
 		return "", fmt.Errorf("error marshalling agent env %s", err)
 	}
 	envReader := bytes.NewReader(envBytes)
-	vmCID, err := rackhdapi.UploadFile(c, nodeID, envReader, int64(len(envBytes)))
+	vmCID, err = rackhdapi.UploadFile(c, nodeID, envReader, int64(len(envBytes)))
 	if err != nil {
 		return "", err
 	}
-	defer rackhdapi.DeleteFile(c, nodeID)
+	defer deleteTemporaryFile(c, nodeID)()
+
+	var interfacesFile string
+	if needsInterfacesFile(networks) {
+		interfaces, err := renderNetworkInterfaces(nodeCatalog.Data.NetworkData.Networks, networks)
+		if err != nil {
+			return "", err
+		}
+
+		interfacesFile = fmt.Sprintf("%s-interfaces", nodeID)
+		_, err = rackhdapi.UploadFile(c, interfacesFile, bytes.NewReader(interfaces), int64(len(interfaces)))
+		if err != nil {
+			return "", err
+		}
+		defer deleteTemporaryFile(c, interfacesFile)()
+	}
 
 	workflowName, err := workflows.PublishProvisionNodeWorkflow(c)
 	if err != nil {
@@ -115,47 +200,333 @@ func CreateVM(c config.Cpi, extInput bosh.MethodArguments) (string, error) {
 
 	wipeDisk := (nodeID == "")
 
-	err = workflows.RunProvisionNodeWorkflow(c, nodeID, workflowName, vmCID, stemcellCID, wipeDisk)
+	err = workflows.RunProvisionNodeWorkflow(c, nodeID, workflowName, vmCID, stemcellCID, wipeDisk, interfacesFile)
 	if err != nil {
-		return "", fmt.Errorf("error running provision workflow: %s", err)
+		return "", bosh.NewVMCreationFailedError(fmt.Errorf("error running provision workflow: %s", err), true)
+	}
+
+	endErr := rackhdapi.EndReservation(c, nodeID)
+	if endErr != nil {
+		log.Error(fmt.Sprintf("error ending the reservation of node %s: %s", nodeID, endErr))
 	}
 
 	return vmCID, nil
 }
 
-func attachMAC(nodeNetworks map[string]rackhdapi.Network, oldSpec bosh.Network) (bosh.Network, error) {
-	var upNetworks []rackhdapi.Network
+// deleteTemporaryFile deletes an uploaded file when the returned function is
+// deferred, or when the cpi is interrupted before then
+func deleteTemporaryFile(c config.Cpi, baseName string) func() {
+	unregister := rackhdapi.OnInterrupt(fmt.Sprintf("delete file %s", baseName), func() error {
+		return rackhdapi.DeleteFile(c, baseName)
+	})
+
+	return func() {
+		unregister()
+		rackhdapi.DeleteFile(c, baseName)
+	}
+}
+
+// rollbackCreateVM returns a node whose vm could not be created to the state
+// it was reserved in: no workflow running, no disk cid pregenerated for the vm
+// and no longer reserved. Every step is attempted even if an earlier one fails.
+func rollbackCreateVM(c config.Cpi, nodeID string, holdsDisk bool, createdDiskCID bool) error {
+	var failures []string
+
+	workflow, err := rackhdapi.GetActiveWorkflows(c, nodeID)
+	if err == nil && workflow.ID != "" {
+		err = rackhdapi.KillActiveWorkflow(c, nodeID)
+	}
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("error cancelling active workflow: %s", err))
+	}
+
+	if createdDiskCID {
+		bodyBytes, err := json.Marshal(rackhdapi.PersistentDiskSettingsContainer{})
+		if err == nil {
+			err = rackhdapi.PatchNode(c, nodeID, bodyBytes)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("error clearing pregenerated disk cid: %s", err))
+		}
+	}
+
+	err = releaseReservation(c, nodeID, holdsDisk)
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("error releasing node: %s", err))
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("error rolling back node %s: %s", nodeID, strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// withRollbackError reports the error that failed the vm creation along with
+// the error rolling it back, keeping the cloud error type of the former
+func withRollbackError(err error, rollbackErr error) error {
+	if rollbackErr == nil {
+		return err
+	}
+
+	if cloudErr, ok := err.(bosh.CloudError); ok {
+		cloudErr.Err = fmt.Errorf("%s; %s", cloudErr.Err, rollbackErr)
+		return cloudErr
+	}
+
+	return fmt.Errorf("%s; %s", err, rollbackErr)
+}
+
+// releaseReservation hands a node reserved for a vm that was not created back
+// to the pool. A node holding the persistent disk of the vm keeps its status
+// and only loses the claim of the request.
+func releaseReservation(c config.Cpi, nodeID string, holdsDisk bool) error {
+	if holdsDisk {
+		return rackhdapi.UnclaimNode(c, nodeID)
+	}
+
+	return rackhdapi.ReleaseLeasedNode(c, nodeID)
+}
+
+func attachMACs(nodeNetworks map[string]rackhdapi.Network, specs map[string]bosh.Network, netProperties map[string]networkCloudProperties) (map[string]bosh.Network, error) {
+	boundNetworks := map[string]bosh.Network{}
+	if len(specs) == 0 {
+		return boundNetworks, nil
+	}
+
+	netNames := make([]string, 0, len(specs))
+	for netName := range specs {
+		netNames = append(netNames, netName)
+	}
+	sort.Strings(netNames)
+
+	claimedInterfaces := map[string][]string{}
+	bondMembers := map[string][]string{}
+	claimInterface := func(interfaceName string, netName string) error {
+		for _, claimedBy := range claimedInterfaces[interfaceName] {
+			if !canShareInterface(netProperties[claimedBy], netProperties[netName], bondMembers[claimedBy], bondMembers[netName]) {
+				return fmt.Errorf("error attaching MAC address: interface %s is selected by both network %s and network %s", interfaceName, claimedBy, netName)
+			}
+		}
+		claimedInterfaces[interfaceName] = append(claimedInterfaces[interfaceName], netName)
+		return nil
+	}
+
+	var unselectedNetworks []string
+	for _, netName := range netNames {
+		properties := netProperties[netName]
+		switch {
+		case properties.Bond != nil:
+			members, err := selectBondMembers(nodeNetworks, *properties.Bond)
+			if err != nil {
+				return nil, fmt.Errorf("error attaching MAC address to network %s: %s", netName, err)
+			}
+
+			bondMembers[netName] = members
+			for _, interfaceName := range members {
+				err = claimInterface(interfaceName, netName)
+				if err != nil {
+					return nil, err
+				}
+			}
+			boundNetworks[netName] = withBond(withMAC(specs[netName], nodeNetworks[members[0]]), properties.Bond.Mode, members, nodeNetworks)
+		case properties.selectsInterface():
+			interfaceName, err := selectInterface(nodeNetworks, properties, claimedInterfaces)
+			if err != nil {
+				return nil, fmt.Errorf("error attaching MAC address to network %s: %s", netName, err)
+			}
+
+			err = claimInterface(interfaceName, netName)
+			if err != nil {
+				return nil, err
+			}
+			boundNetworks[netName] = withMAC(specs[netName], nodeNetworks[interfaceName])
+		default:
+			unselectedNetworks = append(unselectedNetworks, netName)
+		}
+	}
+
+	if len(unselectedNetworks) > 0 {
+		var upInterfaces []string
+		for interfaceName, nodeNetwork := range nodeNetworks {
+			if _, claimed := claimedInterfaces[interfaceName]; claimed {
+				continue
+			}
+			if nodeNetwork.State == rackhdapi.NetworkActive && nodeNetwork.Encapsulation == rackhdapi.EthernetNetwork {
+				upInterfaces = append(upInterfaces, interfaceName)
+			}
+		}
+		sort.Sort(byInterfaceNumber{names: upInterfaces, networks: nodeNetworks})
+
+		if len(upInterfaces) == 0 {
+			return nil, errors.New("error attaching MAC address: node has no active network")
+		}
+
+		if len(upInterfaces) < len(unselectedNetworks) {
+			return nil, fmt.Errorf("error attaching MAC address: node has %d unclaimed active networks for %d BOSH networks", len(upInterfaces), len(unselectedNetworks))
+		}
+
+		for i, netName := range unselectedNetworks {
+			boundNetworks[netName] = withMAC(specs[netName], nodeNetworks[upInterfaces[i]])
+		}
+	}
+
+	for netName, netSpec := range boundNetworks {
+		netSpec.VLANID = netProperties[netName].VLANID
+		boundNetworks[netName] = netSpec
+	}
+
+	return boundNetworks, nil
+}
+
+// Two networks may only share an interface when each tags its traffic with its
+// own VLAN and both see the interface the same way: untouched, or as the same bond
+func canShareInterface(first networkCloudProperties, second networkCloudProperties, firstMembers []string, secondMembers []string) bool {
+	if first.VLANID == 0 || second.VLANID == 0 || first.VLANID == second.VLANID {
+		return false
+	}
+
+	if first.Bond == nil || second.Bond == nil {
+		return first.Bond == nil && second.Bond == nil
+	}
+
+	return first.Bond.Mode == second.Bond.Mode && strings.Join(firstMembers, ",") == strings.Join(secondMembers, ",")
+}
+
+func selectBondMembers(nodeNetworks map[string]rackhdapi.Network, bond bondCloudProperties) ([]string, error) {
+	members := []string{}
+	selected := map[string]bool{}
+	for _, member := range bond.Members {
+		var memberName string
+		for interfaceName, nodeNetwork := range nodeNetworks {
+			if nodeNetwork.Encapsulation != rackhdapi.EthernetNetwork {
+				continue
+			}
+			if interfaceName == member || strings.EqualFold(macAddress(nodeNetwork), member) {
+				memberName = interfaceName
+			}
+		}
+
+		if memberName == "" {
+			return nil, fmt.Errorf("node has no ethernet interface %s to bond", member)
+		}
+		if selected[memberName] {
+			return nil, fmt.Errorf("bond member %s is listed more than once", memberName)
+		}
+		selected[memberName] = true
+		members = append(members, memberName)
+	}
+
+	sort.Sort(byInterfaceNumber{names: members, networks: nodeNetworks})
+	return members, nil
+}
+
+// selectInterface picks the ethernet interface the network's cloud properties
+// select. The ohai catalog carries no pci bus information, so pci_slot is
+// matched against interface names: it only works on nodes whose interfaces
+// biosdevname has named p<slot>p<port>.
+func selectInterface(nodeNetworks map[string]rackhdapi.Network, properties networkCloudProperties, claimedInterfaces map[string][]string) (string, error) {
+	var matches []string
+	for interfaceName, nodeNetwork := range nodeNetworks {
+		if nodeNetwork.Encapsulation != rackhdapi.EthernetNetwork {
+			continue
+		}
 
-	for _, nodeNetwork := range nodeNetworks {
-		if nodeNetwork.State == rackhdapi.NetworkActive && nodeNetwork.Encapsulation == rackhdapi.EthernetNetwork {
-			upNetworks = append(upNetworks, nodeNetwork)
+		switch {
+		case properties.Interface != "":
+			if interfaceName == properties.Interface {
+				matches = append(matches, interfaceName)
+			}
+		case properties.MAC != "":
+			if strings.EqualFold(macAddress(nodeNetwork), properties.MAC) {
+				matches = append(matches, interfaceName)
+			}
+		case properties.PCISlot != "":
+			if nodeNetwork.Type == fmt.Sprintf("p%sp", properties.PCISlot) {
+				matches = append(matches, interfaceName)
+			}
 		}
 	}
 
-	if len(upNetworks) == 0 {
-		return bosh.Network{}, errors.New("error attaching MAC address: node has no active network")
+	if len(matches) == 0 {
+		switch {
+		case properties.Interface != "":
+			return "", fmt.Errorf("node has no ethernet interface named %s", properties.Interface)
+		case properties.MAC != "":
+			return "", fmt.Errorf("node has no ethernet interface with mac %s", properties.MAC)
+		default:
+			var ethernetInterfaces []string
+			for interfaceName, nodeNetwork := range nodeNetworks {
+				if nodeNetwork.Encapsulation == rackhdapi.EthernetNetwork {
+					ethernetInterfaces = append(ethernetInterfaces, interfaceName)
+				}
+			}
+			sort.Strings(ethernetInterfaces)
+			return "", fmt.Errorf("node has no ethernet interface in pci slot %s: pci_slot only matches interfaces named p<slot>p<port> by biosdevname, and the node's ethernet interfaces are %v", properties.PCISlot, ethernetInterfaces)
+		}
 	}
 
-	if len(upNetworks) > 1 {
-		return bosh.Network{}, fmt.Errorf("error attaching MAC address: node has %d active networks", len(upNetworks))
+	sort.Sort(byInterfaceNumber{names: matches, networks: nodeNetworks})
+	for _, interfaceName := range matches {
+		if _, claimed := claimedInterfaces[interfaceName]; !claimed {
+			return interfaceName, nil
+		}
 	}
 
+	return matches[0], nil
+}
+
+func macAddress(nodeNetwork rackhdapi.Network) string {
 	var nodeMac string
-	for netName, netValue := range upNetworks[0].Addresses {
+	for netName, netValue := range nodeNetwork.Addresses {
 		if netValue.Family == rackhdapi.MacAddressFamily {
 			nodeMac = netName
 		}
 	}
 
-	net := bosh.Network{
+	return strings.ToLower(nodeMac)
+}
+
+func withMAC(oldSpec bosh.Network, nodeNetwork rackhdapi.Network) bosh.Network {
+	return bosh.Network{
 		NetworkType: oldSpec.NetworkType,
 		Netmask:     oldSpec.Netmask,
 		Gateway:     oldSpec.Gateway,
 		IP:          oldSpec.IP,
 		Default:     oldSpec.Default,
 		DNS:         oldSpec.DNS,
-		MAC:         strings.ToLower(nodeMac),
+		MAC:         macAddress(nodeNetwork),
+	}
+}
+
+func withBond(spec bosh.Network, mode string, members []string, nodeNetworks map[string]rackhdapi.Network) bosh.Network {
+	bond := &bosh.NetworkBond{Mode: mode}
+	for _, interfaceName := range members {
+		bond.Members = append(bond.Members, macAddress(nodeNetworks[interfaceName]))
+	}
+	spec.Bond = bond
+
+	return spec
+}
+
+type byInterfaceNumber struct {
+	names    []string
+	networks map[string]rackhdapi.Network
+}
+
+func (b byInterfaceNumber) Len() int      { return len(b.names) }
+func (b byInterfaceNumber) Swap(i, j int) { b.names[i], b.names[j] = b.names[j], b.names[i] }
+func (b byInterfaceNumber) Less(i, j int) bool {
+	left, right := b.networks[b.names[i]], b.networks[b.names[j]]
+	if left.Type != right.Type {
+		return left.Type < right.Type
+	}
+
+	leftNumber, leftErr := strconv.Atoi(left.Number)
+	rightNumber, rightErr := strconv.Atoi(right.Number)
+	if leftErr == nil && rightErr == nil && leftNumber != rightNumber {
+		return leftNumber < rightNumber
 	}
 
-	return net, nil
+	return b.names[i] < b.names[j]
 }
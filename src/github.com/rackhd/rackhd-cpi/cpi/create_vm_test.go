@@ -19,6 +19,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -143,14 +144,15 @@ var _ = Describe("The VM Creation Workflow", func() {
 			Expect(err).To(MatchError("network config has unexpected type in: string. Expecting a map"))
 		})
 
-		It("returns an error if more than one network is provided", func() {
+		It("returns a spec for every network provided", func() {
 			jsonInput := []byte(`[
     		"4149ba0f-38d9-4485-476f-1581be36f290",
     		"vm-478585",
     		{},
     		{
         		"private": {
-            		"type": "dynamic"
+            		"type": "dynamic",
+            		"default": ["dns", "gateway"]
         		},
         		"private2": {
             		"type": "dynamic"
@@ -163,8 +165,37 @@ var _ = Describe("The VM Creation Workflow", func() {
 			err := json.Unmarshal(jsonInput, &extInput)
 			Expect(err).ToNot(HaveOccurred())
 
+			_, _, _, networks, _, err := parseCreateVMInput(extInput)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(networks).To(HaveLen(2))
+			Expect(networks["private"].Default).To(Equal([]string{"dns", "gateway"}))
+			Expect(networks["private2"].Default).To(BeEmpty())
+		})
+
+		It("returns an error if more than one network provides the default gateway", func() {
+			jsonInput := []byte(`[
+    		"4149ba0f-38d9-4485-476f-1581be36f290",
+    		"vm-478585",
+    		{},
+    		{
+        		"private": {
+            		"type": "dynamic",
+            		"default": ["gateway"]
+        		},
+        		"private2": {
+            		"type": "dynamic",
+            		"default": ["dns", "gateway"]
+        		}
+    		},
+    		[],
+    		{}]`)
+
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal(jsonInput, &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
 			_, _, _, _, _, err = parseCreateVMInput(extInput)
-			Expect(err).To(MatchError("config error: Only one network supported, provided length: 2"))
+			Expect(err).To(MatchError("config error: only one network can provide the default gateway, provided: [private private2]"))
 		})
 
 		It("defaults to manual network if network type is not defined", func() {
@@ -331,6 +362,217 @@ var _ = Describe("The VM Creation Workflow", func() {
 		})
 	})
 
+	Describe("parseVMCloudProperties", func() {
+		It("reads the sku", func() {
+			extInput := bosh.MethodArguments{"agent-id", "vm-478585", map[string]interface{}{"sku": "storage"}}
+
+			properties, err := parseVMCloudProperties(extInput)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(properties.SKU).To(Equal("storage"))
+		})
+
+		It("returns an error if the sku is not a string", func() {
+			extInput := bosh.MethodArguments{"agent-id", "vm-478585", map[string]interface{}{"sku": 12}}
+
+			_, err := parseVMCloudProperties(extInput)
+			Expect(err).To(MatchError("sku has unexpected type: int. Expecting a string"))
+		})
+	})
+
+	Describe("parseNetworkCloudProperties", func() {
+		It("reads the interface selection of every network", func() {
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal([]byte(`["agent-id", "vm-478585", {}, {
+				"management": {"type": "dynamic", "cloud_properties": {"interface": "eth0"}},
+				"data": {"type": "dynamic", "cloud_properties": {"mac": "00:1e:67:c4:e1:a1"}},
+				"storage": {"type": "dynamic", "cloud_properties": {"pci_slot": "3"}},
+				"other": {"type": "dynamic"}
+			}, []]`), &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			netProperties, err := parseNetworkCloudProperties(extInput)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(netProperties).To(Equal(map[string]networkCloudProperties{
+				"management": networkCloudProperties{Interface: "eth0"},
+				"data":       networkCloudProperties{MAC: "00:1e:67:c4:e1:a1"},
+				"storage":    networkCloudProperties{PCISlot: "3"},
+				"other":      networkCloudProperties{},
+			}))
+		})
+
+		It("returns an error if a network selects its interface more than one way", func() {
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal([]byte(`["agent-id", "vm-478585", {}, {
+				"management": {"type": "dynamic", "cloud_properties": {"interface": "eth0", "mac": "00:1e:67:c4:e1:a1"}}
+			}, []]`), &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = parseNetworkCloudProperties(extInput)
+			Expect(err).To(MatchError("config error: network management can only select its interface by one of interface, mac or pci_slot"))
+		})
+
+		It("reads bond and vlan settings", func() {
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal([]byte(`["agent-id", "vm-478585", {}, {
+				"data": {"type": "dynamic", "cloud_properties": {"bond": {"mode": "802.3ad", "members": ["p514p1", "00:1e:67:c4:e1:a1"]}, "vlan_id": 120}}
+			}, []]`), &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			netProperties, err := parseNetworkCloudProperties(extInput)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(netProperties["data"]).To(Equal(networkCloudProperties{
+				Bond:   &bondCloudProperties{Mode: "802.3ad", Members: []string{"p514p1", "00:1e:67:c4:e1:a1"}},
+				VLANID: 120,
+			}))
+		})
+
+		It("returns an error if the bond mode is not supported", func() {
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal([]byte(`["agent-id", "vm-478585", {}, {
+				"data": {"type": "dynamic", "cloud_properties": {"bond": {"mode": "lacp", "members": ["p514p1"]}}}
+			}, []]`), &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = parseNetworkCloudProperties(extInput)
+			Expect(err).To(MatchError("config error: network data has unsupported bond mode: lacp. Expecting one of balance-rr, active-backup, balance-xor, broadcast, 802.3ad, balance-tlb, balance-alb"))
+		})
+
+		It("returns an error if a bond has no members", func() {
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal([]byte(`["agent-id", "vm-478585", {}, {
+				"data": {"type": "dynamic", "cloud_properties": {"bond": {"mode": "active-backup"}}}
+			}, []]`), &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = parseNetworkCloudProperties(extInput)
+			Expect(err).To(MatchError("config error: network data must list at least one bond member"))
+		})
+
+		It("returns an error if a bonded network also selects an interface", func() {
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal([]byte(`["agent-id", "vm-478585", {}, {
+				"data": {"type": "dynamic", "cloud_properties": {"interface": "p514p1", "bond": {"mode": "active-backup", "members": ["p514p1"]}}}
+			}, []]`), &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = parseNetworkCloudProperties(extInput)
+			Expect(err).To(MatchError("config error: network data cannot select its interface with interface, mac or pci_slot when bonding"))
+		})
+
+		It("returns an error if the vlan_id is out of range", func() {
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal([]byte(`["agent-id", "vm-478585", {}, {
+				"data": {"type": "dynamic", "cloud_properties": {"vlan_id": 4095}}
+			}, []]`), &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = parseNetworkCloudProperties(extInput)
+			Expect(err).To(MatchError("config error: network data has vlan_id 4095. Expecting a value between 1 and 4094"))
+		})
+	})
+
+	Describe("parseCreateVMEnv", func() {
+		It("uploads the env hash in the agent settings", func() {
+			nodeID := "55e79ea54e66816f6152fff9"
+			jsonInput := []byte(`[
+				"4149ba0f-38d9-4485-476f-1581be36f290",
+				"vm-478585",
+				{},
+				{
+						"private": {
+								"type": "dynamic"
+						}
+				},
+				["55e79ea54e66816f6152fff9-disk"],
+				{
+					"bosh": {
+						"password": "$6$salt$hashed",
+						"keep_root_password": true,
+						"remove_dev_tools": false,
+						"trusted_certs": "-----BEGIN CERTIFICATE-----"
+					},
+					"persistent_disk_fs": "xfs"
+				}]`)
+
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal(jsonInput, &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			var uploadedBody []byte
+			server.AllowUnhandledRequests = true
+			server.UnhandledRequestStatusCode = http.StatusNotFound
+			server.RouteToHandler("GET", fmt.Sprintf("/api/common/nodes/%s", nodeID),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, rackhdapi.Node{
+					ID:             nodeID,
+					Status:         rackhdapi.Reserved,
+					PersistentDisk: rackhdapi.PersistentDiskSettings{DiskCID: "55e79ea54e66816f6152fff9-disk"},
+				}),
+			)
+			server.RouteToHandler("GET", fmt.Sprintf("/api/common/nodes/%s/catalogs/ohai", nodeID),
+				ghttp.RespondWith(http.StatusOK, helpers.LoadJSON("../spec_assets/dummy_node_catalog_response.json")),
+			)
+			server.RouteToHandler("PUT", fmt.Sprintf("/api/common/files/%s", nodeID), func(w http.ResponseWriter, req *http.Request) {
+				uploadedBody, err = ioutil.ReadAll(req.Body)
+				Expect(err).ToNot(HaveOccurred())
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("vm-cid"))
+			})
+
+			CreateVM(cpiConfig, extInput)
+			Expect(uploadedBody).ToNot(BeEmpty())
+
+			uploadedEnv := bosh.AgentEnv{}
+			err = json.Unmarshal(uploadedBody, &uploadedEnv)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(uploadedEnv.AgentID).To(Equal("4149ba0f-38d9-4485-476f-1581be36f290"))
+			Expect(uploadedEnv.Env).To(Equal(extInput[5]))
+
+			boshEnv := uploadedEnv.Env["bosh"].(map[string]interface{})
+			Expect(boshEnv["password"]).To(Equal("$6$salt$hashed"))
+			Expect(boshEnv["keep_root_password"]).To(BeTrue())
+			Expect(boshEnv["remove_dev_tools"]).To(BeFalse())
+			Expect(boshEnv["trusted_certs"]).To(Equal("-----BEGIN CERTIFICATE-----"))
+			Expect(uploadedEnv.Env["persistent_disk_fs"]).To(Equal("xfs"))
+		})
+
+		It("returns an empty env if the director does not send one", func() {
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal([]byte(`["agent-id", "vm-478585", {}, {}, []]`), &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			env, err := parseCreateVMEnv(extInput)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(env).To(BeEmpty())
+		})
+
+		It("returns an error if env is of an unexpected type", func() {
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal([]byte(`["agent-id", "vm-478585", {}, {}, [], "not a hash"]`), &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = parseCreateVMEnv(extInput)
+			Expect(err).To(MatchError("env has unexpected type: string. Expecting a map to interface"))
+		})
+
+		It("returns an error if bosh.password is not a string", func() {
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal([]byte(`["agent-id", "vm-478585", {}, {}, [], {"bosh": {"password": 1234}}]`), &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = parseCreateVMEnv(extInput)
+			Expect(err).To(MatchError("env bosh.password has unexpected type: float64. Expecting a string"))
+		})
+
+		It("returns an error if bosh.keep_root_password is not a bool", func() {
+			var extInput bosh.MethodArguments
+			err := json.Unmarshal([]byte(`["agent-id", "vm-478585", {}, {}, [], {"bosh": {"keep_root_password": "yes"}}]`), &extInput)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = parseCreateVMEnv(extInput)
+			Expect(err).To(MatchError("env bosh.keep_root_password has unexpected type: string. Expecting a bool"))
+		})
+	})
+
 	Describe("building the BOSH agent networking spec", func() {
 		It("returns an error if no active networks can be found", func() {
 			dummyCatalogfile, err := os.Open("../spec_assets/dummy_node_catalog_all_interface_down_response.json")
@@ -347,11 +589,11 @@ var _ = Describe("The VM Creation Workflow", func() {
 
 			prevSpec := bosh.Network{}
 
-			_, err = attachMAC(nodeCatalog.Data.NetworkData.Networks, prevSpec)
+			_, err = attachMACs(nodeCatalog.Data.NetworkData.Networks, map[string]bosh.Network{"private": prevSpec}, nil)
 			Expect(err).To(MatchError("error attaching MAC address: node has no active network"))
 		})
 
-		It("returns an error if multiple active networks are found", func() {
+		It("binds the lowest numbered interface if multiple active networks are found", func() {
 			dummyCatalogfile, err := os.Open("../spec_assets/dummy_node_catalog_multiple_interface_up_response.json")
 			Expect(err).ToNot(HaveOccurred())
 			defer dummyCatalogfile.Close()
@@ -366,8 +608,170 @@ var _ = Describe("The VM Creation Workflow", func() {
 
 			prevSpec := bosh.Network{}
 
-			_, err = attachMAC(nodeCatalog.Data.NetworkData.Networks, prevSpec)
-			Expect(err).To(MatchError("error attaching MAC address: node has 2 active networks"))
+			netSpecs, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, map[string]bosh.Network{"private": prevSpec}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(netSpecs["private"].MAC).To(Equal("00:1e:67:c4:e1:a0"))
+		})
+
+		Context("when using multiple networks", func() {
+			var nodeCatalog rackhdapi.NodeCatalog
+			var specs map[string]bosh.Network
+
+			BeforeEach(func() {
+				nodeCatalog = helpers.LoadNodeCatalog("../spec_assets/dummy_node_catalog_multiple_interface_up_response.json")
+				specs = map[string]bosh.Network{
+					"management": bosh.Network{NetworkType: bosh.ManualNetworkType, IP: "10.0.0.5", Default: []string{"dns", "gateway"}},
+					"data":       bosh.Network{NetworkType: bosh.ManualNetworkType, IP: "10.1.0.5"},
+				}
+			})
+
+			It("binds each network to a distinct interface ordered by interface number", func() {
+				netSpecs, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, specs, nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(netSpecs).To(HaveLen(2))
+				Expect(netSpecs["data"].MAC).To(Equal("00:1e:67:c4:e1:a0"))
+				Expect(netSpecs["management"].MAC).To(Equal("00:1e:67:c4:e1:a1"))
+				Expect(netSpecs["management"].Default).To(Equal([]string{"dns", "gateway"}))
+				Expect(netSpecs["data"].Default).To(BeEmpty())
+			})
+
+			It("binds networks to explicitly selected interfaces", func() {
+				netProperties := map[string]networkCloudProperties{
+					"management": networkCloudProperties{Interface: "p514p1"},
+					"data":       networkCloudProperties{MAC: "00:1E:67:C4:E1:A1"},
+				}
+
+				netSpecs, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, specs, netProperties)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(netSpecs["management"].MAC).To(Equal("00:1e:67:c4:e1:a0"))
+				Expect(netSpecs["data"].MAC).To(Equal("00:1e:67:c4:e1:a1"))
+			})
+
+			It("binds the remaining interfaces in order once explicit selections are claimed", func() {
+				netProperties := map[string]networkCloudProperties{
+					"data": networkCloudProperties{Interface: "p514p1"},
+				}
+
+				netSpecs, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, specs, netProperties)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(netSpecs["data"].MAC).To(Equal("00:1e:67:c4:e1:a0"))
+				Expect(netSpecs["management"].MAC).To(Equal("00:1e:67:c4:e1:a1"))
+			})
+
+			It("selects interfaces by pci slot", func() {
+				netProperties := map[string]networkCloudProperties{
+					"management": networkCloudProperties{PCISlot: "514"},
+				}
+
+				netSpecs, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, map[string]bosh.Network{"management": specs["management"]}, netProperties)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(netSpecs["management"].MAC).To(Equal("00:1e:67:c4:e1:a0"))
+			})
+
+			It("returns an error if no interface is named for the selected pci slot", func() {
+				netProperties := map[string]networkCloudProperties{
+					"management": networkCloudProperties{PCISlot: "3"},
+				}
+
+				_, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, map[string]bosh.Network{"management": specs["management"]}, netProperties)
+				Expect(err).To(MatchError("error attaching MAC address to network management: node has no ethernet interface in pci slot 3: " +
+					"pci_slot only matches interfaces named p<slot>p<port> by biosdevname, and the node's ethernet interfaces are [p514p1 p514p2]"))
+			})
+
+			It("returns an error if two networks select the same interface", func() {
+				netProperties := map[string]networkCloudProperties{
+					"management": networkCloudProperties{Interface: "p514p2"},
+					"data":       networkCloudProperties{MAC: "00:1e:67:c4:e1:a1"},
+				}
+
+				_, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, specs, netProperties)
+				Expect(err).To(MatchError("error attaching MAC address: interface p514p2 is selected by both network data and network management"))
+			})
+
+			It("returns an error if a selected interface does not exist", func() {
+				netProperties := map[string]networkCloudProperties{
+					"data": networkCloudProperties{Interface: "eth7"},
+				}
+
+				_, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, specs, netProperties)
+				Expect(err).To(MatchError("error attaching MAC address to network data: node has no ethernet interface named eth7"))
+			})
+
+			It("returns an error if there are more networks than active interfaces", func() {
+				specs["storage"] = bosh.Network{NetworkType: bosh.ManualNetworkType, IP: "10.2.0.5"}
+
+				_, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, specs, nil)
+				Expect(err).To(MatchError("error attaching MAC address: node has 2 unclaimed active networks for 3 BOSH networks"))
+			})
+
+			It("bonds the member interfaces of a bonded network", func() {
+				netProperties := map[string]networkCloudProperties{
+					"data": networkCloudProperties{Bond: &bondCloudProperties{Mode: "802.3ad", Members: []string{"00:1E:67:C4:E1:A1", "p514p1"}}},
+				}
+
+				netSpecs, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, map[string]bosh.Network{"data": specs["data"]}, netProperties)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(netSpecs["data"].MAC).To(Equal("00:1e:67:c4:e1:a0"))
+				Expect(netSpecs["data"].Bond).To(Equal(&bosh.NetworkBond{
+					Mode:    "802.3ad",
+					Members: []string{"00:1e:67:c4:e1:a0", "00:1e:67:c4:e1:a1"},
+				}))
+			})
+
+			It("returns an error if a bond member does not exist", func() {
+				netProperties := map[string]networkCloudProperties{
+					"data": networkCloudProperties{Bond: &bondCloudProperties{Mode: "802.3ad", Members: []string{"p514p1", "eth7"}}},
+				}
+
+				_, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, specs, netProperties)
+				Expect(err).To(MatchError("error attaching MAC address to network data: node has no ethernet interface eth7 to bond"))
+			})
+
+			It("lets networks on distinct vlans share a bond", func() {
+				bond := &bondCloudProperties{Mode: "802.3ad", Members: []string{"p514p1", "p514p2"}}
+				netProperties := map[string]networkCloudProperties{
+					"management": networkCloudProperties{Bond: bond, VLANID: 100},
+					"data":       networkCloudProperties{Bond: bond, VLANID: 200},
+				}
+
+				netSpecs, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, specs, netProperties)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(netSpecs["management"].VLANID).To(Equal(100))
+				Expect(netSpecs["data"].VLANID).To(Equal(200))
+				Expect(netSpecs["management"].Bond).To(Equal(netSpecs["data"].Bond))
+			})
+
+			It("lets networks on distinct vlans share an interface", func() {
+				netProperties := map[string]networkCloudProperties{
+					"management": networkCloudProperties{Interface: "p514p2", VLANID: 100},
+					"data":       networkCloudProperties{Interface: "p514p2", VLANID: 200},
+				}
+
+				netSpecs, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, specs, netProperties)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(netSpecs["management"].MAC).To(Equal("00:1e:67:c4:e1:a1"))
+				Expect(netSpecs["data"].MAC).To(Equal("00:1e:67:c4:e1:a1"))
+			})
+
+			It("returns an error if networks on the same vlan share an interface", func() {
+				netProperties := map[string]networkCloudProperties{
+					"management": networkCloudProperties{Interface: "p514p2", VLANID: 100},
+					"data":       networkCloudProperties{Interface: "p514p2", VLANID: 100},
+				}
+
+				_, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, specs, netProperties)
+				Expect(err).To(MatchError("error attaching MAC address: interface p514p2 is selected by both network data and network management"))
+			})
+
+			It("returns an error if a bond member is also used without the bond", func() {
+				netProperties := map[string]networkCloudProperties{
+					"management": networkCloudProperties{Interface: "p514p2", VLANID: 100},
+					"data":       networkCloudProperties{Bond: &bondCloudProperties{Mode: "802.3ad", Members: []string{"p514p1", "p514p2"}}, VLANID: 200},
+				}
+
+				_, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, specs, netProperties)
+				Expect(err).To(MatchError("error attaching MAC address: interface p514p2 is selected by both network data and network management"))
+			})
 		})
 
 		Context("when using manual networking", func() {
@@ -393,8 +797,9 @@ var _ = Describe("The VM Creation Workflow", func() {
 					DNS:         []string{"8.8.8.8"},
 				}
 
-				newSpec, err := attachMAC(nodeCatalog.Data.NetworkData.Networks, prevSpec)
+				newSpecs, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, map[string]bosh.Network{"private": prevSpec}, nil)
 				Expect(err).ToNot(HaveOccurred())
+				newSpec := newSpecs["private"]
 				Expect(prevSpec.NetworkType).To(Equal(newSpec.NetworkType))
 				Expect(prevSpec.Netmask).To(Equal(newSpec.Netmask))
 				Expect(prevSpec.Gateway).To(Equal(newSpec.Gateway))
@@ -410,9 +815,9 @@ var _ = Describe("The VM Creation Workflow", func() {
 
 				prevSpec := bosh.Network{}
 
-				netSpec, err := attachMAC(nodeCatalog.Data.NetworkData.Networks, prevSpec)
+				netSpecs, err := attachMACs(nodeCatalog.Data.NetworkData.Networks, map[string]bosh.Network{"private": prevSpec}, nil)
 				Expect(err).ToNot(HaveOccurred())
-				Expect(netSpec.MAC).To(Equal("00:1e:67:c4:e1:a0"))
+				Expect(netSpecs["private"].MAC).To(Equal("00:1e:67:c4:e1:a0"))
 			})
 		})
 	})
@@ -580,6 +985,69 @@ var _ = Describe("The VM Creation Workflow", func() {
 			})
 		})
 
+		Context("when filtering by sku", func() {
+			It("only selects nodes with the sku", func() {
+				nodes := helpers.LoadNodes("../spec_assets/dummy_many_nodes_response.json")
+				for i := range nodes {
+					nodes[i].SKU = "5666e4b2a3a8be2c53a2c6b2"
+				}
+				nodes[3].SKU = "5666e4b2a3a8be2c53a2c6b1"
+
+				node3HttpResponse, err := json.Marshal(nodes[3])
+				Expect(err).ToNot(HaveOccurred())
+
+				server.RouteToHandler("GET", fmt.Sprintf("/api/1.1/nodes/%s/workflows/active", nodes[3].ID),
+					ghttp.RespondWith(http.StatusNoContent, []byte{}),
+				)
+				server.RouteToHandler("GET", fmt.Sprintf("/api/common/nodes/%s", nodes[3].ID),
+					ghttp.RespondWith(http.StatusOK, node3HttpResponse),
+				)
+
+				skuFilter := Filter{data: "5666e4b2a3a8be2c53a2c6b1", method: FilterBasedOnSKUMethod}
+				node, err := randomSelectAvailableNode(cpiConfig, nodes, skuFilter)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(node.ID).To(Equal(nodes[3].ID))
+			})
+
+			It("matches the sku links of the 2.0 API", func() {
+				cpiConfig.ApiVersion = config.ApiVersion2
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/api/2.0/nodes"),
+						ghttp.RespondWith(http.StatusOK, []byte(`[
+							{"id":"55e79ea54e66816f6152fff9","sku":"/api/2.0/skus/5666e4b2a3a8be2c53a2c6b1"},
+							{"id":"55e79eb14e66816f6152fffb","sku":"/api/2.0/skus/5666e4b2a3a8be2c53a2c6b2"}
+						]`)),
+					),
+				)
+
+				nodes, err := rackhdapi.GetNodes(cpiConfig)
+				Expect(err).ToNot(HaveOccurred())
+
+				skuFilter := Filter{data: "5666e4b2a3a8be2c53a2c6b1", method: FilterBasedOnSKUMethod}
+				valid, _, _ := skuFilter.Run(cpiConfig, nodes[0])
+				Expect(valid).To(BeTrue())
+				valid, _, _ = skuFilter.Run(cpiConfig, nodes[1])
+				Expect(valid).To(BeFalse())
+			})
+		})
+
+		Context("when a node is claimed by another request", func() {
+			It("skips the node until the claim expires", func() {
+				nodes := helpers.LoadNodes("../spec_assets/dummy_two_node_response.json")
+				for i := range nodes {
+					nodes[i].Claim = &rackhdapi.NodeClaim{
+						RequestID: "another-request",
+						ExpiresAt: time.Now().Add(time.Hour).Unix(),
+					}
+				}
+
+				_, err := randomSelectAvailableNode(cpiConfig, nodes, allowFilter)
+				Expect(err).To(MatchError("all nodes have been reserved"))
+				Expect(server.ReceivedRequests()).To(BeEmpty())
+			})
+		})
+
 		Context("when there is an available node", func() {
 			It("selects a free node for provisioning", func() {
 				nodes := helpers.LoadNodes("../spec_assets/dummy_two_node_response.json")
@@ -639,6 +1107,7 @@ var _ = Describe("The VM Creation Workflow", func() {
 
 		It("returns an error if selection continually fails", func() {
 			cpiConfig.MaxReserveNodeAttempts = 3
+
 			nodeID, err := TryReservation(
 				cpiConfig,
 				"",
@@ -649,6 +1118,21 @@ var _ = Describe("The VM Creation Workflow", func() {
 			Expect(nodeID).To(Equal(""))
 		})
 
+		It("leaves releasing the node to the reservation function", func() {
+			cpiConfig.MaxReserveNodeAttempts = 1
+
+			_, err := TryReservation(
+				cpiConfig,
+				"",
+				func(config.Cpi, string, Filter) (rackhdapi.Node, error) { return rackhdapi.Node{ID: "node-1234"}, nil },
+				func(config.Cpi, rackhdapi.Node) error {
+					return errors.New("error running reserve workflow: Timed out running workflow: Graph.BOSH.ReserveNode on node: node-1234")
+				},
+			)
+			Expect(err).To(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+
 		It("retries and eventually returns a node when selection is successful", func() {
 			cpiConfig.MaxReserveNodeAttempts = 3
 			tries := 0
@@ -669,6 +1153,26 @@ var _ = Describe("The VM Creation Workflow", func() {
 			Expect(nodeID).To(Equal("node-1234"))
 		})
 
+		It("moves on to another node when a claim conflicts", func() {
+			cpiConfig.MaxReserveNodeAttempts = 2
+			nodeIDs := []string{"node-1234", "node-5678"}
+			tries := 0
+			selectionFunc := func(config.Cpi, string, Filter) (rackhdapi.Node, error) {
+				return rackhdapi.Node{ID: nodeIDs[tries]}, nil
+			}
+			reservationFunc := func(c config.Cpi, node rackhdapi.Node) error {
+				if tries == 0 {
+					tries++
+					return fmt.Errorf("%s: node %s was claimed by request another-request", rackhdapi.NodeClaimConflict, node.ID)
+				}
+				return nil
+			}
+
+			nodeID, err := TryReservation(cpiConfig, "", selectionFunc, reservationFunc)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nodeID).To(Equal("node-5678"))
+		})
+
 		It("cleans up reservation flag after receive timeout error on reserve function", func() {
 			apiServer, err := helpers.GetRackHDHost()
 			Expect(err).ToNot(HaveOccurred())
@@ -738,6 +1242,174 @@ var _ = Describe("The VM Creation Workflow", func() {
 		})
 	})
 
+	Describe("reserving a node", func() {
+		node := rackhdapi.Node{ID: "node-1234", Status: rackhdapi.Available}
+
+		claimedBy := func(requestID string) []byte {
+			claimedNode := node
+			claimedNode.Claim = &rackhdapi.NodeClaim{RequestID: requestID, ExpiresAt: time.Now().Add(time.Hour).Unix()}
+			claimedNodeData, err := json.Marshal(claimedNode)
+			Expect(err).ToNot(HaveOccurred())
+			return claimedNodeData
+		}
+
+		BeforeEach(func() {
+			rackhdapi.ClaimSettleTime = 0
+			cpiConfig.RequestID = "my-request"
+		})
+
+		It("does not release a node it failed to claim", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes/node-1234"),
+					ghttp.RespondWith(http.StatusNotFound, []byte("node not found")),
+				),
+			)
+
+			err := ReserveNodeFromRackHD(cpiConfig, node)
+			Expect(err).To(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("releases a node it claimed but failed to lease", func() {
+			nodeData, err := json.Marshal(node)
+			Expect(err).ToNot(HaveOccurred())
+
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes/node-1234"),
+					ghttp.RespondWith(http.StatusOK, nodeData),
+				),
+				ghttp.VerifyRequest("PATCH", "/api/common/nodes/node-1234"),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes/node-1234"),
+					ghttp.RespondWith(http.StatusOK, claimedBy(cpiConfig.RequestID)),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", "/api/common/nodes/node-1234"),
+					ghttp.RespondWith(http.StatusNotFound, []byte("node not found")),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes/node-1234"),
+					ghttp.RespondWith(http.StatusOK, claimedBy(cpiConfig.RequestID)),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", "/api/common/nodes/node-1234"),
+					ghttp.VerifyJSON(`{"status": "available", "cpi_lease": null, "cpi_claim": null}`),
+				),
+			)
+
+			err = ReserveNodeFromRackHD(cpiConfig, node)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("error leasing node node-1234: "))
+			Expect(server.ReceivedRequests()).To(HaveLen(6))
+		})
+
+		It("leaves a node another request has claimed since", func() {
+			nodeData, err := json.Marshal(node)
+			Expect(err).ToNot(HaveOccurred())
+
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes/node-1234"),
+					ghttp.RespondWith(http.StatusOK, nodeData),
+				),
+				ghttp.VerifyRequest("PATCH", "/api/common/nodes/node-1234"),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes/node-1234"),
+					ghttp.RespondWith(http.StatusOK, claimedBy(cpiConfig.RequestID)),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", "/api/common/nodes/node-1234"),
+					ghttp.RespondWith(http.StatusNotFound, []byte("node not found")),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes/node-1234"),
+					ghttp.RespondWith(http.StatusOK, claimedBy("other-request")),
+				),
+			)
+
+			err = ReserveNodeFromRackHD(cpiConfig, node)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix(rackhdapi.NodeClaimConflict))
+			Expect(server.ReceivedRequests()).To(HaveLen(5))
+		})
+	})
+
+	Describe("rolling back a failed vm creation", func() {
+		nodeID := "55e79ea54e66816f6152fff9"
+
+		It("cancels the active workflow, clears the pregenerated disk cid and releases the node", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/1.1/nodes/%s/workflows/active", nodeID)),
+					ghttp.RespondWith(http.StatusOK, []byte(`{"id":"graph-id","_status":"running"}`)),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("DELETE", fmt.Sprintf("/api/1.1/nodes/%s/workflows/active", nodeID)),
+					ghttp.RespondWith(http.StatusNoContent, nil),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", nodeID)),
+					ghttp.VerifyJSON(`{"persistent_disk":{"pregenerated_disk_cid":"","disk_cid":"","location":"","attached":false}}`),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", nodeID)),
+					ghttp.VerifyJSON(`{"status":"available","cpi_lease":null,"cpi_claim":null}`),
+				),
+			)
+
+			err := rollbackCreateVM(cpiConfig, nodeID, false, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(4))
+		})
+
+		It("only removes the claim on a node holding the persistent disk", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/1.1/nodes/%s/workflows/active", nodeID)),
+					ghttp.RespondWith(http.StatusNoContent, nil),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", nodeID)),
+					ghttp.VerifyJSON(`{"cpi_claim":null}`),
+				),
+			)
+
+			err := rollbackCreateVM(cpiConfig, nodeID, true, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("releases the node even if the workflow cannot be cancelled", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/1.1/nodes/%s/workflows/active", nodeID)),
+					ghttp.RespondWith(http.StatusNotFound, []byte("node not found")),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", nodeID)),
+					ghttp.VerifyJSON(`{"status":"available","cpi_lease":null,"cpi_claim":null}`),
+				),
+			)
+
+			err := rollbackCreateVM(cpiConfig, nodeID, false, false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix(fmt.Sprintf("error rolling back node %s: error cancelling active workflow: ", nodeID)))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("reports the rollback error along with the original error", func() {
+			err := withRollbackError(bosh.NewVMCreationFailedError(errors.New("error running provision workflow"), true), errors.New("error rolling back node"))
+			Expect(err).To(MatchError("error running provision workflow; error rolling back node"))
+			Expect(err.(bosh.CloudError).Type).To(Equal(bosh.VMCreationFailedErrorType))
+			Expect(err.(bosh.CloudError).OkToRetry).To(BeTrue())
+
+			err = withRollbackError(errors.New("error getting catalog"), nil)
+			Expect(err).To(MatchError("error getting catalog"))
+		})
+	})
+
 	Context("reserving multiple nodes simultaneously", func() {
 		XIt("works", func() {
 			var wg sync.WaitGroup
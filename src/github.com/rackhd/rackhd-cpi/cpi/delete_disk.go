@@ -20,36 +20,30 @@ func DeleteDisk(c config.Cpi, extInput bosh.MethodArguments) error {
 
 	diskCID = extInput[0].(string)
 
-	nodes, err := rackhdapi.GetNodes(c)
+	node, err := rackhdapi.GetNodeByDiskCID(c, diskCID)
+	if err != nil {
+		return asDiskNotFound(err)
+	}
+
+	if node.PersistentDisk.IsAttached {
+		return fmt.Errorf("Disk: %s is attached\n", diskCID)
+	}
+
+	container := rackhdapi.PersistentDiskSettingsContainer{
+		PersistentDisk: rackhdapi.PersistentDiskSettings{},
+	}
+	bodyBytes, err := json.Marshal(container)
 	if err != nil {
 		return err
 	}
+	rackhdapi.PatchNode(c, node.ID, bodyBytes)
 
-	for _, node := range nodes {
-		if node.PersistentDisk.DiskCID == diskCID {
-			if node.PersistentDisk.IsAttached {
-				return fmt.Errorf("Disk: %s is attached\n", diskCID)
-			}
-
-			container := rackhdapi.PersistentDiskSettingsContainer{
-				PersistentDisk: rackhdapi.PersistentDiskSettings{},
-			}
-			bodyBytes, err := json.Marshal(container)
-			if err != nil {
-				return err
-			}
-			rackhdapi.PatchNode(c, node.ID, bodyBytes)
-
-			if node.CID == "" {
-				err = rackhdapi.ReleaseNode(c, node.ID)
-				if err != nil {
-					fmt.Errorf("error releasing node after delete disk %s: %v", diskCID, err)
-				}
-			}
-
-			return nil
+	if node.CID == "" {
+		err = rackhdapi.ReleaseNode(c, node.ID)
+		if err != nil {
+			fmt.Errorf("error releasing node after delete disk %s: %v", diskCID, err)
 		}
 	}
 
-	return fmt.Errorf("Disk: %s not found\n", diskCID)
+	return nil
 }
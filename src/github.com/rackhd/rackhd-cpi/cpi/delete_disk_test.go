@@ -121,7 +121,8 @@ var _ = Describe("DeleteDisk", func() {
 			)
 
 			err = DeleteDisk(cpiConfig, extInput)
-			Expect(err).To(MatchError("Disk: invalid_disk_cid not found\n"))
+			Expect(err).To(MatchError("disk with cid: invalid_disk_cid was not found"))
+			Expect(err.(bosh.CloudError).Type).To(Equal(bosh.DiskNotFoundErrorType))
 			Expect(len(server.ReceivedRequests())).To(Equal(1))
 		})
 	})
@@ -0,0 +1,47 @@
+package cpi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/rackhd/rackhd-cpi/bosh"
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+func DeleteSnapshot(c config.Cpi, extInput bosh.MethodArguments) error {
+	var snapshotCID string
+	if reflect.TypeOf(extInput[0]) != reflect.TypeOf(snapshotCID) {
+		return errors.New("Received unexpected type for snapshot cid")
+	}
+
+	snapshotCID = extInput[0].(string)
+	node, err := rackhdapi.GetNodeBySnapshotCID(c, snapshotCID)
+	if err != nil {
+		return err
+	}
+
+	err = rackhdapi.DeleteFile(c, snapshotCID)
+	if err != nil {
+		return fmt.Errorf("error deleting snapshot %s: %s", snapshotCID, err)
+	}
+
+	container := rackhdapi.PersistentDiskSettingsContainer{
+		PersistentDisk: node.PersistentDisk,
+	}
+	container.PersistentDisk.Snapshots = []string{}
+	for _, snapshot := range node.PersistentDisk.Snapshots {
+		if snapshot != snapshotCID {
+			container.PersistentDisk.Snapshots = append(container.PersistentDisk.Snapshots, snapshot)
+		}
+	}
+
+	bodyBytes, err := json.Marshal(container)
+	if err != nil {
+		return fmt.Errorf("error marshalling persistent disk information for snapshot %s", snapshotCID)
+	}
+
+	return rackhdapi.PatchNode(c, node.ID, bodyBytes)
+}
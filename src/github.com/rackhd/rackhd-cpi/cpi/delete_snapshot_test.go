@@ -0,0 +1,92 @@
+package cpi_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/onsi/gomega/ghttp"
+	"github.com/rackhd/rackhd-cpi/bosh"
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/cpi"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+var _ = Describe("DeleteSnapshot", func() {
+	var server *ghttp.Server
+	var cpiConfig config.Cpi
+
+	BeforeEach(func() {
+		server, _, cpiConfig, _ = helpers.SetUp(bosh.DELETE_SNAPSHOT)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("with a known snapshot CID", func() {
+		It("deletes the snapshot file and removes it from the node", func() {
+			nodeID := "55e79ea54e66816f6152fff9"
+			snapshotCID := fmt.Sprintf("%s-snapshot-first", nodeID)
+			otherSnapshotCID := fmt.Sprintf("%s-snapshot-second", nodeID)
+
+			expectedNodes := helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json")
+			expectedNodes[0].PersistentDisk.Snapshots = []string{snapshotCID, otherSnapshotCID}
+			expectedNodesData, err := json.Marshal(expectedNodes)
+			Expect(err).ToNot(HaveOccurred())
+
+			container := rackhdapi.PersistentDiskSettingsContainer{
+				PersistentDisk: expectedNodes[0].PersistentDisk,
+			}
+			container.PersistentDisk.Snapshots = []string{otherSnapshotCID}
+			expectedPersistentDiskSettings, err := json.Marshal(container)
+			Expect(err).ToNot(HaveOccurred())
+
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, expectedNodesData),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/files/metadata/%s", snapshotCID)),
+					ghttp.RespondWith(http.StatusOK, []byte(`[{"uuid": "snapshot-file-uuid"}]`)),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("DELETE", "/api/common/files/snapshot-file-uuid"),
+					ghttp.RespondWith(http.StatusNoContent, nil),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", nodeID)),
+					ghttp.VerifyJSON(string(expectedPersistentDiskSettings)),
+				),
+			)
+
+			err = cpi.DeleteSnapshot(cpiConfig, bosh.MethodArguments{snapshotCID})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(4))
+		})
+	})
+
+	Context("with an unknown snapshot CID", func() {
+		It("returns an error", func() {
+			expectedNodes := helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json")
+			expectedNodesData, err := json.Marshal(expectedNodes)
+			Expect(err).ToNot(HaveOccurred())
+
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, expectedNodesData),
+				),
+			)
+
+			err = cpi.DeleteSnapshot(cpiConfig, bosh.MethodArguments{"missing-snapshot"})
+			Expect(err).To(MatchError("snapshot with cid: missing-snapshot was not found"))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+})
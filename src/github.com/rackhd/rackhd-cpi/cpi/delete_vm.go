@@ -19,7 +19,7 @@ func DeleteVM(c config.Cpi, extInput bosh.MethodArguments) error {
 	cid = extInput[0].(string)
 	node, err := rackhdapi.GetNodeByVMCID(c, cid)
 	if err != nil {
-		return err
+		return asVMNotFound(err)
 	}
 
 	if node.PersistentDisk.IsAttached {
@@ -40,11 +40,8 @@ func DeleteVM(c config.Cpi, extInput bosh.MethodArguments) error {
 	}
 
 	if node.PersistentDisk.DiskCID == "" {
-		err = rackhdapi.ReleaseNode(c, node.ID)
-		if err != nil {
-			return err
-		}
+		return rackhdapi.ReleaseLeasedNode(c, node.ID)
 	}
 
-	return nil
+	return rackhdapi.EndReservation(c, node.ID)
 }
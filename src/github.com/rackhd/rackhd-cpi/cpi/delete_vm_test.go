@@ -50,7 +50,7 @@ var _ = Describe("DeleteVM", func() {
 		})
 
 		Context("when there is a persistent disk left before deprovisioning", func() {
-			It("deprovisions the node", func() {
+			It("deprovisions the node and ends its reservation", func() {
 				jsonInput := []byte(`["vm-5678"]`)
 				err := json.Unmarshal(jsonInput, &extInput)
 				Expect(err).NotTo(HaveOccurred())
@@ -62,10 +62,16 @@ var _ = Describe("DeleteVM", func() {
 						"55e79ea54e66816f6152fff9",
 					)...,
 				)
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("PATCH", "/api/common/nodes/55e79ea54e66816f6152fff9"),
+						ghttp.VerifyJSON(`{"cpi_claim": null, "cpi_lease": null}`),
+					),
+				)
 
 				err = cpi.DeleteVM(cpiConfig, extInput)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(len(server.ReceivedRequests())).To(Equal(8))
+				Expect(len(server.ReceivedRequests())).To(Equal(10))
 			})
 		})
 
@@ -85,13 +91,13 @@ var _ = Describe("DeleteVM", func() {
 				server.AppendHandlers(
 					ghttp.CombineHandlers(
 						ghttp.VerifyRequest("PATCH", "/api/common/nodes/55e79eb14e66816f6152fffb"),
-						ghttp.VerifyJSON("{\"status\": \"available\"}"),
+						ghttp.VerifyJSON(`{"status": "available", "cpi_claim": null, "cpi_lease": null}`),
 					),
 				)
 
 				err = cpi.DeleteVM(cpiConfig, extInput)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(len(server.ReceivedRequests())).To(Equal(9))
+				Expect(len(server.ReceivedRequests())).To(Equal(10))
 			})
 		})
 
@@ -124,10 +130,33 @@ var _ = Describe("DeleteVM", func() {
 						nodeID,
 					)...,
 				)
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", nodeID)),
+						ghttp.VerifyJSON(`{"cpi_claim": null, "cpi_lease": null}`),
+					),
+				)
 				err = cpi.DeleteVM(cpiConfig, extInput)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(len(server.ReceivedRequests())).To(Equal(9))
+				Expect(len(server.ReceivedRequests())).To(Equal(11))
 			})
 		})
 	})
+	Context("with a VM CID that is not on any node", func() {
+		It("returns a VM not found error", func() {
+			nodesData, err := json.Marshal(helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json"))
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, nodesData),
+				),
+			)
+
+			err = cpi.DeleteVM(cpiConfig, bosh.MethodArguments{"missing-vm-cid"})
+			Expect(err).To(MatchError("vm with cid: missing-vm-cid was not found"))
+			Expect(err.(bosh.CloudError).Type).To(Equal(bosh.VMNotFoundErrorType))
+			Expect(err.(bosh.CloudError).OkToRetry).To(BeFalse())
+		})
+	})
 })
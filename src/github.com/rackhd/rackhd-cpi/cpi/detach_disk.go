@@ -25,24 +25,18 @@ func DetachDisk(c config.Cpi, extInput bosh.MethodArguments) error {
 	vmCID = extInput[0].(string)
 	diskCID = extInput[1].(string)
 
-	nodes, err := rackhdapi.GetNodes(c)
+	node, err := rackhdapi.GetNodeByDiskCID(c, diskCID)
 	if err != nil {
-		return err
+		return asDiskNotFound(err)
 	}
 
-	for _, node := range nodes {
-		if node.PersistentDisk.DiskCID == diskCID {
-			if !node.PersistentDisk.IsAttached {
-				return fmt.Errorf("Disk: %s is detached\n", diskCID)
-			}
-
-			if node.CID != vmCID {
-				return fmt.Errorf("Disk %s does not belong to VM %s\n", diskCID, vmCID)
-			}
+	if !node.PersistentDisk.IsAttached {
+		return bosh.NewDiskNotAttachedError(fmt.Errorf("Disk: %s is detached\n", diskCID), true)
+	}
 
-			return rackhdapi.MakeDiskRequest(c, node, false)
-		}
+	if node.CID != vmCID {
+		return bosh.NewDiskNotAttachedError(fmt.Errorf("Disk %s does not belong to VM %s\n", diskCID, vmCID), false)
 	}
 
-	return fmt.Errorf("Disk: %s not found\n", diskCID)
+	return rackhdapi.MakeDiskRequest(c, node, false)
 }
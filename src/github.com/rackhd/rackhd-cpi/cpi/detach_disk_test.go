@@ -53,6 +53,8 @@ var _ = Describe("DetachDisk", func() {
 
 				err = DetachDisk(cpiConfig, extInput)
 				Expect(err).To(MatchError("Disk: valid_disk_cid_1 is detached\n"))
+				Expect(err.(bosh.CloudError).Type).To(Equal(bosh.DiskNotAttachedErrorType))
+				Expect(err.(bosh.CloudError).OkToRetry).To(BeTrue())
 				Expect(len(server.ReceivedRequests())).To(Equal(1))
 			})
 		})
@@ -147,7 +149,8 @@ var _ = Describe("DetachDisk", func() {
 			)
 
 			err = DetachDisk(cpiConfig, extInput)
-			Expect(err).To(MatchError("Disk: invalid_disk_cid not found\n"))
+			Expect(err).To(MatchError("disk with cid: invalid_disk_cid was not found"))
+			Expect(err.(bosh.CloudError).Type).To(Equal(bosh.DiskNotFoundErrorType))
 			Expect(len(server.ReceivedRequests())).To(Equal(1))
 		})
 	})
@@ -0,0 +1,22 @@
+package cpi
+
+import (
+	"github.com/rackhd/rackhd-cpi/bosh"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+func asVMNotFound(err error) error {
+	if _, notFound := err.(rackhdapi.NotFoundError); notFound {
+		return bosh.NewVMNotFoundError(err)
+	}
+
+	return err
+}
+
+func asDiskNotFound(err error) error {
+	if _, notFound := err.(rackhdapi.NotFoundError); notFound {
+		return bosh.NewDiskNotFoundError(err)
+	}
+
+	return err
+}
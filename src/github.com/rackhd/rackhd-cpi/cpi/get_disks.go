@@ -20,7 +20,7 @@ func GetDisks(c config.Cpi, extInput bosh.MethodArguments) ([]string, error) {
 
 	node, err := rackhdapi.GetNodeByVMCID(c, vmCID)
 	if err != nil {
-		return nil, err
+		return nil, asVMNotFound(err)
 	}
 
 	if node.PersistentDisk.DiskCID != "" {
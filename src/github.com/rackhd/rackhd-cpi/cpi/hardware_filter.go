@@ -0,0 +1,157 @@
+package cpi
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+type hardwareRequirements struct {
+	MinCPUCores     int    `json:"min_cpu_cores"`
+	MinMemoryMB     int    `json:"min_memory_mb"`
+	MinDisks        int    `json:"min_disks"`
+	MinDiskSizeMB   int    `json:"min_disk_size_mb"`
+	MinNICs         int    `json:"min_nics"`
+	MinNICSpeedMbps int    `json:"min_nic_speed_mbps"`
+	CPUModel        string `json:"cpu_model"`
+}
+
+var diskDevicePattern = regexp.MustCompile(`^(sd|hd|vd|nvme)`)
+
+func (r hardwareRequirements) required() bool {
+	return r != hardwareRequirements{}
+}
+
+func (r hardwareRequirements) validate() error {
+	for name, value := range map[string]int{
+		"min_cpu_cores":      r.MinCPUCores,
+		"min_memory_mb":      r.MinMemoryMB,
+		"min_disks":          r.MinDisks,
+		"min_disk_size_mb":   r.MinDiskSizeMB,
+		"min_nics":           r.MinNICs,
+		"min_nic_speed_mbps": r.MinNICSpeedMbps,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s cannot be negative", name)
+		}
+	}
+
+	if r.CPUModel != "" {
+		if _, err := regexp.Compile(r.CPUModel); err != nil {
+			return fmt.Errorf("cpu_model is not a valid regular expression: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (f Filter) FilterBasedOnHardware(c config.Cpi, node rackhdapi.Node) (bool, string, error) {
+	requirements, ok := f.data.(hardwareRequirements)
+	if !ok {
+		return false, "", errors.New("error converting hardware requirements: requirements have unexpected type")
+	}
+
+	catalog, err := nodeInfo.catalog(c, node.ID)
+	if err != nil {
+		return false, "", fmt.Errorf("error getting catalog of VM: %s", node.ID)
+	}
+
+	var unmet []string
+	if requirements.MinCPUCores > 0 {
+		cores := catalog.Data.CPU.Cores
+		if cores == 0 {
+			cores = catalog.Data.CPU.Total
+		}
+		if cores < requirements.MinCPUCores {
+			unmet = append(unmet, fmt.Sprintf("has %d cpu cores, requires %d", cores, requirements.MinCPUCores))
+		}
+	}
+
+	if requirements.CPUModel != "" {
+		model := catalog.Data.CPU.Processor.ModelName
+		if !regexp.MustCompile(requirements.CPUModel).MatchString(model) {
+			unmet = append(unmet, fmt.Sprintf("has cpu model %q, requires %s", model, requirements.CPUModel))
+		}
+	}
+
+	if requirements.MinMemoryMB > 0 {
+		memoryKB, err := strconv.Atoi(strings.TrimSuffix(catalog.Data.Memory.Total, "kB"))
+		if err != nil {
+			unmet = append(unmet, "has unknown memory size")
+		} else if memoryKB < requirements.MinMemoryMB*1024 {
+			unmet = append(unmet, fmt.Sprintf("has %dMB memory, requires %dMB", memoryKB/1024, requirements.MinMemoryMB))
+		}
+	}
+
+	if requirements.MinDisks > 0 || requirements.MinDiskSizeMB > 0 {
+		minDisks := requirements.MinDisks
+		if minDisks == 0 {
+			minDisks = 1
+		}
+
+		disks := 0
+		for name, device := range catalog.Data.BlockDevices {
+			if !diskDevicePattern.MatchString(name) {
+				continue
+			}
+			sizeInKB, err := strconv.Atoi(device.Size)
+			if err == nil && sizeInKB >= requirements.MinDiskSizeMB*1024 {
+				disks++
+			}
+		}
+
+		if disks < minDisks {
+			unmet = append(unmet, fmt.Sprintf("has %d disks of at least %dMB, requires %d", disks, requirements.MinDiskSizeMB, minDisks))
+		}
+	}
+
+	if requirements.MinNICs > 0 || requirements.MinNICSpeedMbps > 0 {
+		minNICs := requirements.MinNICs
+		if minNICs == 0 {
+			minNICs = 1
+		}
+
+		nics := 0
+		if requirements.MinNICSpeedMbps > 0 {
+			lshw, err := nodeInfo.lshwCatalog(c, node.ID)
+			if err != nil {
+				return false, "", fmt.Errorf("error getting lshw catalog of VM: %s", node.ID)
+			}
+			nics = countNICs(lshw.Data, int64(requirements.MinNICSpeedMbps)*1000*1000)
+		} else {
+			for _, nodeNetwork := range catalog.Data.NetworkData.Networks {
+				if nodeNetwork.Encapsulation == rackhdapi.EthernetNetwork {
+					nics++
+				}
+			}
+		}
+
+		if nics < minNICs {
+			unmet = append(unmet, fmt.Sprintf("has %d nics of at least %dMbps, requires %d", nics, requirements.MinNICSpeedMbps, minNICs))
+		}
+	}
+
+	if len(unmet) > 0 {
+		return false, strings.Join(unmet, ", "), nil
+	}
+
+	return true, "", nil
+}
+
+func countNICs(device rackhdapi.LSHWDevice, minCapacity int64) int {
+	count := 0
+	if device.Class == "network" && device.Capacity >= minCapacity {
+		count++
+	}
+
+	for _, child := range device.Children {
+		count += countNICs(child, minCapacity)
+	}
+
+	return count
+}
@@ -0,0 +1,158 @@
+package cpi
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/onsi/gomega/ghttp"
+	"github.com/rackhd/rackhd-cpi/bosh"
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Filtering nodes on hardware", func() {
+	var server *ghttp.Server
+	var cpiConfig config.Cpi
+	var node rackhdapi.Node
+
+	BeforeEach(func() {
+		server, _, cpiConfig, _ = helpers.SetUp(bosh.CREATE_VM)
+		node = rackhdapi.Node{ID: "55e79ea54e66816f6152fff9"}
+		server.RouteToHandler("GET", fmt.Sprintf("/api/common/nodes/%s/catalogs/ohai", node.ID),
+			ghttp.RespondWith(http.StatusOK, helpers.LoadJSON("../spec_assets/dummy_node_catalog_hardware_response.json")),
+		)
+		server.RouteToHandler("GET", fmt.Sprintf("/api/common/nodes/%s/catalogs/lshw", node.ID),
+			ghttp.RespondWith(http.StatusOK, helpers.LoadJSON("../spec_assets/dummy_node_lshw_catalog_response.json")),
+		)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("accepts a node that meets every requirement", func() {
+		filter := Filter{hardwareRequirements{
+			MinCPUCores:   24,
+			MinMemoryMB:   128 * 1024,
+			MinDisks:      2,
+			MinDiskSizeMB: 1024 * 1024,
+			MinNICs:       2,
+			CPUModel:      "E5-26[0-9]{2} v3",
+		}, FilterBasedOnHardwareMethod}
+
+		valid, reason, err := filter.Run(cpiConfig, node)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(valid).To(BeTrue())
+		Expect(reason).To(BeEmpty())
+	})
+
+	It("lists every requirement a node does not meet", func() {
+		filter := Filter{hardwareRequirements{
+			MinCPUCores: 32,
+			MinMemoryMB: 256 * 1024,
+			MinDisks:    4,
+			CPUModel:    "E7-",
+		}, FilterBasedOnHardwareMethod}
+
+		valid, reason, err := filter.Run(cpiConfig, node)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(valid).To(BeFalse())
+		Expect(reason).To(Equal(`has 24 cpu cores, requires 32, has cpu model "Intel(R) Xeon(R) CPU E5-2680 v3 @ 2.50GHz", requires E7-, has 131072MB memory, requires 262144MB, has 3 disks of at least 0MB, requires 4`))
+	})
+
+	It("counts nics by speed from the lshw catalog", func() {
+		filter := Filter{hardwareRequirements{MinNICs: 2, MinNICSpeedMbps: 10000}, FilterBasedOnHardwareMethod}
+
+		valid, reason, err := filter.Run(cpiConfig, node)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(valid).To(BeFalse())
+		Expect(reason).To(Equal("has 1 nics of at least 10000Mbps, requires 2"))
+	})
+
+	It("composes with other filters", func() {
+		filter := AllFilters(
+			Filter{"5666e4b2a3a8be2c53a2c6b1", FilterBasedOnSKUMethod},
+			Filter{hardwareRequirements{MinCPUCores: 24}, FilterBasedOnHardwareMethod},
+		)
+
+		node.SKU = "5666e4b2a3a8be2c53a2c6b2"
+		valid, reason, err := filter.Run(cpiConfig, node)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(valid).To(BeFalse())
+		Expect(reason).To(Equal("has sku 5666e4b2a3a8be2c53a2c6b2, requires 5666e4b2a3a8be2c53a2c6b1"))
+
+		node.SKU = "5666e4b2a3a8be2c53a2c6b1"
+		valid, reason, err = filter.Run(cpiConfig, node)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(valid).To(BeTrue())
+		Expect(reason).To(BeEmpty())
+	})
+
+	It("explains why each candidate was rejected when no node matches", func() {
+		nodes := helpers.LoadNodes("../spec_assets/dummy_two_node_response.json")
+		nodes[1].Status = rackhdapi.Available
+		nodes[1].CID = ""
+		for i := range nodes {
+			nodes[i].SKU = "5666e4b2a3a8be2c53a2c6b2"
+		}
+
+		_, err := randomSelectAvailableNode(cpiConfig, nodes, Filter{"5666e4b2a3a8be2c53a2c6b1", FilterBasedOnSKUMethod})
+		Expect(err).To(MatchError("no available node meets the requirements: " +
+			"node 55e79ea54e66816f6152fff9 has sku 5666e4b2a3a8be2c53a2c6b2, requires 5666e4b2a3a8be2c53a2c6b1; " +
+			"node 55e79eb14e66816f6152fffb has sku 5666e4b2a3a8be2c53a2c6b2, requires 5666e4b2a3a8be2c53a2c6b1"))
+	})
+
+	It("logs rejections at debug rather than as errors", func() {
+		logOutput := new(bytes.Buffer)
+		log.SetOutput(logOutput)
+		defer log.SetOutput(ioutil.Discard)
+
+		node.SKU = "5666e4b2a3a8be2c53a2c6b2"
+		rejections := map[string]string{}
+		Expect(hasNotBeenFiltered(cpiConfig, node, Filter{"5666e4b2a3a8be2c53a2c6b1", FilterBasedOnSKUMethod}, rejections)).To(BeFalse())
+		Expect(rejections[node.ID]).To(Equal("has sku 5666e4b2a3a8be2c53a2c6b2, requires 5666e4b2a3a8be2c53a2c6b1"))
+		Expect(logOutput.String()).ToNot(ContainSubstring("level=error"))
+	})
+
+	Describe("parsing hardware requirements", func() {
+		It("reads requirements from cloud properties", func() {
+			extInput := bosh.MethodArguments{"agent-id", "vm-478585", map[string]interface{}{
+				"min_cpu_cores":      16,
+				"min_memory_mb":      65536,
+				"min_nic_speed_mbps": 10000,
+				"cpu_model":          "Xeon",
+			}}
+
+			properties, err := parseVMCloudProperties(extInput)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(properties.Hardware).To(Equal(hardwareRequirements{
+				MinCPUCores:     16,
+				MinMemoryMB:     65536,
+				MinNICSpeedMbps: 10000,
+				CPUModel:        "Xeon",
+			}))
+		})
+
+		It("returns an error if the cpu model is not a regular expression", func() {
+			extInput := bosh.MethodArguments{"agent-id", "vm-478585", map[string]interface{}{"cpu_model": "Xeon("}}
+
+			_, err := parseVMCloudProperties(extInput)
+			Expect(err).To(MatchError("hardware requirements in cloud properties are invalid: cpu_model is not a valid regular expression: error parsing regexp: missing closing ): `Xeon(`"))
+		})
+
+		It("returns an error if a requirement is negative", func() {
+			extInput := bosh.MethodArguments{"agent-id", "vm-478585", map[string]interface{}{"min_disks": -1}}
+
+			_, err := parseVMCloudProperties(extInput)
+			Expect(err).To(MatchError("hardware requirements in cloud properties are invalid: min_disks cannot be negative"))
+		})
+	})
+})
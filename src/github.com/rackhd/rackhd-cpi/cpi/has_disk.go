@@ -22,16 +22,13 @@ func HasDisk(c config.Cpi, extInput bosh.MethodArguments) (bool, error) {
 		return false, nil
 	}
 
-	nodes, err := rackhdapi.GetNodes(c)
+	_, err := rackhdapi.GetNodeByDiskCID(c, diskCID)
+	if _, notFound := err.(rackhdapi.NotFoundError); notFound {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
 
-	for _, node := range nodes {
-		if node.PersistentDisk.DiskCID == diskCID {
-			return true, nil
-		}
-	}
-
-	return false, nil
+	return true, nil
 }
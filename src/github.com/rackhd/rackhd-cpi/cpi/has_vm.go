@@ -17,16 +17,13 @@ func HasVM(c config.Cpi, extInput bosh.MethodArguments) (bool, error) {
 
 	cid = extInput[0].(string)
 
-	nodes, err := rackhdapi.GetNodes(c)
+	_, err := rackhdapi.GetNodeByVMCID(c, cid)
+	if _, notFound := err.(rackhdapi.NotFoundError); notFound {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
 
-	for _, node := range nodes {
-		if node.CID == cid {
-			return true, nil
-		}
-	}
-
-	return false, nil
+	return true, nil
 }
@@ -11,7 +11,7 @@ var cpiMethods = map[string]bool{
 	bosh.CREATE_VM:          true,
 	bosh.DELETE_VM:          true,
 	bosh.HAS_VM:             true,
-	bosh.REBOOT_VM:          false,
+	bosh.REBOOT_VM:          true,
 	bosh.SET_VM_METADATA:    true,
 	bosh.CONFIGURE_NETWORKS: false,
 	bosh.CREATE_STEMCELL:    true,
@@ -23,7 +23,7 @@ var cpiMethods = map[string]bool{
 	bosh.HAS_DISK:           true,
 	bosh.GET_DISKS:          true,
 	bosh.SNAPSHOT_DISK:      false,
-	bosh.DELETE_SNAPSHOT:    false,
+	bosh.DELETE_SNAPSHOT:    true,
 	bosh.CURRENT_VM_ID:      false,
 }
 
@@ -0,0 +1,194 @@
+package cpi
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rackhd/rackhd-cpi/bosh"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+type interfaceStanza struct {
+	device  string
+	method  string
+	options []string
+}
+
+type networkBond struct {
+	device string
+	mode   string
+	slaves []string
+}
+
+func needsInterfacesFile(networks map[string]bosh.Network) bool {
+	for _, network := range networks {
+		if network.Bond != nil || network.VLANID != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// renderNetworkInterfaces writes an ifupdown interfaces file for the bonds and
+// VLANs the agent settings describe, since the stemcell cannot create them itself.
+// The provision task verifies its md5, installs it in /etc/network/interfaces.d
+// and makes /etc/network/interfaces source that directory.
+func renderNetworkInterfaces(nodeNetworks map[string]rackhdapi.Network, networks map[string]bosh.Network) ([]byte, error) {
+	interfaceNames := map[string]string{}
+	for interfaceName, nodeNetwork := range nodeNetworks {
+		if mac := macAddress(nodeNetwork); mac != "" {
+			interfaceNames[mac] = interfaceName
+		}
+	}
+
+	netNames := make([]string, 0, len(networks))
+	for netName := range networks {
+		netNames = append(netNames, netName)
+	}
+	sort.Strings(netNames)
+
+	var bonds []networkBond
+	bondDevices := map[string]int{}
+	bondOfSlave := map[string]string{}
+	isBond := map[string]bool{}
+	var rawDevices []string
+	rawDeviceSeen := map[string]bool{}
+	devicesInUse := map[string]string{}
+	var stanzas []interfaceStanza
+
+	for _, netName := range netNames {
+		network := networks[netName]
+
+		var rawDevice string
+		if network.Bond != nil {
+			var slaves []string
+			for _, mac := range network.Bond.Members {
+				interfaceName, found := interfaceNames[strings.ToLower(mac)]
+				if !found {
+					return nil, fmt.Errorf("error rendering network %s: node has no interface with mac %s", netName, mac)
+				}
+				slaves = append(slaves, interfaceName)
+			}
+			sort.Strings(slaves)
+
+			key := strings.Join(slaves, ",")
+			index, exists := bondDevices[key]
+			if !exists {
+				index = len(bonds)
+				bondDevices[key] = index
+				bonds = append(bonds, networkBond{device: fmt.Sprintf("bond%d", index), mode: network.Bond.Mode, slaves: slaves})
+				isBond[bonds[index].device] = true
+			}
+			bond := bonds[index]
+
+			if bond.mode != network.Bond.Mode {
+				return nil, fmt.Errorf("error rendering network %s: %s is configured with both mode %s and mode %s", netName, bond.device, bond.mode, network.Bond.Mode)
+			}
+
+			for _, slave := range slaves {
+				if otherBond, enslaved := bondOfSlave[slave]; enslaved && otherBond != bond.device {
+					return nil, fmt.Errorf("error rendering network %s: interface %s is a member of both %s and %s", netName, slave, otherBond, bond.device)
+				}
+				bondOfSlave[slave] = bond.device
+			}
+
+			rawDevice = bond.device
+		} else {
+			interfaceName, found := interfaceNames[strings.ToLower(network.MAC)]
+			if !found {
+				return nil, fmt.Errorf("error rendering network %s: node has no interface with mac %s", netName, network.MAC)
+			}
+			rawDevice = interfaceName
+		}
+
+		device := rawDevice
+		if network.VLANID != 0 {
+			device = fmt.Sprintf("%s.%d", rawDevice, network.VLANID)
+			if !rawDeviceSeen[rawDevice] {
+				rawDeviceSeen[rawDevice] = true
+				rawDevices = append(rawDevices, rawDevice)
+			}
+		}
+
+		if otherNetwork, inUse := devicesInUse[device]; inUse {
+			return nil, fmt.Errorf("error rendering network %s: device %s is already used by network %s", netName, device, otherNetwork)
+		}
+		devicesInUse[device] = netName
+
+		stanza := interfaceStanza{device: device, method: "dhcp"}
+		if network.NetworkType == bosh.ManualNetworkType {
+			stanza.method = "static"
+			stanza.options = append(stanza.options, fmt.Sprintf("address %s", network.IP), fmt.Sprintf("netmask %s", network.Netmask))
+			if contains(network.Default, "gateway") {
+				stanza.options = append(stanza.options, fmt.Sprintf("gateway %s", network.Gateway))
+			}
+			if len(network.DNS) > 0 {
+				stanza.options = append(stanza.options, fmt.Sprintf("dns-nameservers %s", strings.Join(network.DNS, " ")))
+			}
+		}
+		if network.VLANID != 0 {
+			stanza.options = append(stanza.options, fmt.Sprintf("vlan-raw-device %s", rawDevice))
+		}
+		stanzas = append(stanzas, stanza)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("# generated by rackhd-cpi\n")
+
+	for _, bond := range bonds {
+		for _, slave := range bond.slaves {
+			writeStanza(&b, interfaceStanza{device: slave, method: "manual", options: []string{fmt.Sprintf("bond-master %s", bond.device)}})
+		}
+	}
+
+	for _, bond := range bonds {
+		if _, inUse := devicesInUse[bond.device]; !inUse {
+			writeStanza(&b, interfaceStanza{device: bond.device, method: "manual", options: bondOptions(bond)})
+		}
+	}
+
+	for _, rawDevice := range rawDevices {
+		if _, inUse := devicesInUse[rawDevice]; !inUse && !isBond[rawDevice] {
+			writeStanza(&b, interfaceStanza{device: rawDevice, method: "manual"})
+		}
+	}
+
+	for _, stanza := range stanzas {
+		for _, bond := range bonds {
+			if stanza.device == bond.device {
+				stanza.options = append(stanza.options, bondOptions(bond)...)
+			}
+		}
+		writeStanza(&b, stanza)
+	}
+
+	return b.Bytes(), nil
+}
+
+func bondOptions(bond networkBond) []string {
+	return []string{
+		fmt.Sprintf("bond-mode %s", bond.mode),
+		"bond-miimon 100",
+		"bond-slaves none",
+	}
+}
+
+func writeStanza(b *bytes.Buffer, stanza interfaceStanza) {
+	fmt.Fprintf(b, "\nauto %s\niface %s inet %s\n", stanza.device, stanza.device, stanza.method)
+	for _, option := range stanza.options {
+		fmt.Fprintf(b, "    %s\n", option)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,142 @@
+package cpi
+
+import (
+	"github.com/rackhd/rackhd-cpi/bosh"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rendering network interfaces", func() {
+	var nodeNetworks map[string]rackhdapi.Network
+
+	BeforeEach(func() {
+		nodeCatalog := helpers.LoadNodeCatalog("../spec_assets/dummy_node_catalog_multiple_interface_up_response.json")
+		nodeNetworks = nodeCatalog.Data.NetworkData.Networks
+	})
+
+	Describe("needsInterfacesFile", func() {
+		It("is only needed for bonded or tagged networks", func() {
+			Expect(needsInterfacesFile(map[string]bosh.Network{"default": bosh.Network{MAC: "00:1e:67:c4:e1:a0"}})).To(BeFalse())
+			Expect(needsInterfacesFile(map[string]bosh.Network{"default": bosh.Network{MAC: "00:1e:67:c4:e1:a0", VLANID: 100}})).To(BeTrue())
+		})
+	})
+
+	It("renders vlans on top of a shared bond", func() {
+		bond := &bosh.NetworkBond{Mode: "802.3ad", Members: []string{"00:1e:67:c4:e1:a0", "00:1e:67:c4:e1:a1"}}
+		networks := map[string]bosh.Network{
+			"management": bosh.Network{
+				NetworkType: bosh.ManualNetworkType,
+				IP:          "10.0.0.5",
+				Netmask:     "255.255.255.0",
+				Gateway:     "10.0.0.1",
+				Default:     []string{"dns", "gateway"},
+				DNS:         []string{"8.8.8.8"},
+				MAC:         "00:1e:67:c4:e1:a0",
+				Bond:        bond,
+				VLANID:      100,
+			},
+			"data": bosh.Network{
+				NetworkType: bosh.DynamicNetworkType,
+				MAC:         "00:1e:67:c4:e1:a0",
+				Bond:        bond,
+				VLANID:      200,
+			},
+		}
+
+		interfaces, err := renderNetworkInterfaces(nodeNetworks, networks)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(interfaces)).To(Equal(`# generated by rackhd-cpi
+
+auto p514p1
+iface p514p1 inet manual
+    bond-master bond0
+
+auto p514p2
+iface p514p2 inet manual
+    bond-master bond0
+
+auto bond0
+iface bond0 inet manual
+    bond-mode 802.3ad
+    bond-miimon 100
+    bond-slaves none
+
+auto bond0.200
+iface bond0.200 inet dhcp
+    vlan-raw-device bond0
+
+auto bond0.100
+iface bond0.100 inet static
+    address 10.0.0.5
+    netmask 255.255.255.0
+    gateway 10.0.0.1
+    dns-nameservers 8.8.8.8
+    vlan-raw-device bond0
+`))
+	})
+
+	It("renders an untagged bond and a tagged interface", func() {
+		networks := map[string]bosh.Network{
+			"management": bosh.Network{
+				NetworkType: bosh.DynamicNetworkType,
+				MAC:         "00:1e:67:c4:e1:a0",
+				Bond:        &bosh.NetworkBond{Mode: "active-backup", Members: []string{"00:1e:67:c4:e1:a0"}},
+			},
+			"data": bosh.Network{
+				NetworkType: bosh.ManualNetworkType,
+				IP:          "10.1.0.5",
+				Netmask:     "255.255.255.0",
+				Gateway:     "10.1.0.1",
+				MAC:         "00:1e:67:c4:e1:a1",
+				VLANID:      300,
+			},
+		}
+
+		interfaces, err := renderNetworkInterfaces(nodeNetworks, networks)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(interfaces)).To(Equal(`# generated by rackhd-cpi
+
+auto p514p1
+iface p514p1 inet manual
+    bond-master bond0
+
+auto p514p2
+iface p514p2 inet manual
+
+auto p514p2.300
+iface p514p2.300 inet static
+    address 10.1.0.5
+    netmask 255.255.255.0
+    vlan-raw-device p514p2
+
+auto bond0
+iface bond0 inet dhcp
+    bond-mode active-backup
+    bond-miimon 100
+    bond-slaves none
+`))
+	})
+
+	It("returns an error if one bond is given two modes", func() {
+		members := []string{"00:1e:67:c4:e1:a0", "00:1e:67:c4:e1:a1"}
+		networks := map[string]bosh.Network{
+			"data":       bosh.Network{Bond: &bosh.NetworkBond{Mode: "802.3ad", Members: members}, VLANID: 100},
+			"management": bosh.Network{Bond: &bosh.NetworkBond{Mode: "balance-rr", Members: members}, VLANID: 200},
+		}
+
+		_, err := renderNetworkInterfaces(nodeNetworks, networks)
+		Expect(err).To(MatchError("error rendering network management: bond0 is configured with both mode 802.3ad and mode balance-rr"))
+	})
+
+	It("returns an error if a network's mac is not on the node", func() {
+		networks := map[string]bosh.Network{
+			"data": bosh.Network{MAC: "00:00:00:00:00:01", VLANID: 100},
+		}
+
+		_, err := renderNetworkInterfaces(nodeNetworks, networks)
+		Expect(err).To(MatchError("error rendering network data: node has no interface with mac 00:00:00:00:00:01"))
+	})
+})
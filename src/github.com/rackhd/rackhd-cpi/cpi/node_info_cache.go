@@ -0,0 +1,107 @@
+package cpi
+
+import (
+	"sync"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+// nodeInfoCache keeps the catalogs and OBM settings fetched while selecting a
+// node for the rest of the cpi invocation, so that filters and concurrent
+// candidate checks fetch each of them once. It is emptied whenever it is used
+// with the config of a different request, and is bypassed by configs without a
+// request id. Failed fetches are not cached.
+type nodeInfoCache struct {
+	mutex        sync.Mutex
+	requestID    string
+	apiServer    string
+	catalogs     map[string]rackhdapi.NodeCatalog
+	lshwCatalogs map[string]rackhdapi.LSHWCatalog
+	obmSettings  map[string][]rackhdapi.OBMSetting
+}
+
+var nodeInfo = &nodeInfoCache{}
+
+func (cache *nodeInfoCache) lock(c config.Cpi) {
+	cache.mutex.Lock()
+	if cache.requestID != c.RequestID || cache.apiServer != c.ApiServer || cache.catalogs == nil {
+		cache.requestID = c.RequestID
+		cache.apiServer = c.ApiServer
+		cache.catalogs = map[string]rackhdapi.NodeCatalog{}
+		cache.lshwCatalogs = map[string]rackhdapi.LSHWCatalog{}
+		cache.obmSettings = map[string][]rackhdapi.OBMSetting{}
+	}
+}
+
+func (cache *nodeInfoCache) catalog(c config.Cpi, nodeID string) (rackhdapi.NodeCatalog, error) {
+	if c.RequestID == "" {
+		return rackhdapi.GetNodeCatalog(c, nodeID)
+	}
+
+	cache.lock(c)
+	catalog, cached := cache.catalogs[nodeID]
+	cache.mutex.Unlock()
+	if cached {
+		return catalog, nil
+	}
+
+	catalog, err := rackhdapi.GetNodeCatalog(c, nodeID)
+	if err != nil {
+		return rackhdapi.NodeCatalog{}, err
+	}
+
+	cache.lock(c)
+	cache.catalogs[nodeID] = catalog
+	cache.mutex.Unlock()
+
+	return catalog, nil
+}
+
+func (cache *nodeInfoCache) lshwCatalog(c config.Cpi, nodeID string) (rackhdapi.LSHWCatalog, error) {
+	if c.RequestID == "" {
+		return rackhdapi.GetNodeLSHWCatalog(c, nodeID)
+	}
+
+	cache.lock(c)
+	catalog, cached := cache.lshwCatalogs[nodeID]
+	cache.mutex.Unlock()
+	if cached {
+		return catalog, nil
+	}
+
+	catalog, err := rackhdapi.GetNodeLSHWCatalog(c, nodeID)
+	if err != nil {
+		return rackhdapi.LSHWCatalog{}, err
+	}
+
+	cache.lock(c)
+	cache.lshwCatalogs[nodeID] = catalog
+	cache.mutex.Unlock()
+
+	return catalog, nil
+}
+
+func (cache *nodeInfoCache) obm(c config.Cpi, nodeID string) ([]rackhdapi.OBMSetting, error) {
+	if c.RequestID == "" {
+		return rackhdapi.GetOBMSettings(c, nodeID)
+	}
+
+	cache.lock(c)
+	settings, cached := cache.obmSettings[nodeID]
+	cache.mutex.Unlock()
+	if cached {
+		return settings, nil
+	}
+
+	settings, err := rackhdapi.GetOBMSettings(c, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.lock(c)
+	cache.obmSettings[nodeID] = settings
+	cache.mutex.Unlock()
+
+	return settings, nil
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -73,9 +75,6 @@ func parseCreateVMInput(extInput bosh.MethodArguments) (string, string, string,
 	}
 
 	networks = networkInput.(map[string]interface{})
-	if len(networks) > 1 {
-		return "", "", "", networkSpecs, "", fmt.Errorf("config error: Only one network supported, provided length: %d", len(networks))
-	}
 
 	b, err := json.Marshal(networks)
 	if err != nil {
@@ -88,27 +87,34 @@ func parseCreateVMInput(extInput bosh.MethodArguments) (string, string, string,
 		return "", "", "", networkSpecs, "", errors.New("error unmarshalling the network")
 	}
 
-	var boshNetName string
-	var boshNet bosh.Network
+	var gatewayNetworks []string
+	for boshNetName, boshNet := range boshNetworks {
+		defaultNetworkType(&boshNet)
+		log.Debug(fmt.Sprintf("After defaulting network type: %s", boshNet.NetworkType))
 
-	for k, v := range boshNetworks {
-		boshNetName = k
-		boshNet = v
-	}
-	defaultNetworkType(&boshNet)
-	log.Debug(fmt.Sprintf("After defaulting network type: %s", boshNet.NetworkType))
+		if valErr := validateNetworkingConfig(boshNet); valErr != nil {
+			return "", "", "", networkSpecs, "", valErr
+		}
 
-	if valErr := validateNetworkingConfig(boshNet); valErr != nil {
-		return "", "", "", networkSpecs, "", valErr
+		for _, d := range boshNet.Default {
+			if d == "gateway" {
+				gatewayNetworks = append(gatewayNetworks, boshNetName)
+			}
+		}
+
+		networkSpecs[boshNetName] = bosh.Network{
+			NetworkType: boshNet.NetworkType,
+			Netmask:     boshNet.Netmask,
+			Gateway:     boshNet.Gateway,
+			IP:          boshNet.IP,
+			Default:     boshNet.Default,
+			DNS:         boshNet.DNS,
+		}
 	}
 
-	networkSpecs[boshNetName] = bosh.Network{
-		NetworkType: boshNet.NetworkType,
-		Netmask:     boshNet.Netmask,
-		Gateway:     boshNet.Gateway,
-		IP:          boshNet.IP,
-		Default:     boshNet.Default,
-		DNS:         boshNet.DNS,
+	if len(gatewayNetworks) > 1 {
+		sort.Strings(gatewayNetworks)
+		return "", "", "", map[string]bosh.Network{}, "", fmt.Errorf("config error: only one network can provide the default gateway, provided: %v", gatewayNetworks)
 	}
 
 	diskInput := extInput[4]
@@ -142,6 +148,213 @@ func parseCreateVMInput(extInput bosh.MethodArguments) (string, string, string,
 	return agentID, stemcellID, publicKey, networkSpecs, "", nil
 }
 
+type vmCloudProperties struct {
+	SKU      string
+	Hardware hardwareRequirements
+	Tags     tagRequirements
+}
+
+func parseVMCloudProperties(extInput bosh.MethodArguments) (vmCloudProperties, error) {
+	cloudProperties, ok := extInput[2].(map[string]interface{})
+	if !ok {
+		return vmCloudProperties{}, fmt.Errorf("cloud properties has unexpected type: %s. Expecting a map to interface", reflect.TypeOf(extInput[2]))
+	}
+
+	var properties vmCloudProperties
+	if skuInput, exists := cloudProperties["sku"]; exists {
+		sku, ok := skuInput.(string)
+		if !ok {
+			return vmCloudProperties{}, fmt.Errorf("sku has unexpected type: %s. Expecting a string", reflect.TypeOf(skuInput))
+		}
+		properties.SKU = sku
+	}
+
+	b, err := json.Marshal(cloudProperties)
+	if err != nil {
+		return vmCloudProperties{}, errors.New("error marshalling cloud properties")
+	}
+
+	err = json.Unmarshal(b, &properties.Hardware)
+	if err != nil {
+		return vmCloudProperties{}, fmt.Errorf("hardware requirements in cloud properties are invalid: %s", err)
+	}
+
+	err = properties.Hardware.validate()
+	if err != nil {
+		return vmCloudProperties{}, fmt.Errorf("hardware requirements in cloud properties are invalid: %s", err)
+	}
+
+	err = json.Unmarshal(b, &properties.Tags)
+	if err != nil {
+		return vmCloudProperties{}, fmt.Errorf("tags in cloud properties are invalid: %s", err)
+	}
+
+	err = properties.Tags.validate()
+	if err != nil {
+		return vmCloudProperties{}, fmt.Errorf("tags in cloud properties are invalid: %s", err)
+	}
+
+	return properties, nil
+}
+
+var bondModes = []string{"balance-rr", "active-backup", "balance-xor", "broadcast", "802.3ad", "balance-tlb", "balance-alb"}
+
+type networkCloudProperties struct {
+	Interface string               `json:"interface"`
+	MAC       string               `json:"mac"`
+	PCISlot   string               `json:"pci_slot"`
+	Bond      *bondCloudProperties `json:"bond"`
+	VLANID    int                  `json:"vlan_id"`
+}
+
+type bondCloudProperties struct {
+	Mode    string   `json:"mode"`
+	Members []string `json:"members"`
+}
+
+func (p networkCloudProperties) selectsInterface() bool {
+	return p.Interface != "" || p.MAC != "" || p.PCISlot != ""
+}
+
+func (p networkCloudProperties) bindsInterface() bool {
+	return p.selectsInterface() || p.Bond != nil || p.VLANID != 0
+}
+
+func parseNetworkCloudProperties(extInput bosh.MethodArguments) (map[string]networkCloudProperties, error) {
+	properties := map[string]networkCloudProperties{}
+
+	networks, ok := extInput[3].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("network config has unexpected type in: %s. Expecting a map", reflect.TypeOf(extInput[3]))
+	}
+
+	for netName, netInput := range networks {
+		network, ok := netInput.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("network %s has unexpected type: %s. Expecting a map", netName, reflect.TypeOf(netInput))
+		}
+
+		cloudPropertiesInput, exists := network["cloud_properties"]
+		if !exists || cloudPropertiesInput == nil {
+			properties[netName] = networkCloudProperties{}
+			continue
+		}
+
+		b, err := json.Marshal(cloudPropertiesInput)
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling cloud properties of network %s", netName)
+		}
+
+		var netProperties networkCloudProperties
+		err = json.Unmarshal(b, &netProperties)
+		if err != nil {
+			return nil, fmt.Errorf("cloud properties of network %s are invalid: %s", netName, err)
+		}
+
+		selectors := 0
+		for _, selector := range []string{netProperties.Interface, netProperties.MAC, netProperties.PCISlot} {
+			if selector != "" {
+				selectors++
+			}
+		}
+		if selectors > 1 {
+			return nil, fmt.Errorf("config error: network %s can only select its interface by one of interface, mac or pci_slot", netName)
+		}
+
+		if netProperties.Bond != nil {
+			if selectors > 0 {
+				return nil, fmt.Errorf("config error: network %s cannot select its interface with interface, mac or pci_slot when bonding", netName)
+			}
+
+			err = validateBond(*netProperties.Bond)
+			if err != nil {
+				return nil, fmt.Errorf("config error: network %s %s", netName, err)
+			}
+		}
+
+		if netProperties.VLANID < 0 || netProperties.VLANID > 4094 {
+			return nil, fmt.Errorf("config error: network %s has vlan_id %d. Expecting a value between 1 and 4094", netName, netProperties.VLANID)
+		}
+
+		properties[netName] = netProperties
+	}
+
+	return properties, nil
+}
+
+func validateBond(bond bondCloudProperties) error {
+	supported := false
+	for _, mode := range bondModes {
+		if bond.Mode == mode {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("has unsupported bond mode: %s. Expecting one of %s", bond.Mode, strings.Join(bondModes, ", "))
+	}
+
+	if len(bond.Members) == 0 {
+		return errors.New("must list at least one bond member")
+	}
+
+	seen := map[string]bool{}
+	for _, member := range bond.Members {
+		if seen[strings.ToLower(member)] {
+			return fmt.Errorf("lists bond member %s more than once", member)
+		}
+		seen[strings.ToLower(member)] = true
+	}
+
+	return nil
+}
+
+func parseCreateVMEnv(extInput bosh.MethodArguments) (map[string]interface{}, error) {
+	env := map[string]interface{}{}
+	if len(extInput) < 6 || extInput[5] == nil {
+		return env, nil
+	}
+
+	envInput := extInput[5]
+	if reflect.TypeOf(envInput) != reflect.TypeOf(env) {
+		return nil, fmt.Errorf("env has unexpected type: %s. Expecting a map to interface", reflect.TypeOf(envInput))
+	}
+	env = envInput.(map[string]interface{})
+
+	if persistentDiskFS, exists := env["persistent_disk_fs"]; exists {
+		if _, ok := persistentDiskFS.(string); !ok {
+			return nil, fmt.Errorf("env persistent_disk_fs has unexpected type: %s. Expecting a string", reflect.TypeOf(persistentDiskFS))
+		}
+	}
+
+	boshEnvInput, exists := env["bosh"]
+	if !exists || boshEnvInput == nil {
+		return env, nil
+	}
+
+	boshEnv, ok := boshEnvInput.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("env bosh has unexpected type: %s. Expecting a map to interface", reflect.TypeOf(boshEnvInput))
+	}
+
+	for _, key := range []string{"password", "trusted_certs"} {
+		if value, exists := boshEnv[key]; exists {
+			if _, ok := value.(string); !ok {
+				return nil, fmt.Errorf("env bosh.%s has unexpected type: %s. Expecting a string", key, reflect.TypeOf(value))
+			}
+		}
+	}
+
+	for _, key := range []string{"keep_root_password", "remove_dev_tools", "remove_static_libraries"} {
+		if value, exists := boshEnv[key]; exists {
+			if _, ok := value.(bool); !ok {
+				return nil, fmt.Errorf("env bosh.%s has unexpected type: %s. Expecting a bool", key, reflect.TypeOf(value))
+			}
+		}
+	}
+
+	return env, nil
+}
+
 func parseDiskCID(diskCID string) string {
 	key := regexp.MustCompile(`^([0-9a-z]+)-.+`)
 	array := key.FindStringSubmatch(diskCID)
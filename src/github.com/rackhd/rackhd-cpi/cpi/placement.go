@@ -0,0 +1,135 @@
+package cpi
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+// placementGroup identifies the instances of one job in one deployment, the
+// set of VMs that should not share a rack or chassis
+type placementGroup struct {
+	Deployment string
+	Job        string
+}
+
+type failureDomain struct {
+	Rack    string
+	Chassis string
+}
+
+// parsePlacementGroup reads the deployment and job of the VM being created from
+// the bosh groups in its env, which the director orders as
+// [director, deployment, job, ...]
+func parsePlacementGroup(env map[string]interface{}) placementGroup {
+	boshEnv, ok := env["bosh"].(map[string]interface{})
+	if !ok {
+		return placementGroup{}
+	}
+
+	groups, ok := boshEnv["groups"].([]interface{})
+	if !ok || len(groups) < 3 {
+		return placementGroup{}
+	}
+
+	deployment, _ := groups[1].(string)
+	job, _ := groups[2].(string)
+	if deployment == "" || job == "" {
+		return placementGroup{}
+	}
+
+	return placementGroup{Deployment: deployment, Job: job}
+}
+
+func (g placementGroup) empty() bool {
+	return g == placementGroup{}
+}
+
+// includes reports whether a node hosts a VM of the group, going by the
+// metadata set_vm_metadata stored on it
+func (g placementGroup) includes(n rackhdapi.Node) bool {
+	if n.CID == "" || n.Metadata == nil {
+		return false
+	}
+
+	job, _ := n.Metadata["job"].(string)
+	if job == "" {
+		job, _ = n.Metadata["instance_group"].(string)
+	}
+	deployment, _ := n.Metadata["deployment"].(string)
+
+	return deployment == g.Deployment && job == g.Job
+}
+
+func nodeFailureDomain(c config.Cpi, n rackhdapi.Node) failureDomain {
+	location := c.Topology[n.ID]
+	domain := failureDomain{Rack: location.Rack, Chassis: location.Chassis}
+	if domain.Chassis == "" {
+		domain.Chassis = n.EnclosureID()
+	}
+
+	return domain
+}
+
+// orderByFailureDomain stably sorts nodes so that those in the racks, and then
+// the chassis, hosting the fewest VMs of the group come first. Nodes in an
+// unknown rack or chassis count as alone in it.
+func orderByFailureDomain(c config.Cpi, nodes []rackhdapi.Node, group placementGroup) []rackhdapi.Node {
+	rackCount := map[string]int{}
+	chassisCount := map[string]int{}
+	for _, n := range nodes {
+		if !group.includes(n) {
+			continue
+		}
+
+		domain := nodeFailureDomain(c, n)
+		if domain.Rack != "" {
+			rackCount[domain.Rack]++
+		}
+		if domain.Chassis != "" {
+			chassisCount[domain.Chassis]++
+		}
+	}
+
+	log.Debug(fmt.Sprintf("instances of %s/%s per rack: %v, per chassis: %v", group.Deployment, group.Job, rackCount, chassisCount))
+
+	byLoad := byFailureDomainLoad{
+		nodes:        make([]rackhdapi.Node, len(nodes)),
+		domains:      make([]failureDomain, len(nodes)),
+		rackCount:    rackCount,
+		chassisCount: chassisCount,
+	}
+	for i, n := range nodes {
+		byLoad.nodes[i] = n
+		byLoad.domains[i] = nodeFailureDomain(c, n)
+	}
+	sort.Stable(byLoad)
+
+	return byLoad.nodes
+}
+
+// byFailureDomainLoad sorts nodes by the number of VMs of the group in their
+// rack, and then in their chassis
+type byFailureDomainLoad struct {
+	nodes        []rackhdapi.Node
+	domains      []failureDomain
+	rackCount    map[string]int
+	chassisCount map[string]int
+}
+
+func (b byFailureDomainLoad) Len() int { return len(b.nodes) }
+func (b byFailureDomainLoad) Swap(i, j int) {
+	b.nodes[i], b.nodes[j] = b.nodes[j], b.nodes[i]
+	b.domains[i], b.domains[j] = b.domains[j], b.domains[i]
+}
+func (b byFailureDomainLoad) Less(i, j int) bool {
+	di, dj := b.domains[i], b.domains[j]
+	if b.rackCount[di.Rack] != b.rackCount[dj.Rack] {
+		return b.rackCount[di.Rack] < b.rackCount[dj.Rack]
+	}
+	return b.chassisCount[di.Chassis] < b.chassisCount[dj.Chassis]
+}
@@ -0,0 +1,85 @@
+package cpi
+
+import (
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Placing VMs across failure domains", func() {
+	var group placementGroup
+
+	BeforeEach(func() {
+		group = placementGroup{Deployment: "cf", Job: "router"}
+	})
+
+	vm := func(id, cid, deployment, job string) rackhdapi.Node {
+		return rackhdapi.Node{ID: id, CID: cid, Metadata: map[string]interface{}{"deployment": deployment, "job": job}}
+	}
+
+	ids := func(nodes []rackhdapi.Node) []string {
+		var nodeIDs []string
+		for _, n := range nodes {
+			nodeIDs = append(nodeIDs, n.ID)
+		}
+		return nodeIDs
+	}
+
+	Describe("parsePlacementGroup", func() {
+		It("reads the deployment and job from the bosh groups in env", func() {
+			env := map[string]interface{}{
+				"bosh": map[string]interface{}{
+					"groups": []interface{}{"director", "cf", "router", "director-cf", "cf-router", "director-cf-router"},
+				},
+			}
+			Expect(parsePlacementGroup(env)).To(Equal(group))
+		})
+
+		It("returns an empty group when env has no bosh groups", func() {
+			Expect(parsePlacementGroup(map[string]interface{}{}).empty()).To(BeTrue())
+		})
+	})
+
+	It("prefers nodes in the rack hosting the fewest instances of the job", func() {
+		c := config.Cpi{Topology: map[string]config.NodeLocation{
+			"vm-a":   {Rack: "rack-1"},
+			"vm-b":   {Rack: "rack-1"},
+			"vm-c":   {Rack: "rack-2"},
+			"free-1": {Rack: "rack-1"},
+			"free-2": {Rack: "rack-2"},
+			"free-3": {Rack: "rack-3"},
+		}}
+		nodes := []rackhdapi.Node{
+			{ID: "free-1"},
+			{ID: "free-2"},
+			vm("vm-a", "vm-1", "cf", "router"),
+			vm("vm-b", "vm-2", "cf", "router"),
+			vm("vm-c", "vm-3", "cf", "router"),
+			{ID: "free-3"},
+		}
+
+		ordered := orderByFailureDomain(c, nodes, group)
+		Expect(ids(ordered)[:3]).To(Equal([]string{"free-3", "free-2", "vm-c"}))
+	})
+
+	It("breaks rack ties by the chassis RackHD encloses the node in", func() {
+		enclosed := func(id, enclosure string) rackhdapi.Node {
+			return rackhdapi.Node{ID: id, Relations: []rackhdapi.NodeRelation{
+				{RelationType: rackhdapi.EnclosedByRelation, Targets: []string{enclosure}},
+			}}
+		}
+		busy := enclosed("vm-a", "chassis-1")
+		busy.CID = "vm-1"
+		busy.Metadata = map[string]interface{}{"deployment": "cf", "job": "router"}
+		other := enclosed("vm-b", "chassis-2")
+		other.CID = "vm-2"
+		other.Metadata = map[string]interface{}{"deployment": "cf", "job": "api"}
+
+		nodes := []rackhdapi.Node{enclosed("free-1", "chassis-1"), busy, other, enclosed("free-2", "chassis-2")}
+
+		ordered := orderByFailureDomain(config.Cpi{}, nodes, group)
+		Expect(ids(ordered)).To(Equal([]string{"vm-b", "free-2", "free-1", "vm-a"}))
+	})
+})
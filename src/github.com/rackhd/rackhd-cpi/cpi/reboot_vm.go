@@ -0,0 +1,40 @@
+package cpi
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rackhd/rackhd-cpi/bosh"
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+	"github.com/rackhd/rackhd-cpi/workflows"
+)
+
+func RebootVM(c config.Cpi, extInput bosh.MethodArguments) error {
+	var cid string
+	if reflect.TypeOf(extInput[0]) != reflect.TypeOf(cid) {
+		return errors.New("Received unexpected type for vm cid")
+	}
+
+	cid = extInput[0].(string)
+	node, err := rackhdapi.GetNodeByVMCID(c, cid)
+	if err != nil {
+		return asVMNotFound(err)
+	}
+
+	workflowName, err := workflows.PublishRebootNodeWorkflow(c)
+	if err != nil {
+		return fmt.Errorf("error publishing reboot workflow: %s", err)
+	}
+
+	err = workflows.RunRebootNodeWorkflow(c, node.ID, workflowName)
+	if err != nil {
+		return fmt.Errorf("error running reboot workflow: %s", err)
+	}
+
+	log.Info(fmt.Sprintf("rebooted vm %s on node %s", cid, node.ID))
+	return nil
+}
@@ -0,0 +1,97 @@
+package cpi_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/onsi/gomega/ghttp"
+	"github.com/rackhd/rackhd-cpi/bosh"
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/cpi"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/workflows"
+)
+
+var _ = Describe("RebootVM", func() {
+	var server *ghttp.Server
+	var cpiConfig config.Cpi
+
+	BeforeEach(func() {
+		server, _, cpiConfig, _ = helpers.SetUp(bosh.REBOOT_VM)
+		cpiConfig.RequestID = "requestid"
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("with a valid VM CID", func() {
+		It("reboots the node through its OBM service without reprovisioning", func() {
+			expectedNodes := helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json")
+			expectedNodesData, err := json.Marshal(expectedNodes)
+			Expect(err).ToNot(HaveOccurred())
+
+			nodeID := "55e79eb14e66816f6152fffb"
+			nodeStubData := []byte(`{"obmSettings": [{"service": "fake-obm-service"}]}`)
+			completedWorkflowResponse := []byte(fmt.Sprintf("{\"id\": \"%s\", \"_status\": \"succeeded\"}", cpiConfig.RequestID))
+
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, expectedNodesData),
+				),
+			)
+			server.AppendHandlers(helpers.MakePublishHandlers("Graph.BOSH.RebootNode.", 0)...)
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", nodeID)),
+					ghttp.RespondWith(http.StatusOK, nodeStubData),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", fmt.Sprintf("/api/1.1/nodes/%s/workflows/", nodeID)),
+					ghttp.VerifyJSON(fmt.Sprintf(`{"name": "Graph.BOSH.RebootNode.%s", "options": {"defaults": {"obmServiceName": "fake-obm-service"}}}`, workflows.DefinitionVersion())),
+					ghttp.RespondWith(http.StatusCreated, completedWorkflowResponse),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/workflows/%s", cpiConfig.RequestID)),
+					ghttp.RespondWith(http.StatusOK, completedWorkflowResponse),
+				),
+			)
+
+			err = cpi.RebootVM(cpiConfig, bosh.MethodArguments{"vm-1234"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(7))
+		})
+	})
+
+	Context("with a VM CID that does not exist", func() {
+		It("returns an error", func() {
+			expectedNodes := helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json")
+			expectedNodesData, err := json.Marshal(expectedNodes)
+			Expect(err).ToNot(HaveOccurred())
+
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, expectedNodesData),
+				),
+			)
+
+			err = cpi.RebootVM(cpiConfig, bosh.MethodArguments{"does-not-exist"})
+			Expect(err).To(MatchError("vm with cid: does-not-exist was not found"))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Context("with an invalid VM CID", func() {
+		It("returns an error", func() {
+			err := cpi.RebootVM(cpiConfig, bosh.MethodArguments{123})
+			Expect(err).To(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+	})
+})
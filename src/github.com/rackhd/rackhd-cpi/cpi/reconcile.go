@@ -0,0 +1,161 @@
+package cpi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rackhd/rackhd-cpi/bosh"
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+// DirectorCIDs are the cids of the vms and disks the director knows about. A
+// nil set means the director's cids of that kind were not given, and nodes
+// are not checked against them.
+type DirectorCIDs struct {
+	VMs   map[string]bool
+	Disks map[string]bool
+}
+
+// Inconsistency is a node whose state on RackHD does not match what the cpi
+// or the director expect of it, along with how to fix it
+type Inconsistency struct {
+	NodeID  string
+	Problem string
+	Fix     string
+	apply   func(c config.Cpi) error
+}
+
+// Apply fixes the inconsistency
+func (i Inconsistency) Apply(c config.Cpi) error {
+	return i.apply(c)
+}
+
+// ReadCIDs reads a list of cids exported from the director, one per line.
+// Blank lines and lines starting with # are skipped.
+func ReadCIDs(r io.Reader) (map[string]bool, error) {
+	cids := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cids[line] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading cids: %s", err)
+	}
+
+	return cids, nil
+}
+
+// FindInconsistencies compares the nodes on RackHD with the vms and disks the
+// director knows about, and returns at most one inconsistency per node, ordered
+// by node id. Fixing a node may uncover another inconsistency on it, such as a
+// disk left behind by a deleted vm, which the next run reports.
+func FindInconsistencies(c config.Cpi, director DirectorCIDs) ([]Inconsistency, error) {
+	nodes, err := rackhdapi.GetNodes(c)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byNodeID(nodes))
+
+	now := time.Now()
+	inconsistencies := []Inconsistency{}
+	for _, n := range nodes {
+		if inconsistency, found := findInconsistency(c, n, director, now); found {
+			inconsistencies = append(inconsistencies, inconsistency)
+		}
+	}
+
+	return inconsistencies, nil
+}
+
+type byNodeID []rackhdapi.Node
+
+func (b byNodeID) Len() int           { return len(b) }
+func (b byNodeID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byNodeID) Less(i, j int) bool { return b[i].ID < b[j].ID }
+
+func findInconsistency(c config.Cpi, n rackhdapi.Node, director DirectorCIDs, now time.Time) (Inconsistency, bool) {
+	vmCID := n.CID
+	diskCID := n.PersistentDisk.DiskCID
+	pregeneratedDiskCID := n.PersistentDisk.PregeneratedDiskCID
+	nodeID := n.ID
+
+	switch {
+	case vmCID != "" && director.VMs != nil && !director.VMs[vmCID]:
+		return Inconsistency{
+			NodeID:  nodeID,
+			Problem: fmt.Sprintf("has vm %s, which the director does not know", vmCID),
+			Fix:     "delete the vm",
+			apply: func(c config.Cpi) error {
+				return DeleteVM(c, bosh.MethodArguments{vmCID})
+			},
+		}, true
+	case diskCID != "" && director.Disks != nil && !director.Disks[diskCID]:
+		return Inconsistency{
+			NodeID:  nodeID,
+			Problem: fmt.Sprintf("has disk %s, which the director does not know", diskCID),
+			Fix:     "delete the disk",
+			apply: func(c config.Cpi) error {
+				return DeleteDisk(c, bosh.MethodArguments{diskCID})
+			},
+		}, true
+	case n.Status == rackhdapi.Available && diskCID != "":
+		return Inconsistency{
+			NodeID:  nodeID,
+			Problem: fmt.Sprintf("is available but holds disk %s", diskCID),
+			Fix:     "reserve the node for the disk",
+			apply: func(c config.Cpi) error {
+				return rackhdapi.ReserveNode(c, nodeID)
+			},
+		}, true
+	case n.Status == rackhdapi.Available && pregeneratedDiskCID != "":
+		return Inconsistency{
+			NodeID:  nodeID,
+			Problem: fmt.Sprintf("is available but has disk cid %s pregenerated", pregeneratedDiskCID),
+			Fix:     "clear the disk cid",
+			apply: func(c config.Cpi) error {
+				bodyBytes, err := json.Marshal(rackhdapi.PersistentDiskSettingsContainer{})
+				if err != nil {
+					return err
+				}
+				return rackhdapi.PatchNode(c, nodeID, bodyBytes)
+			},
+		}, true
+	case n.Status == rackhdapi.Reserved && vmCID == "" && diskCID == "" && !isBeingReserved(c, n, now):
+		return Inconsistency{
+			NodeID:  nodeID,
+			Problem: "is reserved without a vm or a disk",
+			Fix:     "release the node",
+			apply: func(c config.Cpi) error {
+				return rollbackCreateVM(c, nodeID, false, pregeneratedDiskCID != "")
+			},
+		}, true
+	default:
+		return Inconsistency{}, false
+	}
+}
+
+// isBeingReserved tells a node a create_vm may still be working on from one
+// it left behind: its claim and lease are current, or a workflow is running
+func isBeingReserved(c config.Cpi, n rackhdapi.Node, now time.Time) bool {
+	if n.Claim != nil && !n.Claim.Expired(now) {
+		return true
+	}
+
+	if n.Lease != nil && !n.Lease.Expired(c.ReservationLeaseTTLSeconds*time.Second, now) {
+		return true
+	}
+
+	return !hasNoActiveWorkflow(c, n.ID)
+}
@@ -0,0 +1,156 @@
+package cpi_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/onsi/gomega/ghttp"
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/cpi"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+var _ = Describe("Reconciling nodes", func() {
+	var server *ghttp.Server
+	var cpiConfig config.Cpi
+	var nodes []rackhdapi.Node
+	var director cpi.DirectorCIDs
+
+	problems := func(inconsistencies []cpi.Inconsistency) []string {
+		described := []string{}
+		for _, inconsistency := range inconsistencies {
+			described = append(described, fmt.Sprintf("%s %s: %s", inconsistency.NodeID, inconsistency.Problem, inconsistency.Fix))
+		}
+		return described
+	}
+
+	BeforeEach(func() {
+		server, _, cpiConfig, _ = helpers.SetUp("")
+		cpiConfig.ReservationLeaseTTLSeconds = 60 * 60
+
+		template := helpers.LoadNodes("../spec_assets/dummy_two_node_response.json")[0]
+		nodes = make([]rackhdapi.Node, 7)
+		for i := range nodes {
+			nodes[i] = template
+			nodes[i].ID = fmt.Sprintf("node-%d", i)
+			nodes[i].Status = rackhdapi.Reserved
+			nodes[i].CID = ""
+			nodes[i].PersistentDisk = rackhdapi.PersistentDiskSettings{}
+			nodes[i].Claim = nil
+			nodes[i].Lease = nil
+		}
+
+		nodes[0].CID = "vm-unknown"
+		nodes[1].CID = "vm-known"
+		nodes[1].PersistentDisk.DiskCID = "disk-unknown"
+		nodes[2].Status = rackhdapi.Available
+		nodes[2].PersistentDisk.DiskCID = "disk-known"
+		nodes[3].Status = rackhdapi.Available
+		nodes[3].PersistentDisk.PregeneratedDiskCID = "node-3-dead-request"
+		nodes[4].PersistentDisk.PregeneratedDiskCID = "node-4-dead-request"
+		nodes[4].Lease = &rackhdapi.NodeLease{RequestID: "dead-request", ReservedAt: time.Now().Add(-2 * time.Hour).Unix()}
+		nodes[5].Lease = &rackhdapi.NodeLease{RequestID: "live-request", ReservedAt: time.Now().Unix()}
+		nodes[6].CID = "vm-known"
+		nodes[6].PersistentDisk.DiskCID = "disk-known"
+
+		director = cpi.DirectorCIDs{
+			VMs:   map[string]bool{"vm-known": true},
+			Disks: map[string]bool{"disk-known": true},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	appendNodesHandler := func() {
+		nodesData, err := json.Marshal(nodes)
+		Expect(err).ToNot(HaveOccurred())
+
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/common/nodes"),
+				ghttp.RespondWith(http.StatusOK, nodesData),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/1.1/nodes/node-4/workflows/active"),
+				ghttp.RespondWith(http.StatusNoContent, []byte{}),
+			),
+		)
+	}
+
+	It("finds the nodes that do not match the director or their reservation", func() {
+		appendNodesHandler()
+
+		inconsistencies, err := cpi.FindInconsistencies(cpiConfig, director)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(problems(inconsistencies)).To(Equal([]string{
+			"node-0 has vm vm-unknown, which the director does not know: delete the vm",
+			"node-1 has disk disk-unknown, which the director does not know: delete the disk",
+			"node-2 is available but holds disk disk-known: reserve the node for the disk",
+			"node-3 is available but has disk cid node-3-dead-request pregenerated: clear the disk cid",
+			"node-4 is reserved without a vm or a disk: release the node",
+		}))
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+	})
+
+	It("only checks the node state when the director cids are not given", func() {
+		appendNodesHandler()
+
+		inconsistencies, err := cpi.FindInconsistencies(cpiConfig, cpi.DirectorCIDs{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(problems(inconsistencies)).To(Equal([]string{
+			"node-2 is available but holds disk disk-known: reserve the node for the disk",
+			"node-3 is available but has disk cid node-3-dead-request pregenerated: clear the disk cid",
+			"node-4 is reserved without a vm or a disk: release the node",
+		}))
+	})
+
+	It("fixes the node state", func() {
+		appendNodesHandler()
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PATCH", "/api/common/nodes/node-2"),
+				ghttp.VerifyJSON(`{"status": "reserved"}`),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PATCH", "/api/common/nodes/node-3"),
+				ghttp.VerifyJSON(`{"persistent_disk": {"pregenerated_disk_cid": "", "disk_cid": "", "location": "", "attached": false}}`),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/1.1/nodes/node-4/workflows/active"),
+				ghttp.RespondWith(http.StatusNoContent, []byte{}),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PATCH", "/api/common/nodes/node-4"),
+				ghttp.VerifyJSON(`{"persistent_disk": {"pregenerated_disk_cid": "", "disk_cid": "", "location": "", "attached": false}}`),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PATCH", "/api/common/nodes/node-4"),
+				ghttp.VerifyJSON(`{"status": "available", "cpi_lease": null, "cpi_claim": null}`),
+			),
+		)
+
+		inconsistencies, err := cpi.FindInconsistencies(cpiConfig, cpi.DirectorCIDs{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(inconsistencies).To(HaveLen(3))
+
+		for _, inconsistency := range inconsistencies {
+			Expect(inconsistency.Apply(cpiConfig)).To(Succeed())
+		}
+		Expect(server.ReceivedRequests()).To(HaveLen(7))
+	})
+
+	It("reads the cids exported from the director", func() {
+		cids, err := cpi.ReadCIDs(strings.NewReader("# vms\nvm-1234\n\n  vm-5678  \n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cids).To(Equal(map[string]bool{"vm-1234": true, "vm-5678": true}))
+	})
+})
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,8 +18,13 @@ import (
 )
 
 const (
-	AllowAnyNodeMethod      = "AllowAnyNode"
-	FilterBasedOnSizeMethod = "FilterBasedOnSize"
+	AllowAnyNodeMethod                  = "AllowAnyNode"
+	FilterBasedOnSizeMethod             = "FilterBasedOnSize"
+	FilterBasedOnSKUMethod              = "FilterBasedOnSKU"
+	FilterBasedOnHardwareMethod         = "FilterBasedOnHardware"
+	FilterBasedOnTagsMethod             = "FilterBasedOnTags"
+	FilterBasedOnAvailabilityZoneMethod = "FilterBasedOnAvailabilityZone"
+	AllFiltersMethod                    = "AllFilters"
 )
 
 type selectionFunc func(config.Cpi, string, Filter) (rackhdapi.Node, error)
@@ -29,6 +35,17 @@ type Filter struct {
 	method string
 }
 
+func AllFilters(filters ...Filter) Filter {
+	switch len(filters) {
+	case 0:
+		return Filter{nil, AllowAnyNodeMethod}
+	case 1:
+		return filters[0]
+	default:
+		return Filter{filters, AllFiltersMethod}
+	}
+}
+
 func TryReservation(c config.Cpi, nodeID string, choose selectionFunc, reserve reservationFunc) (string, error) {
 	return TryReservationWithFilter(c, nodeID, Filter{nil, AllowAnyNodeMethod}, choose, reserve)
 }
@@ -46,8 +63,8 @@ func TryReservationWithFilter(c config.Cpi, nodeID string, filter Filter, choose
 		err = reserve(c, node)
 		if err != nil {
 			log.Error(fmt.Sprintf("retry %d: error reserving node %s", i, err))
-			if strings.HasPrefix(err.Error(), "Timed out running workflow") {
-				rackhdapi.ReleaseNode(c, node.ID)
+			if strings.HasPrefix(err.Error(), rackhdapi.NodeClaimConflict) {
+				continue
 			}
 			rand.Seed(time.Now().UnixNano())
 			sleepTime := rand.Intn(5000)
@@ -66,45 +83,91 @@ func TryReservationWithFilter(c config.Cpi, nodeID string, filter Filter, choose
 	return node.ID, nil
 }
 
-func (f Filter) AllowAnyNode() (bool, error) {
-	return true, nil
+func (f Filter) AllowAnyNode() (bool, string, error) {
+	return true, "", nil
 }
 
-func (f Filter) Run(c config.Cpi, node rackhdapi.Node) (bool, error) {
+// Run tells whether the node passes the filter. A node that does not is
+// rejected with the reason why; err reports a failure to apply the filter.
+func (f Filter) Run(c config.Cpi, node rackhdapi.Node) (bool, string, error) {
 	if f.method == AllowAnyNodeMethod {
 		return f.AllowAnyNode()
 	}
 	if f.method == FilterBasedOnSizeMethod {
 		return f.FilterBasedOnSize(c, node)
 	}
-	return false, fmt.Errorf("error running filter: filter method not valid: %s", f.method)
+	if f.method == FilterBasedOnSKUMethod {
+		return f.FilterBasedOnSKU(node)
+	}
+	if f.method == FilterBasedOnHardwareMethod {
+		return f.FilterBasedOnHardware(c, node)
+	}
+	if f.method == FilterBasedOnTagsMethod {
+		return f.FilterBasedOnTags(node)
+	}
+	if f.method == FilterBasedOnAvailabilityZoneMethod {
+		return f.FilterBasedOnAvailabilityZone(c, node)
+	}
+	if f.method == AllFiltersMethod {
+		return f.RunAll(c, node)
+	}
+	return false, "", fmt.Errorf("error running filter: filter method not valid: %s", f.method)
+}
+
+func (f Filter) RunAll(c config.Cpi, node rackhdapi.Node) (bool, string, error) {
+	filters, ok := f.data.([]Filter)
+	if !ok {
+		return false, "", errors.New("error converting filters: filters must be convertible to a list of filters")
+	}
+
+	for _, filter := range filters {
+		valid, reason, err := filter.Run(c, node)
+		if !valid || err != nil {
+			return false, reason, err
+		}
+	}
+
+	return true, "", nil
 }
 
-func (f Filter) FilterBasedOnSize(c config.Cpi, node rackhdapi.Node) (bool, error) {
+func (f Filter) FilterBasedOnSize(c config.Cpi, node rackhdapi.Node) (bool, string, error) {
 	size, ok := f.data.(int)
 	if !ok {
-		return false, fmt.Errorf("error converting disk size: disk size must be convertible to int")
+		return false, "", fmt.Errorf("error converting disk size: disk size must be convertible to int")
 	}
 
-	catalog, err := rackhdapi.GetNodeCatalog(c, node.ID)
+	catalog, err := nodeInfo.catalog(c, node.ID)
 	if err != nil {
-		return false, fmt.Errorf("error getting catalog of VM: %s", node.ID)
+		return false, "", fmt.Errorf("error getting catalog of VM: %s", node.ID)
 	}
 
 	persistentDiskSize := catalog.Data.BlockDevices[rackhdapi.PersistentDiskLocation].Size
 	if persistentDiskSize == "" {
-		return false, fmt.Errorf("error creating disk for node %s: no disk found at %s", node.ID, rackhdapi.PersistentDiskLocation)
+		return false, fmt.Sprintf("has no disk at %s", rackhdapi.PersistentDiskLocation), nil
 	}
 	availableSpaceInKB, err := strconv.Atoi(persistentDiskSize)
 	if err != nil {
-		return false, fmt.Errorf("error creating disk for node %s: %v", node.ID, err)
+		return false, "", fmt.Errorf("error reading disk size of node %s: %v", node.ID, err)
 	}
 
 	if availableSpaceInKB < size*1024 {
-		return false, fmt.Errorf("error creating disk with size %vMB for node %s: insufficient available disk space", size, node.ID)
+		return false, fmt.Sprintf("has %vMB of disk space at %s, requires %vMB", availableSpaceInKB/1024, rackhdapi.PersistentDiskLocation, size), nil
 	}
 
-	return true, nil
+	return true, "", nil
+}
+
+func (f Filter) FilterBasedOnSKU(node rackhdapi.Node) (bool, string, error) {
+	skuID, ok := f.data.(string)
+	if !ok {
+		return false, "", fmt.Errorf("error converting sku: sku must be convertible to string")
+	}
+
+	if node.SKU != skuID {
+		return false, fmt.Sprintf("has sku %s, requires %s", node.SKU, skuID), nil
+	}
+
+	return true, "", nil
 }
 
 func ReserveNodeFromRackHD(c config.Cpi, node rackhdapi.Node) error {
@@ -112,21 +175,62 @@ func ReserveNodeFromRackHD(c config.Cpi, node rackhdapi.Node) error {
 		return nil
 	}
 
+	err := rackhdapi.ClaimNode(c, node.ID)
+	if err != nil {
+		return err
+	}
+
+	err = rackhdapi.LeaseNode(c, node.ID)
+	if err != nil {
+		return releaseFailedReservation(c, node.ID, fmt.Errorf("error leasing node %s: %s", node.ID, err))
+	}
+	defer rackhdapi.OnInterrupt(fmt.Sprintf("release node %s", node.ID), func() error {
+		return rackhdapi.ReleaseClaimedNode(c, node.ID)
+	})()
+
 	workflowName, err := workflows.PublishReserveNodeWorkflow(c)
 	if err != nil {
-		return fmt.Errorf("error publishing reserve workflow: %s", err)
+		return releaseFailedReservation(c, node.ID, fmt.Errorf("error publishing reserve workflow: %s", err))
 	}
 
 	err = workflows.RunReserveNodeWorkflow(c, node.ID, workflowName)
 	if err != nil {
-		return fmt.Errorf("error running reserve workflow: %s", err)
+		return releaseFailedReservation(c, node.ID, fmt.Errorf("error running reserve workflow: %s", err))
 	}
 
 	log.Info(fmt.Sprintf("reserved node %s", node.ID))
 	return nil
 }
 
+// releaseFailedReservation hands back a node this request claimed but failed
+// to reserve. A node claimed by another request in the meantime is left alone,
+// and the claim conflict is returned instead of err so that another node is
+// tried.
+func releaseFailedReservation(c config.Cpi, nodeID string, err error) error {
+	releaseErr := rackhdapi.ReleaseClaimedNode(c, nodeID)
+	if releaseErr != nil && strings.HasPrefix(releaseErr.Error(), rackhdapi.NodeClaimConflict) {
+		return releaseErr
+	}
+	if releaseErr != nil {
+		log.Error(fmt.Sprintf("error releasing node %s after failing to reserve it: %s", nodeID, releaseErr))
+	}
+
+	return err
+}
+
 func SelectNodeFromRackHD(c config.Cpi, nodeID string, filter Filter) (rackhdapi.Node, error) {
+	return selectNodeFromRackHD(c, nodeID, filter, placementGroup{})
+}
+
+// SpreadAcrossFailureDomains selects like SelectNodeFromRackHD, but prefers
+// nodes in the racks and chassis hosting the fewest VMs of the group
+func SpreadAcrossFailureDomains(group placementGroup) selectionFunc {
+	return func(c config.Cpi, nodeID string, filter Filter) (rackhdapi.Node, error) {
+		return selectNodeFromRackHD(c, nodeID, filter, group)
+	}
+}
+
+func selectNodeFromRackHD(c config.Cpi, nodeID string, filter Filter, group placementGroup) (rackhdapi.Node, error) {
 	if nodeID != "" {
 		node, err := rackhdapi.GetNode(c, nodeID)
 
@@ -143,7 +247,12 @@ func SelectNodeFromRackHD(c config.Cpi, nodeID string, filter Filter) (rackhdapi
 		return rackhdapi.Node{}, err
 	}
 
-	node, err := randomSelectAvailableNode(c, nodes, filter)
+	var node rackhdapi.Node
+	if group.empty() {
+		node, err = randomSelectAvailableNode(c, nodes, filter)
+	} else {
+		node, err = firstAvailableNode(c, orderByFailureDomain(c, shuffleNodes(nodes), group), filter)
+	}
 	if err != nil || node.ID == "" {
 		return rackhdapi.Node{}, err
 	}
@@ -153,25 +262,112 @@ func SelectNodeFromRackHD(c config.Cpi, nodeID string, filter Filter) (rackhdapi
 }
 
 func randomSelectAvailableNode(c config.Cpi, nodes []rackhdapi.Node, filter Filter) (rackhdapi.Node, error) {
+	return firstAvailableNode(c, shuffleNodes(nodes), filter)
+}
+
+func shuffleNodes(nodes []rackhdapi.Node) []rackhdapi.Node {
 	rand.Seed(time.Now().UnixNano())
 	shuffle := rand.Perm(len(nodes))
 	log.Debug(fmt.Sprintf("Accessing nodes randomly with pattern: %v", shuffle))
 
+	shuffled := make([]rackhdapi.Node, len(nodes))
 	for i := range shuffle {
-		node := nodes[shuffle[i]]
-		log.Debug(fmt.Sprintf("Trying node: %v", node.ID))
-		if nodeIsAvailable(c, node, filter) {
-			log.Debug(fmt.Sprintf("node %s is available", node.ID))
-			return node, nil
+		shuffled[i] = nodes[shuffle[i]]
+	}
+
+	return shuffled
+}
+
+type candidateCheck struct {
+	index     int
+	available bool
+	rejection string
+}
+
+// firstAvailableNode returns the first of the nodes, in order, that is
+// available. Nodes are checked concurrently, but no more than
+// max_concurrent_node_checks past the first node whose check has not finished,
+// and no further checks start once the first available node is known.
+func firstAvailableNode(c config.Cpi, nodes []rackhdapi.Node, filter Filter) (rackhdapi.Node, error) {
+	workers := c.MaxConcurrentNodeChecks
+	if workers < 1 {
+		workers = 1
+	}
+
+	checks := make([]*candidateCheck, len(nodes))
+	done := make(chan candidateCheck)
+	started, inFlight, next := 0, 0, 0
+	found := -1
+	for {
+		for found < 0 && started < next+workers && started < len(nodes) {
+			go func(index int) {
+				done <- checkCandidate(c, index, nodes[index], filter)
+			}(started)
+			started++
+			inFlight++
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		check := <-done
+		inFlight--
+		checks[check.index] = &check
+		for found < 0 && next < len(nodes) && checks[next] != nil {
+			if checks[next].available {
+				found = next
+			} else {
+				next++
+			}
+		}
+	}
+
+	if found >= 0 {
+		return nodes[found], nil
+	}
+
+	rejections := map[string]string{}
+	for i, check := range checks {
+		if check != nil && check.rejection != "" {
+			rejections[nodes[i].ID] = check.rejection
+		}
+	}
+
+	if len(rejections) > 0 {
+		nodeIDs := make([]string, 0, len(rejections))
+		for nodeID := range rejections {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+		sort.Strings(nodeIDs)
+
+		reasons := make([]string, 0, len(nodeIDs))
+		for _, nodeID := range nodeIDs {
+			reasons = append(reasons, fmt.Sprintf("node %s %s", nodeID, rejections[nodeID]))
 		}
+
+		return rackhdapi.Node{}, fmt.Errorf("no available node meets the requirements: %s", strings.Join(reasons, "; "))
 	}
 
 	return rackhdapi.Node{}, errors.New("all nodes have been reserved")
 }
 
-func nodeIsAvailable(c config.Cpi, n rackhdapi.Node, filter Filter) bool {
+func checkCandidate(c config.Cpi, index int, node rackhdapi.Node, filter Filter) candidateCheck {
+	log.Debug(fmt.Sprintf("Trying node: %v", node.ID))
+	rejections := map[string]string{}
+	available := nodeIsAvailable(c, node, filter, rejections)
+	if available {
+		log.Debug(fmt.Sprintf("node %s is available", node.ID))
+	}
+
+	return candidateCheck{index: index, available: available, rejection: rejections[node.ID]}
+}
+
+func nodeIsAvailable(c config.Cpi, n rackhdapi.Node, filter Filter, rejections map[string]string) bool {
 	return hasAvailableState(n) &&
-		hasNotBeenFiltered(c, n, filter) &&
+		!isExcluded(c, n, rejections) &&
+		!n.IsClaimedByOther(c, time.Now()) &&
+		hasNotBeenFiltered(c, n, filter, rejections) &&
 		hasNoActiveWorkflow(c, n.ID) &&
 		hasOBMSettings(c, n.ID) &&
 		!hasPersistentDisk(n)
@@ -181,11 +377,28 @@ func hasAvailableState(n rackhdapi.Node) bool {
 	return (n.Status == "" || n.Status == rackhdapi.Available) && (n.CID == "")
 }
 
-func hasNotBeenFiltered(c config.Cpi, n rackhdapi.Node, filter Filter) bool {
+func isExcluded(c config.Cpi, n rackhdapi.Node, rejections map[string]string) bool {
+	if c.IsNodeExcluded(n.ID) {
+		log.Debug(fmt.Sprintf("node %s is in excluded_node_ids", n.ID))
+		rejections[n.ID] = "is listed in excluded_node_ids"
+		return true
+	}
+
+	return false
+}
+
+func hasNotBeenFiltered(c config.Cpi, n rackhdapi.Node, filter Filter, rejections map[string]string) bool {
 	log.Debug(fmt.Sprintf("Applying filter"))
-	valid, err := filter.Run(c, n)
+	valid, reason, err := filter.Run(c, n)
 	if err != nil {
 		log.Error(fmt.Sprintf("Error applying filter to node %s: %v\n", n.ID, err))
+		rejections[n.ID] = err.Error()
+		return false
+	}
+
+	if !valid {
+		log.Debug(fmt.Sprintf("node %s %s", n.ID, reason))
+		rejections[n.ID] = reason
 	}
 
 	return valid
@@ -206,7 +419,7 @@ func hasNoActiveWorkflow(c config.Cpi, nodeID string) bool {
 
 func hasOBMSettings(c config.Cpi, nodeID string) bool {
 	log.Debug(fmt.Sprintf("Getting OBM settings"))
-	obmSettings, err := rackhdapi.GetOBMSettings(c, nodeID)
+	obmSettings, err := nodeInfo.obm(c, nodeID)
 	if err != nil {
 		log.Error(fmt.Sprintf("Error getting OBM settings on node %s: %v\n", nodeID, err))
 	}
@@ -0,0 +1,150 @@
+package cpi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeRackHD answers the requests made while checking candidate nodes after a
+// fixed latency. Nodes listed in busy have an active workflow.
+type fakeRackHD struct {
+	server           *httptest.Server
+	latency          time.Duration
+	busy             map[string]bool
+	workflowRequests int64
+	nodeRequests     int64
+	catalogRequests  int64
+}
+
+func newFakeRackHD(latency time.Duration, busy map[string]bool) *fakeRackHD {
+	fake := &fakeRackHD{latency: latency, busy: busy}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	return fake
+}
+
+func (fake *fakeRackHD) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(fake.latency)
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	nodeID := parts[3]
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/workflows/active"):
+		atomic.AddInt64(&fake.workflowRequests, 1)
+		if !fake.busy[nodeID] {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(rackhdapi.WorkflowResponse{ID: "workflow-" + nodeID, Status: "valid"})
+	case strings.HasSuffix(r.URL.Path, "/catalogs/ohai"):
+		atomic.AddInt64(&fake.catalogRequests, 1)
+		json.NewEncoder(w).Encode(rackhdapi.NodeCatalog{Data: rackhdapi.CatalogData{
+			BlockDevices: map[string]rackhdapi.Device{rackhdapi.PersistentDiskLocation: {Size: "104857600"}},
+		}})
+	default:
+		atomic.AddInt64(&fake.nodeRequests, 1)
+		json.NewEncoder(w).Encode(rackhdapi.Node{
+			ID:          nodeID,
+			OBMSettings: []rackhdapi.OBMSetting{{ServiceName: rackhdapi.OBMSettingIPMIServiceName}},
+		})
+	}
+}
+
+func fakeNodes(count int) []rackhdapi.Node {
+	nodes := make([]rackhdapi.Node, count)
+	for i := range nodes {
+		nodes[i] = rackhdapi.Node{ID: fmt.Sprintf("node-%03d", i), Status: rackhdapi.Available}
+	}
+
+	return nodes
+}
+
+var _ = Describe("Checking candidate nodes", func() {
+	var fake *fakeRackHD
+	var nodes []rackhdapi.Node
+	var cpiConfig config.Cpi
+
+	BeforeEach(func() {
+		nodes = fakeNodes(20)
+		busy := map[string]bool{}
+		for _, node := range nodes {
+			busy[node.ID] = node.ID != "node-013" && node.ID != "node-017"
+		}
+		fake = newFakeRackHD(5*time.Millisecond, busy)
+		cpiConfig = config.Cpi{
+			ApiServer:               fake.server.URL,
+			RequestID:               "select-node-spec",
+			MaxConcurrentNodeChecks: 4,
+		}
+	})
+
+	AfterEach(func() {
+		fake.server.Close()
+	})
+
+	It("selects the first available node in order", func() {
+		node, err := firstAvailableNode(cpiConfig, nodes, Filter{nil, AllowAnyNodeMethod})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(node.ID).To(Equal("node-013"))
+	})
+
+	It("stops starting checks once a node is found", func() {
+		_, err := firstAvailableNode(cpiConfig, nodes, Filter{nil, AllowAnyNodeMethod})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(atomic.LoadInt64(&fake.workflowRequests)).To(BeNumerically("<=", 13+cpiConfig.MaxConcurrentNodeChecks))
+	})
+
+	It("fetches the catalog and OBM settings of a node once per request", func() {
+		sizeFilter := Filter{1024, FilterBasedOnSizeMethod}
+		_, err := firstAvailableNode(cpiConfig, nodes[13:14], AllFilters(sizeFilter, sizeFilter))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = firstAvailableNode(cpiConfig, nodes[13:14], sizeFilter)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(atomic.LoadInt64(&fake.catalogRequests)).To(BeEquivalentTo(1))
+		Expect(atomic.LoadInt64(&fake.nodeRequests)).To(BeEquivalentTo(1))
+
+		cpiConfig.RequestID = "another-request"
+		_, err = firstAvailableNode(cpiConfig, nodes[13:14], sizeFilter)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(atomic.LoadInt64(&fake.catalogRequests)).To(BeEquivalentTo(2))
+	})
+})
+
+func benchmarkFirstAvailableNode(b *testing.B, concurrency int) {
+	nodes := fakeNodes(100)
+	busy := map[string]bool{}
+	for _, node := range nodes[:len(nodes)-1] {
+		busy[node.ID] = true
+	}
+	fake := newFakeRackHD(2*time.Millisecond, busy)
+	defer fake.server.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := config.Cpi{
+			ApiServer:               fake.server.URL,
+			RequestID:               fmt.Sprintf("benchmark-%d", i),
+			MaxConcurrentNodeChecks: concurrency,
+		}
+		_, err := firstAvailableNode(c, nodes, Filter{1024, FilterBasedOnSizeMethod})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFirstAvailableNodeSequential(b *testing.B) { benchmarkFirstAvailableNode(b, 1) }
+
+func BenchmarkFirstAvailableNodeConcurrent(b *testing.B) { benchmarkFirstAvailableNode(b, 8) }
@@ -34,7 +34,7 @@ func SetVMMetadata(c config.Cpi, extInput bosh.MethodArguments) error {
 	node, err := rackhdapi.GetNodeByVMCID(c, cid)
 	nodeID := node.ID
 	if err != nil {
-		return err
+		return asVMNotFound(err)
 	}
 
 	return rackhdapi.SetNodeMetadata(c, nodeID, string(metadata))
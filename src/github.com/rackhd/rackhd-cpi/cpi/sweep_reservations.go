@@ -0,0 +1,49 @@
+package cpi
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+// SweepAbandonedReservations releases the nodes left reserved by requests that
+// died before creating a vm on them. It is run by the sweep subcommand rather
+// than on every node selection.
+func SweepAbandonedReservations(c config.Cpi) ([]string, error) {
+	nodes, err := rackhdapi.GetNodes(c)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	released := []string{}
+	for _, n := range nodes {
+		if !hasAbandonedReservation(c, n, now) {
+			continue
+		}
+
+		err := rackhdapi.ReleaseLeasedNode(c, n.ID)
+		if err != nil {
+			log.Error(fmt.Sprintf("error releasing abandoned reservation on node %s: %s", n.ID, err))
+			continue
+		}
+
+		log.Info(fmt.Sprintf("released node %s reserved by request %s at %s", n.ID, n.Lease.RequestID, time.Unix(n.Lease.ReservedAt, 0).UTC()))
+		released = append(released, n.ID)
+	}
+
+	return released, nil
+}
+
+func hasAbandonedReservation(c config.Cpi, n rackhdapi.Node, now time.Time) bool {
+	return n.Status == rackhdapi.Reserved &&
+		n.CID == "" &&
+		!hasPersistentDisk(n) &&
+		n.Lease != nil &&
+		n.Lease.Expired(c.ReservationLeaseTTLSeconds*time.Second, now) &&
+		hasNoActiveWorkflow(c, n.ID)
+}
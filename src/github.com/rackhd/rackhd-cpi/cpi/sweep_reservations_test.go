@@ -0,0 +1,113 @@
+package cpi_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/onsi/gomega/ghttp"
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/cpi"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+var _ = Describe("SweepAbandonedReservations", func() {
+	var server *ghttp.Server
+	var cpiConfig config.Cpi
+	var nodes []rackhdapi.Node
+
+	BeforeEach(func() {
+		server, _, cpiConfig, _ = helpers.SetUp("")
+		cpiConfig.ReservationLeaseTTLSeconds = 60 * 60
+
+		nodes = helpers.LoadNodes("../spec_assets/dummy_two_node_response.json")
+		for i := range nodes {
+			nodes[i].Status = rackhdapi.Reserved
+			nodes[i].CID = ""
+			nodes[i].PersistentDisk = rackhdapi.PersistentDiskSettings{}
+			nodes[i].Lease = &rackhdapi.NodeLease{
+				RequestID:  "dead-request",
+				ReservedAt: time.Now().Add(-2 * time.Hour).Unix(),
+			}
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("releases reservations whose lease has expired", func() {
+		nodes[1].Lease.ReservedAt = time.Now().Unix()
+		nodesData, err := json.Marshal(nodes)
+		Expect(err).ToNot(HaveOccurred())
+
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/common/nodes"),
+				ghttp.RespondWith(http.StatusOK, nodesData),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", fmt.Sprintf("/api/1.1/nodes/%s/workflows/active", nodes[0].ID)),
+				ghttp.RespondWith(http.StatusNoContent, []byte{}),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", nodes[0].ID)),
+				ghttp.VerifyJSON(`{"status": "available", "cpi_lease": null, "cpi_claim": null}`),
+			),
+		)
+
+		released, err := cpi.SweepAbandonedReservations(cpiConfig)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(Equal([]string{nodes[0].ID}))
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+	})
+
+	It("leaves reservations that have a vm, a disk or an active workflow", func() {
+		nodes[0].CID = "vm-1234"
+		nodes[1].PersistentDisk.DiskCID = "disk-1234"
+		nodes = append(nodes, nodes[0])
+		nodes[2].ID = "5665a65a0561790005b77b85"
+		nodes[2].CID = ""
+		nodesData, err := json.Marshal(nodes)
+		Expect(err).ToNot(HaveOccurred())
+
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/common/nodes"),
+				ghttp.RespondWith(http.StatusOK, nodesData),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", fmt.Sprintf("/api/1.1/nodes/%s/workflows/active", nodes[2].ID)),
+				ghttp.RespondWith(http.StatusOK, helpers.LoadJSON("../spec_assets/dummy_workflow_response.json")),
+			),
+		)
+
+		released, err := cpi.SweepAbandonedReservations(cpiConfig)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(BeEmpty())
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+	})
+
+	It("leaves reservations made before leases existed", func() {
+		nodes[0].Lease = nil
+		nodes[1].Lease = nil
+		nodesData, err := json.Marshal(nodes)
+		Expect(err).ToNot(HaveOccurred())
+
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/common/nodes"),
+				ghttp.RespondWith(http.StatusOK, nodesData),
+			),
+		)
+
+		released, err := cpi.SweepAbandonedReservations(cpiConfig)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(BeEmpty())
+	})
+})
@@ -0,0 +1,83 @@
+package cpi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+type tagRequirements struct {
+	Tags        []string `json:"tags"`
+	AnyTags     []string `json:"any_tags"`
+	ExcludeTags []string `json:"exclude_tags"`
+}
+
+func (r tagRequirements) required() bool {
+	return len(r.Tags) > 0 || len(r.AnyTags) > 0 || len(r.ExcludeTags) > 0
+}
+
+func (r tagRequirements) validate() error {
+	for _, tag := range r.Tags {
+		if contains(r.ExcludeTags, tag) {
+			return fmt.Errorf("tag %s is both required and excluded", tag)
+		}
+	}
+
+	for _, tag := range r.AnyTags {
+		if contains(r.ExcludeTags, tag) {
+			return fmt.Errorf("tag %s is both in any_tags and excluded", tag)
+		}
+	}
+
+	return nil
+}
+
+func (f Filter) FilterBasedOnTags(node rackhdapi.Node) (bool, string, error) {
+	requirements, ok := f.data.(tagRequirements)
+	if !ok {
+		return false, "", errors.New("error converting tag requirements: requirements have unexpected type")
+	}
+
+	var unmet []string
+
+	var missing []string
+	for _, tag := range requirements.Tags {
+		if !contains(node.Tags, tag) {
+			missing = append(missing, tag)
+		}
+	}
+	if len(missing) > 0 {
+		unmet = append(unmet, fmt.Sprintf("is missing tags %v", missing))
+	}
+
+	if len(requirements.AnyTags) > 0 {
+		found := false
+		for _, tag := range requirements.AnyTags {
+			if contains(node.Tags, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unmet = append(unmet, fmt.Sprintf("has none of tags %v", requirements.AnyTags))
+		}
+	}
+
+	var excluded []string
+	for _, tag := range requirements.ExcludeTags {
+		if contains(node.Tags, tag) {
+			excluded = append(excluded, tag)
+		}
+	}
+	if len(excluded) > 0 {
+		unmet = append(unmet, fmt.Sprintf("has excluded tags %v", excluded))
+	}
+
+	if len(unmet) > 0 {
+		return false, strings.Join(unmet, ", "), nil
+	}
+
+	return true, "", nil
+}
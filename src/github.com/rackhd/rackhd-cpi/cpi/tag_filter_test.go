@@ -0,0 +1,92 @@
+package cpi
+
+import (
+	"github.com/rackhd/rackhd-cpi/bosh"
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Filtering nodes on tags", func() {
+	var node rackhdapi.Node
+
+	BeforeEach(func() {
+		node = rackhdapi.Node{ID: "55e79ea54e66816f6152fff9", Tags: []string{"pool-a", "ssd"}}
+	})
+
+	It("accepts a node that has all required tags, one of any_tags and no excluded tags", func() {
+		filter := Filter{tagRequirements{
+			Tags:        []string{"pool-a"},
+			AnyTags:     []string{"hdd", "ssd"},
+			ExcludeTags: []string{"broken"},
+		}, FilterBasedOnTagsMethod}
+
+		valid, reason, err := filter.Run(config.Cpi{}, node)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(valid).To(BeTrue())
+		Expect(reason).To(BeEmpty())
+	})
+
+	It("lists every tag requirement a node does not meet", func() {
+		filter := Filter{tagRequirements{
+			Tags:        []string{"pool-a", "pool-b", "gpu"},
+			AnyTags:     []string{"hdd", "nvme"},
+			ExcludeTags: []string{"ssd"},
+		}, FilterBasedOnTagsMethod}
+
+		valid, reason, err := filter.Run(config.Cpi{}, node)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(valid).To(BeFalse())
+		Expect(reason).To(Equal("is missing tags [pool-b gpu], has none of tags [hdd nvme], has excluded tags [ssd]"))
+	})
+
+	It("never selects a node listed in excluded_node_ids", func() {
+		nodes := helpers.LoadNodes("../spec_assets/dummy_two_node_response.json")
+		nodes[1].Status = rackhdapi.Available
+		nodes[1].CID = ""
+		cpiConfig := config.Cpi{ExcludedNodeIDs: []string{nodes[0].ID, nodes[1].ID}}
+
+		_, err := randomSelectAvailableNode(cpiConfig, nodes, Filter{nil, AllowAnyNodeMethod})
+		Expect(err).To(MatchError("no available node meets the requirements: " +
+			"node 55e79ea54e66816f6152fff9 is listed in excluded_node_ids; " +
+			"node 55e79eb14e66816f6152fffb is listed in excluded_node_ids"))
+	})
+
+	Describe("parsing tag requirements", func() {
+		It("reads tags from cloud properties", func() {
+			extInput := bosh.MethodArguments{"agent-id", "vm-478585", map[string]interface{}{
+				"tags":         []interface{}{"pool-a"},
+				"any_tags":     []interface{}{"hdd", "ssd"},
+				"exclude_tags": []interface{}{"broken"},
+			}}
+
+			properties, err := parseVMCloudProperties(extInput)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(properties.Tags).To(Equal(tagRequirements{
+				Tags:        []string{"pool-a"},
+				AnyTags:     []string{"hdd", "ssd"},
+				ExcludeTags: []string{"broken"},
+			}))
+		})
+
+		It("returns an error if a tag is both required and excluded", func() {
+			extInput := bosh.MethodArguments{"agent-id", "vm-478585", map[string]interface{}{
+				"tags":         []interface{}{"pool-a"},
+				"exclude_tags": []interface{}{"pool-a"},
+			}}
+
+			_, err := parseVMCloudProperties(extInput)
+			Expect(err).To(MatchError("tags in cloud properties are invalid: tag pool-a is both required and excluded"))
+		})
+
+		It("returns an error if tags is not a list", func() {
+			extInput := bosh.MethodArguments{"agent-id", "vm-478585", map[string]interface{}{"tags": "pool-a"}}
+
+			_, err := parseVMCloudProperties(extInput)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -126,26 +126,41 @@ func MakeTryReservationHandlers(requestID string, nodeID string, expectedNodesPa
 		),
 	}
 
+	reservationHandlers = append(reservationHandlers, MakeClaimHandlers(requestID, expectedNode)...)
+	reservationHandlers = append(reservationHandlers, ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", nodeID)))
 	return append(reservationHandlers, MakeWorkflowHandlers("Reserve", requestID, nodeID)...)
 }
 
-func MakeWorkflowHandlers(workflow string, requestID string, nodeID string) []http.HandlerFunc {
-	taskStubData := []byte(fmt.Sprintf("[{\"injectableName\": \"Task.BOSH.%s.Node.%s\"}]", workflow, requestID))
-	workflowStubData := []byte(fmt.Sprintf("[{\"injectableName\": \"Graph.BOSH.%sNode.%s\"}]", workflow, requestID))
-	nodeStubData := []byte(`{"obmSettings": [{"service": "fake-obm-service"}]}`)
-	completedWorkflowResponse := []byte(fmt.Sprintf("{\"id\": \"%s\", \"_status\": \"succeeded\"}", requestID))
+func MakeClaimHandlers(requestID string, node rackhdapi.Node) []http.HandlerFunc {
+	unclaimedNodeData, err := json.Marshal(node)
+	Expect(err).ToNot(HaveOccurred())
+
+	node.Claim = &rackhdapi.NodeClaim{RequestID: requestID}
+	claimedNodeData, err := json.Marshal(node)
+	Expect(err).ToNot(HaveOccurred())
 
 	return []http.HandlerFunc{
-		ghttp.VerifyRequest("PUT", "/api/1.1/workflows/tasks"),
 		ghttp.CombineHandlers(
-			ghttp.VerifyRequest("GET", "/api/1.1/workflows/tasks/library"),
-			ghttp.RespondWith(http.StatusOK, taskStubData),
+			ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+			ghttp.RespondWith(http.StatusOK, unclaimedNodeData),
 		),
-		ghttp.VerifyRequest("PUT", "/api/1.1/workflows"),
 		ghttp.CombineHandlers(
-			ghttp.VerifyRequest("GET", "/api/1.1/workflows/library"),
-			ghttp.RespondWith(http.StatusOK, workflowStubData),
+			ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+			ghttp.RespondWith(http.StatusOK, claimedNodeData),
 		),
+		ghttp.CombineHandlers(
+			ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+			ghttp.RespondWith(http.StatusOK, claimedNodeData),
+		),
+	}
+}
+
+func MakeWorkflowHandlers(workflow string, requestID string, nodeID string) []http.HandlerFunc {
+	nodeStubData := []byte(`{"obmSettings": [{"service": "fake-obm-service"}]}`)
+	completedWorkflowResponse := []byte(fmt.Sprintf("{\"id\": \"%s\", \"_status\": \"succeeded\"}", requestID))
+
+	handlers := MakePublishHandlers(fmt.Sprintf("Graph.BOSH.%sNode.", workflow), 1)
+	return append(handlers,
 		ghttp.CombineHandlers(
 			ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", nodeID)),
 			ghttp.RespondWith(http.StatusOK, nodeStubData),
@@ -158,5 +173,45 @@ func MakeWorkflowHandlers(workflow string, requestID string, nodeID string) []ht
 			ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/workflows/%s", requestID)),
 			ghttp.RespondWith(http.StatusOK, completedWorkflowResponse),
 		),
+	)
+}
+
+// MakePublishHandlers answers publishing a graph whose name starts with
+// graphPrefix, and its tasks, to a library that does not hold it yet. The
+// library lists the names that were published.
+func MakePublishHandlers(graphPrefix string, taskCount int) []http.HandlerFunc {
+	published := []rackhdapi.TaskStub{}
+	publish := func(w http.ResponseWriter, req *http.Request) {
+		stub := rackhdapi.TaskStub{}
+		err := json.NewDecoder(req.Body).Decode(&stub)
+		Expect(err).ToNot(HaveOccurred())
+		published = append(published, stub)
+	}
+	library := func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(published)
+	}
+
+	handlers := []http.HandlerFunc{
+		ghttp.CombineHandlers(
+			ghttp.VerifyRequest("GET", "/api/1.1/workflows/library"),
+			ghttp.RespondWith(http.StatusOK, []byte(`[]`)),
+		),
+	}
+	for i := 0; i < taskCount; i++ {
+		handlers = append(handlers,
+			ghttp.CombineHandlers(ghttp.VerifyRequest("PUT", "/api/1.1/workflows/tasks"), publish),
+			ghttp.CombineHandlers(ghttp.VerifyRequest("GET", "/api/1.1/workflows/tasks/library"), library),
+		)
 	}
+
+	return append(handlers,
+		ghttp.CombineHandlers(
+			ghttp.VerifyRequest("PUT", "/api/1.1/workflows"),
+			publish,
+			func(w http.ResponseWriter, req *http.Request) {
+				Expect(published[len(published)-1].Name).To(HavePrefix(graphPrefix))
+			},
+		),
+		ghttp.CombineHandlers(ghttp.VerifyRequest("GET", "/api/1.1/workflows/library"), library),
+	)
 }
@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -15,24 +18,69 @@ import (
 	"github.com/rackhd/rackhd-cpi/bosh"
 	"github.com/rackhd/rackhd-cpi/config"
 	"github.com/rackhd/rackhd-cpi/cpi"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+	"github.com/rackhd/rackhd-cpi/workflows"
 )
 
 var responseLogBuffer *bytes.Buffer
 
+// exitMutex is held by whichever of the method and the signal handler
+// responds first, so that the director receives exactly one response
+var exitMutex sync.Mutex
+
+// handleSignals cleans up the work in progress on RackHD when the director
+// kills the cpi, and responds with an error instead of the interrupted method
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-signals
+		exitMutex.Lock()
+
+		err := fmt.Errorf("interrupted by %s", sig)
+		log.Error(err)
+		cleanupErr := rackhdapi.Interrupt()
+		if cleanupErr != nil {
+			err = fmt.Errorf("%s; %s", err, cleanupErr)
+		}
+
+		fmt.Println(bosh.BuildDefaultErrorResponse(err, true, responseLogBuffer.String()))
+		os.Exit(1)
+	}()
+}
+
 func exitWithDefaultError(err error) {
+	exitMutex.Lock()
 	log.Error(err)
 	fmt.Println(bosh.BuildDefaultErrorResponse(err, false, responseLogBuffer.String()))
 	responseLogBuffer.Reset()
 	os.Exit(1)
 }
 
+func exitWithCloudError(err error, context string) {
+	exitMutex.Lock()
+	if cloudErr, ok := err.(bosh.CloudError); ok {
+		err = cloudErr.Wrap(context)
+	} else {
+		err = fmt.Errorf("%s: %s", context, err)
+	}
+
+	log.Error(err)
+	fmt.Println(bosh.BuildCloudErrorResponse(err, responseLogBuffer.String()))
+	responseLogBuffer.Reset()
+	os.Exit(1)
+}
+
 func exitWithNotImplementedError(err error) {
+	exitMutex.Lock()
 	fmt.Println(bosh.BuildErrorResponse(err, bosh.NotImplementedErrorType, false, responseLogBuffer.String()))
 	responseLogBuffer.Reset()
 	os.Exit(1)
 }
 
 func exitWithResult(result interface{}) {
+	exitMutex.Lock()
 	fmt.Println(bosh.BuildResultResponse(result, responseLogBuffer.String()))
 	responseLogBuffer.Reset()
 	os.Exit(0)
@@ -43,6 +91,7 @@ func main() {
 	multiWriter := io.MultiWriter(os.Stderr, responseLogBuffer)
 	logLevel := os.Getenv("RACKHD_CPI_LOG_LEVEL")
 	log.SetOutput(multiWriter)
+	rackhdapi.ResponseLog = responseLogBuffer
 
 	switch logLevel {
 	case "DEBUG":
@@ -57,6 +106,14 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	if len(os.Args) > 1 {
+		if command, found := commands[os.Args[1]]; found {
+			log.SetOutput(os.Stderr)
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+	handleSignals()
+
 	configPath := flag.String("configPath", "", "Path to configuration file")
 	flag.Parse()
 
@@ -97,76 +154,242 @@ func main() {
 	case bosh.CREATE_STEMCELL:
 		cid, err := cpi.CreateStemcell(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running CreateStemcell: %s", err))
+			exitWithCloudError(err, "Error running CreateStemcell")
 		}
 		exitWithResult(cid)
 	case bosh.CREATE_VM:
 		vmcid, err := cpi.CreateVM(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running CreateVM: %s", err))
+			exitWithCloudError(err, "Error running CreateVM")
 		}
 		exitWithResult(vmcid)
 	case bosh.DELETE_STEMCELL:
 		err = cpi.DeleteStemcell(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running DeleteStemcell: %s", err))
+			exitWithCloudError(err, "Error running DeleteStemcell")
 		}
 		exitWithResult("")
 	case bosh.DELETE_VM:
 		err = cpi.DeleteVM(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running DeleteVM: %s", err))
+			exitWithCloudError(err, "Error running DeleteVM")
+		}
+		exitWithResult("")
+	case bosh.REBOOT_VM:
+		err = cpi.RebootVM(cpiConfig, req.Arguments)
+		if err != nil {
+			exitWithCloudError(err, "Error running RebootVM")
 		}
 		exitWithResult("")
 	case bosh.SET_VM_METADATA:
 		err := cpi.SetVMMetadata(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running SetVMMetadata: %s", err))
+			exitWithCloudError(err, "Error running SetVMMetadata")
 		}
 		exitWithResult("")
 	case bosh.HAS_VM:
 		hasVM, err := cpi.HasVM(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running HasVM: %s", err))
+			exitWithCloudError(err, "Error running HasVM")
 		}
 		exitWithResult(hasVM)
 	case bosh.CREATE_DISK:
 		diskCID, err := cpi.CreateDisk(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running CreateDisk: %s", err))
+			exitWithCloudError(err, "Error running CreateDisk")
 		}
 		exitWithResult(diskCID)
 	case bosh.DELETE_DISK:
 		err := cpi.DeleteDisk(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running DeleteDisk: %s", err))
+			exitWithCloudError(err, "Error running DeleteDisk")
 		}
 		exitWithResult("")
 	case bosh.ATTACH_DISK:
 		err := cpi.AttachDisk(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running AttachDisk: %s", err))
+			exitWithCloudError(err, "Error running AttachDisk")
 		}
 		exitWithResult("")
 	case bosh.DETACH_DISK:
 		err := cpi.DetachDisk(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running DetachDisk: %s", err))
+			exitWithCloudError(err, "Error running DetachDisk")
 		}
 		exitWithResult("")
 	case bosh.HAS_DISK:
 		diskExists, err := cpi.HasDisk(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running HasDisk: %s", err))
+			exitWithCloudError(err, "Error running HasDisk")
 		}
 		exitWithResult(diskExists)
 	case bosh.GET_DISKS:
 		diskCIDs, err := cpi.GetDisks(cpiConfig, req.Arguments)
 		if err != nil {
-			exitWithDefaultError(fmt.Errorf("Error running GetDisks: %s", err))
+			exitWithCloudError(err, "Error running GetDisks")
 		}
 		exitWithResult(diskCIDs)
+	case bosh.DELETE_SNAPSHOT:
+		err := cpi.DeleteSnapshot(cpiConfig, req.Arguments)
+		if err != nil {
+			exitWithCloudError(err, "Error running DeleteSnapshot")
+		}
+		exitWithResult("")
 	default:
 		exitWithDefaultError(fmt.Errorf("Unexpected command: %s dispatched...aborting", req.Method))
 	}
 }
+
+// commands are the maintenance subcommands of the cpi, run by an operator
+// rather than the director. Each returns the exit code of the command.
+var commands = map[string]func(args []string) int{
+	"cleanup-definitions": cleanupDefinitions,
+	"reconcile":           reconcile,
+	"sweep":               sweep,
+}
+
+// loadCommandConfig reads the cpi configuration for a subcommand
+func loadCommandConfig(configPath string) (config.Cpi, error) {
+	file, err := os.Open(configPath)
+	if err != nil {
+		return config.Cpi{}, fmt.Errorf("unable to open configuration file %s", err)
+	}
+	defer file.Close()
+
+	return config.New(file, bosh.CpiRequest{})
+}
+
+// sweep releases the nodes left reserved by requests that died before
+// creating a vm on them
+func sweep(args []string) int {
+	flags := flag.NewFlagSet("sweep", flag.ContinueOnError)
+	configPath := flags.String("configPath", "", "Path to configuration file")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	cpiConfig, err := loadCommandConfig(*configPath)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	released, err := cpi.SweepAbandonedReservations(cpiConfig)
+	if err != nil {
+		log.Error(fmt.Sprintf("error sweeping abandoned reservations: %s", err))
+		return 1
+	}
+
+	for _, nodeID := range released {
+		fmt.Printf("node %s: released\n", nodeID)
+	}
+
+	return 0
+}
+
+// cleanupDefinitions deletes the workflow definitions uploaded by earlier
+// releases of the cpi from the RackHD library
+func cleanupDefinitions(args []string) int {
+	flags := flag.NewFlagSet("cleanup-definitions", flag.ContinueOnError)
+	configPath := flags.String("configPath", "", "Path to configuration file")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	cpiConfig, err := loadCommandConfig(*configPath)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	deleted, err := workflows.CleanupStaleDefinitions(cpiConfig)
+	for _, name := range deleted {
+		fmt.Printf("definition %s: deleted\n", name)
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("error cleaning up stale definitions: %s", err))
+		return 1
+	}
+
+	return 0
+}
+
+// reconcile lists the nodes whose state on RackHD is inconsistent, and fixes
+// them with --fix. It returns the exit code of the command.
+func reconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	configPath := flags.String("configPath", "", "Path to configuration file")
+	vmCIDsPath := flags.String("vmCIDs", "", "Path to the vm cids the director knows about, one per line")
+	diskCIDsPath := flags.String("diskCIDs", "", "Path to the disk cids the director knows about, one per line")
+	fix := flags.Bool("fix", false, "Fix the inconsistencies found")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	file, err := os.Open(*configPath)
+	if err != nil {
+		log.Error(fmt.Sprintf("unable to open configuration file %s", err))
+		return 1
+	}
+	defer file.Close()
+
+	cpiConfig, err := config.New(file, bosh.CpiRequest{})
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	var director cpi.DirectorCIDs
+	director.VMs, err = readCIDs(*vmCIDsPath)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	director.Disks, err = readCIDs(*diskCIDsPath)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	inconsistencies, err := cpi.FindInconsistencies(cpiConfig, director)
+	if err != nil {
+		log.Error(fmt.Sprintf("error finding inconsistent nodes: %s", err))
+		return 1
+	}
+
+	exitCode := 0
+	for _, inconsistency := range inconsistencies {
+		if !*fix {
+			fmt.Printf("node %s %s: would %s\n", inconsistency.NodeID, inconsistency.Problem, inconsistency.Fix)
+			continue
+		}
+
+		err = inconsistency.Apply(cpiConfig)
+		if err != nil {
+			fmt.Printf("node %s %s: %s: %s\n", inconsistency.NodeID, inconsistency.Problem, inconsistency.Fix, err)
+			exitCode = 1
+			continue
+		}
+		fmt.Printf("node %s %s: %s: done\n", inconsistency.NodeID, inconsistency.Problem, inconsistency.Fix)
+	}
+
+	return exitCode
+}
+
+// readCIDs reads the cids at path, or returns nil if no path was given
+func readCIDs(path string) (map[string]bool, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open cids file %s", err)
+	}
+	defer file.Close()
+
+	return cpi.ReadCIDs(file)
+}
@@ -0,0 +1,342 @@
+package rackhdapi
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rackhd/rackhd-cpi/config"
+)
+
+// RetryBackoff is how long the client waits before retrying a failed request.
+// It doubles with each further attempt.
+var RetryBackoff = 500 * time.Millisecond
+
+// Client sends requests to the RackHD API with connect and read timeouts, and
+// retries idempotent requests that fail with a connection error or a 5xx.
+// Requests other than uploads must also complete, body included, within the
+// request timeout.
+// When credentials are configured it logs in for a JWT, sends it with every
+// request, and logs in again when the API answers 401.
+type Client struct {
+	httpClient   *http.Client
+	uploadClient *http.Client
+	maxRetries   int
+	loginURL     string
+	username     string
+	password     string
+	err          error
+
+	tokenMutex sync.Mutex
+	token      string
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	Token string `json:"token"`
+}
+
+type clientSettings struct {
+	apiServer      string
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	requestTimeout time.Duration
+	maxRetries     int
+	tls            config.TLSConfig
+	username       string
+	password       string
+}
+
+var (
+	clientsMutex sync.Mutex
+	clients      = map[clientSettings]*Client{}
+)
+
+func NewClient(c config.Cpi) (*Client, error) {
+	tlsConfig, err := buildTLSConfig(c.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   time.Second * c.ConnectTimeoutSeconds,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   time.Second * c.ConnectTimeoutSeconds,
+		ResponseHeaderTimeout: time.Second * c.ReadTimeoutSeconds,
+	}
+
+	return &Client{
+		httpClient:   &http.Client{Transport: transport, Timeout: time.Second * c.RequestTimeoutSeconds},
+		uploadClient: &http.Client{Transport: transport},
+		maxRetries:   c.MaxRequestRetries,
+		loginURL:     fmt.Sprintf("%s/login", c.ApiServer),
+		username:     c.Username,
+		password:     c.Password,
+	}, nil
+}
+
+func buildTLSConfig(t config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+
+	if t.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(t.CACert)) {
+			return nil, errors.New("error parsing ca_cert: no PEM encoded certificates found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if t.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(t.ClientCert), []byte(t.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing client_cert and client_key: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// clientFor returns a client shared by all calls made with the same settings,
+// so that connections to the API and the login token are reused. A client that
+// could not be built returns the error from every request.
+func clientFor(c config.Cpi) *Client {
+	settings := clientSettings{
+		apiServer:      c.ApiServer,
+		connectTimeout: c.ConnectTimeoutSeconds,
+		readTimeout:    c.ReadTimeoutSeconds,
+		requestTimeout: c.RequestTimeoutSeconds,
+		maxRetries:     c.MaxRequestRetries,
+		tls:            c.TLS,
+		username:       c.Username,
+		password:       c.Password,
+	}
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	client, exists := clients[settings]
+	if !exists {
+		var err error
+		client, err = NewClient(c)
+		if err != nil {
+			client = &Client{err: err}
+		}
+		clients[settings] = client
+	}
+
+	return client
+}
+
+func (cl *Client) Get(url string) (*http.Response, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return cl.Do(request)
+}
+
+// Do sends the request. GET, PATCH and DELETE requests are retried with
+// backoff on connection errors and 5xx responses, so their body is read into
+// memory to be sent again.
+func (cl *Client) Do(request *http.Request) (*http.Response, error) {
+	body, err := bufferBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return cl.send(cl.httpClient, request, body)
+}
+
+// Upload sends the request like Do, but without the request timeout, since
+// the time it takes to send a file grows with its size. The body is streamed
+// rather than read into memory, so an upload is only sent again when it has
+// no body.
+func (cl *Client) Upload(request *http.Request) (*http.Response, error) {
+	return cl.send(cl.uploadClient, request, nil)
+}
+
+// send sends the request, with body holding the bytes of its body when the
+// request can be replayed
+func (cl *Client) send(httpClient *http.Client, request *http.Request, body []byte) (*http.Response, error) {
+	if cl.err != nil {
+		return nil, cl.err
+	}
+
+	replayable := request.Body == nil || body != nil
+	attempts := 1
+	if isRetryable(request) && replayable {
+		attempts += cl.maxRetries
+	}
+
+	err := cl.authenticate(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *http.Response
+	reauthenticated := false
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			backoff := RetryBackoff * time.Duration(1<<uint(attempt-1))
+			log.Debug(fmt.Sprintf("retry %d: %s %s in %s", attempt, request.Method, request.URL, backoff))
+			time.Sleep(backoff)
+
+			rewindBody(request, body)
+		}
+
+		resp, err = httpClient.Do(request)
+		if err != nil {
+			log.Error(fmt.Sprintf("error sending %s %s: %s", request.Method, request.URL, err))
+			continue
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && cl.username != "" && !reauthenticated && replayable {
+			log.Info(fmt.Sprintf("%s %s was unauthorized, logging in again", request.Method, request.URL))
+			discard(resp)
+			reauthenticated = true
+			cl.clearToken()
+
+			err = cl.authenticate(request)
+			if err != nil {
+				return nil, err
+			}
+
+			rewindBody(request, body)
+
+			resp, err = httpClient.Do(request)
+			if err != nil {
+				log.Error(fmt.Sprintf("error sending %s %s: %s", request.Method, request.URL, err))
+				continue
+			}
+		}
+
+		if resp.StatusCode < 500 || attempt == attempts-1 {
+			return resp, nil
+		}
+
+		log.Error(fmt.Sprintf("%s %s failed with status: %s", request.Method, request.URL, resp.Status))
+		discard(resp)
+	}
+
+	return resp, err
+}
+
+func (cl *Client) authenticate(request *http.Request) error {
+	if cl.username == "" {
+		return nil
+	}
+
+	token, err := cl.authToken()
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("JWT %s", token))
+
+	return nil
+}
+
+func (cl *Client) authToken() (string, error) {
+	cl.tokenMutex.Lock()
+	defer cl.tokenMutex.Unlock()
+
+	if cl.token != "" {
+		return cl.token, nil
+	}
+
+	body, err := json.Marshal(loginRequest{Username: cl.username, Password: cl.password})
+	if err != nil {
+		return "", fmt.Errorf("error marshalling login request: %s", err)
+	}
+
+	resp, err := cl.httpClient.Post(cl.loginURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("error logging in to %s: %s", cl.loginURL, err)
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading login response body: %s", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("Failed logging in to %s as %s with status: %s", cl.loginURL, cl.username, resp.Status)
+	}
+
+	var login loginResponse
+	err = json.Unmarshal(respBytes, &login)
+	if err != nil || login.Token == "" {
+		return "", fmt.Errorf("error reading token from login response: %s", string(respBytes))
+	}
+
+	log.Debug(fmt.Sprintf("logged in to %s as %s", cl.loginURL, cl.username))
+	cl.token = login.Token
+	return cl.token, nil
+}
+
+func (cl *Client) clearToken() {
+	cl.tokenMutex.Lock()
+	defer cl.tokenMutex.Unlock()
+
+	cl.token = ""
+}
+
+func isRetryable(request *http.Request) bool {
+	switch request.Method {
+	case "GET", "PATCH", "DELETE":
+		return true
+	default:
+		return false
+	}
+}
+
+// bufferBody reads the body of the request into memory, and replaces it with
+// a reader over the bytes read
+func bufferBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error reading body of %s %s: %s", request.Method, request.URL, err)
+	}
+	rewindBody(request, body)
+
+	return body, nil
+}
+
+func rewindBody(request *http.Request, body []byte) {
+	if body == nil {
+		return
+	}
+
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+}
+
+func discard(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
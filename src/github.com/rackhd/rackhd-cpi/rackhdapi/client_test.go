@@ -0,0 +1,311 @@
+package rackhdapi_test
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Client", func() {
+	var server *ghttp.Server
+	var cpiConfig config.Cpi
+	var client *rackhdapi.Client
+	var retryBackoff time.Duration
+
+	BeforeEach(func() {
+		server, _, cpiConfig, _ = helpers.SetUp("")
+		cpiConfig.MaxRequestRetries = 2
+		var err error
+		client, err = rackhdapi.NewClient(cpiConfig)
+		Expect(err).ToNot(HaveOccurred())
+		retryBackoff = rackhdapi.RetryBackoff
+		rackhdapi.RetryBackoff = time.Millisecond
+	})
+
+	AfterEach(func() {
+		rackhdapi.RetryBackoff = retryBackoff
+		server.Close()
+	})
+
+	It("retries a GET that fails with a 5xx", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/common/nodes"),
+				ghttp.RespondWith(http.StatusServiceUnavailable, nil),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/common/nodes"),
+				ghttp.RespondWith(http.StatusOK, []byte("[]")),
+			),
+		)
+
+		resp, err := client.Get(fmt.Sprintf("%s/api/common/nodes", server.URL()))
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+	})
+
+	It("replays the body of a retried PATCH", func() {
+		body := []byte(`{"status":"reserved"}`)
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PATCH", "/api/common/nodes/55e79ea54e66816f6152fff9"),
+				ghttp.RespondWith(http.StatusInternalServerError, nil),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PATCH", "/api/common/nodes/55e79ea54e66816f6152fff9"),
+				ghttp.VerifyJSON(string(body)),
+				ghttp.RespondWith(http.StatusOK, nil),
+			),
+		)
+
+		err := rackhdapi.PatchNode(cpiConfig, "55e79ea54e66816f6152fff9", body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+	})
+
+	It("replays a body that can only be read once", func() {
+		body := []byte(`{"status":"reserved"}`)
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PATCH", "/api/common/nodes/55e79ea54e66816f6152fff9"),
+				ghttp.RespondWith(http.StatusInternalServerError, nil),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PATCH", "/api/common/nodes/55e79ea54e66816f6152fff9"),
+				ghttp.VerifyJSON(string(body)),
+				ghttp.RespondWith(http.StatusOK, nil),
+			),
+		)
+
+		request, err := http.NewRequest("PATCH", fmt.Sprintf("%s/api/common/nodes/55e79ea54e66816f6152fff9", server.URL()), ioutil.NopCloser(bytes.NewReader(body)))
+		Expect(err).ToNot(HaveOccurred())
+		request.Header.Set("Content-Type", "application/json")
+		request.ContentLength = int64(len(body))
+
+		resp, err := client.Do(request)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+	})
+
+	It("returns the last response once retries are exhausted", func() {
+		for i := 0; i < 3; i++ {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusBadGateway, nil))
+		}
+
+		resp, err := client.Get(fmt.Sprintf("%s/api/common/nodes", server.URL()))
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+	})
+
+	It("does not retry a POST", func() {
+		server.AppendHandlers(ghttp.RespondWith(http.StatusInternalServerError, nil))
+
+		request, err := http.NewRequest("POST", fmt.Sprintf("%s/api/1.1/nodes/55e79ea54e66816f6152fff9/workflows/", server.URL()), bytes.NewReader([]byte("{}")))
+		Expect(err).ToNot(HaveOccurred())
+
+		resp, err := client.Do(request)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	It("returns the connection error once retries are exhausted", func() {
+		closedServer := ghttp.NewServer()
+		url := fmt.Sprintf("%s/api/common/nodes", closedServer.URL())
+		closedServer.Close()
+
+		_, err := client.Get(url)
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("with a request timeout", func() {
+		slowBody := func(w http.ResponseWriter, req *http.Request) {
+			ioutil.ReadAll(req.Body)
+			w.WriteHeader(http.StatusCreated)
+			w.(http.Flusher).Flush()
+			time.Sleep(1500 * time.Millisecond)
+			w.Write([]byte("uploaded"))
+		}
+
+		BeforeEach(func() {
+			cpiConfig.RequestTimeoutSeconds = 1
+			var err error
+			client, err = rackhdapi.NewClient(cpiConfig)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("gives up on a response whose body takes too long", func() {
+			server.AppendHandlers(slowBody)
+
+			resp, err := client.Get(fmt.Sprintf("%s/api/common/nodes", server.URL()))
+			if err == nil {
+				defer resp.Body.Close()
+				_, err = ioutil.ReadAll(resp.Body)
+			}
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("does not apply to uploads", func() {
+			server.AppendHandlers(slowBody)
+
+			request, err := http.NewRequest("PUT", fmt.Sprintf("%s/api/common/files/agent-env", server.URL()), bytes.NewReader([]byte("{}")))
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := client.Upload(request)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal("uploaded"))
+		})
+	})
+
+	Context("with credentials", func() {
+		BeforeEach(func() {
+			cpiConfig.Username = "admin"
+			cpiConfig.Password = "admin123"
+			var err error
+			client, err = rackhdapi.NewClient(cpiConfig)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		login := func(token string) http.HandlerFunc {
+			return ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/login"),
+				ghttp.VerifyJSON(`{"username":"admin","password":"admin123"}`),
+				ghttp.RespondWith(http.StatusOK, []byte(fmt.Sprintf(`{"token":"%s"}`, token))),
+			)
+		}
+
+		It("logs in once and sends the token with every request", func() {
+			server.AppendHandlers(
+				login("token-1"),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.VerifyHeaderKV("Authorization", "JWT token-1"),
+					ghttp.RespondWith(http.StatusOK, []byte("[]")),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/skus"),
+					ghttp.VerifyHeaderKV("Authorization", "JWT token-1"),
+					ghttp.RespondWith(http.StatusOK, []byte("[]")),
+				),
+			)
+
+			resp, err := client.Get(fmt.Sprintf("%s/api/common/nodes", server.URL()))
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			resp, err = client.Get(fmt.Sprintf("%s/api/common/skus", server.URL()))
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(server.ReceivedRequests()).To(HaveLen(3))
+		})
+
+		It("logs in again when the token is rejected", func() {
+			server.AppendHandlers(
+				login("token-1"),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", "/api/common/nodes/55e79ea54e66816f6152fff9"),
+					ghttp.RespondWith(http.StatusUnauthorized, nil),
+				),
+				login("token-2"),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", "/api/common/nodes/55e79ea54e66816f6152fff9"),
+					ghttp.VerifyHeaderKV("Authorization", "JWT token-2"),
+					ghttp.VerifyJSON(`{"status":"reserved"}`),
+					ghttp.RespondWith(http.StatusOK, nil),
+				),
+			)
+
+			request, err := http.NewRequest("PATCH", fmt.Sprintf("%s/api/common/nodes/55e79ea54e66816f6152fff9", server.URL()), bytes.NewReader([]byte(`{"status":"reserved"}`)))
+			Expect(err).ToNot(HaveOccurred())
+			request.Header.Set("Content-Type", "application/json")
+
+			resp, err := client.Do(request)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("returns an error if the login fails", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/login"),
+					ghttp.RespondWith(http.StatusUnauthorized, nil),
+				),
+			)
+
+			_, err := client.Get(fmt.Sprintf("%s/api/common/nodes", server.URL()))
+			Expect(err).To(MatchError(fmt.Sprintf("Failed logging in to %s/login as admin with status: 401 Unauthorized", server.URL())))
+		})
+	})
+
+	Context("with an HTTPS api_url", func() {
+		var tlsServer *ghttp.Server
+
+		BeforeEach(func() {
+			tlsServer = ghttp.NewTLSServer()
+			tlsServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, []byte("[]")))
+			cpiConfig.ApiServer = tlsServer.URL()
+		})
+
+		AfterEach(func() {
+			tlsServer.Close()
+		})
+
+		It("verifies the server against the configured ca_cert", func() {
+			certificate := tlsServer.HTTPTestServer.Certificate()
+			cpiConfig.TLS.CACert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+			client, err := rackhdapi.NewClient(cpiConfig)
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := client.Get(fmt.Sprintf("%s/api/common/nodes", tlsServer.URL()))
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("rejects a server it cannot verify", func() {
+			cpiConfig.MaxRequestRetries = 0
+			client, err := rackhdapi.NewClient(cpiConfig)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = client.Get(fmt.Sprintf("%s/api/common/nodes", tlsServer.URL()))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("skips verification when insecure_skip_verify is set", func() {
+			cpiConfig.TLS.InsecureSkipVerify = true
+			client, err := rackhdapi.NewClient(cpiConfig)
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := client.Get(fmt.Sprintf("%s/api/common/nodes", tlsServer.URL()))
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+		})
+
+		It("returns an error if the ca_cert is not PEM encoded", func() {
+			cpiConfig.TLS.CACert = "not a certificate"
+			_, err := rackhdapi.NewClient(cpiConfig)
+			Expect(err).To(MatchError("error parsing ca_cert: no PEM encoded certificates found"))
+		})
+	})
+})
@@ -0,0 +1,215 @@
+package rackhdapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rackhd/rackhd-cpi/config"
+)
+
+const (
+	workflowRunningStatus = "running"
+	workflowPendingStatus = "pending"
+)
+
+// endpoints builds the urls and decodes the responses of the RackHD API
+// version the cpi is configured for. The 1.1 API mixes /api/common and
+// /api/1.1 routes; the 2.0 API serves everything under /api/2.0.
+type endpoints struct {
+	apiServer string
+	v2        bool
+}
+
+func endpointsFor(c config.Cpi) endpoints {
+	return endpoints{apiServer: c.ApiServer, v2: c.ApiVersion == config.ApiVersion2}
+}
+
+func (e endpoints) url(v1Path string, v2Path string, args ...interface{}) string {
+	path := v1Path
+	if e.v2 {
+		path = v2Path
+	}
+
+	return e.apiServer + fmt.Sprintf(path, args...)
+}
+
+func (e endpoints) nodes() string {
+	return e.url("/api/common/nodes", "/api/2.0/nodes")
+}
+
+func (e endpoints) node(nodeID string) string {
+	return e.url("/api/common/nodes/%s", "/api/2.0/nodes/%s", nodeID)
+}
+
+func (e endpoints) nodeCatalog(nodeID string, source string) string {
+	return e.url("/api/common/nodes/%s/catalogs/%s", "/api/2.0/nodes/%s/catalogs/%s", nodeID, source)
+}
+
+func (e endpoints) skus() string {
+	return e.url("/api/common/skus", "/api/2.0/skus")
+}
+
+func (e endpoints) file(identifier string) string {
+	return e.url("/api/common/files/%s", "/api/2.0/files/%s", identifier)
+}
+
+func (e endpoints) fileMetadata(baseName string) string {
+	return e.url("/api/common/files/metadata/%s", "/api/2.0/files/%s/metadata", baseName)
+}
+
+func (e endpoints) tasks() string {
+	return e.url("/api/1.1/workflows/tasks", "/api/2.0/workflows/tasks")
+}
+
+func (e endpoints) taskLibrary() string {
+	return e.url("/api/1.1/workflows/tasks/library", "/api/2.0/workflows/tasks")
+}
+
+func (e endpoints) graphs() string {
+	return e.url("/api/1.1/workflows", "/api/2.0/workflows/graphs")
+}
+
+func (e endpoints) graphLibrary() string {
+	return e.url("/api/1.1/workflows/library", "/api/2.0/workflows/graphs")
+}
+
+// taskDefinition and graphDefinition are the routes of a single library entry.
+// Entries can only be deleted on the 2.0 API.
+func (e endpoints) taskDefinition(injectableName string) string {
+	return e.url("", "/api/2.0/workflows/tasks/%s", injectableName)
+}
+
+func (e endpoints) graphDefinition(injectableName string) string {
+	return e.url("", "/api/2.0/workflows/graphs/%s", injectableName)
+}
+
+func (e endpoints) workflow(workflowID string) string {
+	return e.url("/api/common/workflows/%s", "/api/2.0/workflows/%s", workflowID)
+}
+
+func (e endpoints) nodeWorkflows(nodeID string) string {
+	return e.url("/api/1.1/nodes/%s/workflows/", "/api/2.0/nodes/%s/workflows", nodeID)
+}
+
+func (e endpoints) activeWorkflow(nodeID string) string {
+	return e.url("/api/1.1/nodes/%s/workflows/active", "/api/2.0/nodes/%s/workflows/active", nodeID)
+}
+
+// publishedStatus is the status the API answers a published task or graph with
+func (e endpoints) publishedStatus() int {
+	if e.v2 {
+		return http.StatusCreated
+	}
+
+	return http.StatusOK
+}
+
+// cancelActiveWorkflowRequest deletes the active workflow of a node on the 1.1
+// API. The 2.0 API cancels it with a command sent to the workflow action route.
+func (e endpoints) cancelActiveWorkflowRequest(nodeID string) (*http.Request, error) {
+	if !e.v2 {
+		return http.NewRequest("DELETE", e.activeWorkflow(nodeID), nil)
+	}
+
+	body := []byte(`{"command":"cancel"}`)
+	request, err := http.NewRequest("PUT", e.url("", "/api/2.0/nodes/%s/workflows/action", nodeID), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	return request, nil
+}
+
+func (e endpoints) obmSettings(node Node) []OBMSetting {
+	if e.v2 {
+		return node.OBMs
+	}
+
+	return node.OBMSettings
+}
+
+type workflowResponseV2 struct {
+	Name       string                    `json:"injectableName"`
+	Tasks      map[string]taskResponseV2 `json:"tasks"`
+	Status     string                    `json:"status"`
+	InstanceID string                    `json:"instanceId"`
+}
+
+type taskResponseV2 struct {
+	Name  string     `json:"injectableName"`
+	Label string     `json:"label"`
+	State string     `json:"state"`
+	Error *TaskError `json:"error"`
+}
+
+// decodeWorkflow reads a workflow instance. Instances on the 2.0 API are
+// identified by instanceId and report their status in status rather than
+// _status; they have no pending task list and stay running until they finish.
+func (e endpoints) decodeWorkflow(body []byte) (WorkflowResponse, error) {
+	if !e.v2 {
+		var workflow WorkflowResponse
+		err := json.Unmarshal(body, &workflow)
+		return workflow, err
+	}
+
+	var v2Workflow workflowResponseV2
+	err := json.Unmarshal(body, &v2Workflow)
+	if err != nil {
+		return WorkflowResponse{}, err
+	}
+
+	workflow := WorkflowResponse{
+		Name:   v2Workflow.Name,
+		Status: v2Workflow.Status,
+		ID:     v2Workflow.InstanceID,
+	}
+	if len(v2Workflow.Tasks) > 0 {
+		workflow.Tasks = map[string]TaskResponse{}
+		for id, task := range v2Workflow.Tasks {
+			workflow.Tasks[id] = TaskResponse{Name: task.Name, Label: task.Label, State: task.State, Error: task.Error}
+		}
+	}
+
+	return workflow, nil
+}
+
+// decodeNodes reads a node listing. The 2.0 API links a node to its sku with
+// the url of the sku rather than its id.
+func (e endpoints) decodeNodes(body []byte) ([]Node, error) {
+	var nodes []Node
+	err := json.Unmarshal(body, &nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.v2 {
+		for i := range nodes {
+			nodes[i].SKU = skuIDFromLink(nodes[i].SKU)
+		}
+	}
+
+	return nodes, nil
+}
+
+func (e endpoints) decodeNode(body []byte) (Node, error) {
+	var node Node
+	err := json.Unmarshal(body, &node)
+	if err != nil {
+		return Node{}, err
+	}
+
+	if e.v2 {
+		node.SKU = skuIDFromLink(node.SKU)
+	}
+
+	return node, nil
+}
+
+func skuIDFromLink(sku string) string {
+	sku = strings.TrimSuffix(sku, "/")
+	return sku[strings.LastIndex(sku, "/")+1:]
+}
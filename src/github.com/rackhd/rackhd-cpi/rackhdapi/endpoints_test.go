@@ -0,0 +1,208 @@
+package rackhdapi_test
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("The 2.0 API", func() {
+	var server *ghttp.Server
+	var cpiConfig config.Cpi
+
+	BeforeEach(func() {
+		server, _, cpiConfig, _ = helpers.SetUp("")
+		cpiConfig.ApiVersion = config.ApiVersion2
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("gets nodes, catalogs and skus under /api/2.0", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/2.0/nodes"),
+				ghttp.RespondWith(http.StatusOK, []byte(`[{"id":"55e79ea54e66816f6152fff9"}]`)),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/2.0/nodes/55e79ea54e66816f6152fff9/catalogs/ohai"),
+				ghttp.RespondWith(http.StatusOK, []byte(`{"data":{}}`)),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/2.0/skus"),
+				ghttp.RespondWith(http.StatusOK, []byte(`[]`)),
+			),
+		)
+
+		nodes, err := rackhdapi.GetNodes(cpiConfig)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nodes).To(HaveLen(1))
+		_, err = rackhdapi.GetNodeCatalog(cpiConfig, nodes[0].ID)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = rackhdapi.GetSKUs(cpiConfig)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+	})
+
+	It("reads the sku id from the sku link of a node", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/2.0/nodes"),
+				ghttp.RespondWith(http.StatusOK, []byte(`[{"id":"55e79ea54e66816f6152fff9","sku":"/api/2.0/skus/5666e4b2a3a8be2c53a2c6b1"}]`)),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/2.0/nodes/55e79ea54e66816f6152fff9"),
+				ghttp.RespondWith(http.StatusOK, []byte(`{"id":"55e79ea54e66816f6152fff9","sku":"/api/2.0/skus/5666e4b2a3a8be2c53a2c6b1"}`)),
+			),
+		)
+
+		nodes, err := rackhdapi.GetNodes(cpiConfig)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nodes[0].SKU).To(Equal("5666e4b2a3a8be2c53a2c6b1"))
+
+		node, err := rackhdapi.GetNode(cpiConfig, "55e79ea54e66816f6152fff9")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(node.SKU).To(Equal("5666e4b2a3a8be2c53a2c6b1"))
+	})
+
+	It("reads obm settings from obms", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/2.0/nodes/55e79ea54e66816f6152fff9"),
+				ghttp.RespondWith(http.StatusOK, []byte(`{"id":"55e79ea54e66816f6152fff9","obms":[{"ref":"/api/2.0/obms/1","service":"ipmi-obm-service"}]}`)),
+			),
+		)
+
+		serviceName, err := rackhdapi.GetOBMServiceName(cpiConfig, "55e79ea54e66816f6152fff9")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(serviceName).To(Equal(rackhdapi.OBMSettingIPMIServiceName))
+	})
+
+	It("deletes a file by the uuid in its metadata", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/2.0/files/stemcell/metadata"),
+				ghttp.RespondWith(http.StatusOK, []byte(`[{"basename":"stemcell","uuid":"e8cf5b5f-1f3e-4b55-8a5d-9d2e5c5e7c1a"}]`)),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("DELETE", "/api/2.0/files/e8cf5b5f-1f3e-4b55-8a5d-9d2e5c5e7c1a"),
+				ghttp.RespondWith(http.StatusNoContent, nil),
+			),
+		)
+
+		err := rackhdapi.DeleteFile(cpiConfig, "stemcell")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+	})
+
+	It("publishes tasks and graphs to the 2.0 library", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PUT", "/api/2.0/workflows/tasks"),
+				ghttp.RespondWith(http.StatusCreated, nil),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/2.0/workflows/tasks"),
+				ghttp.RespondWith(http.StatusOK, []byte(`[{"injectableName":"Task.BOSH.Provision"}]`)),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PUT", "/api/2.0/workflows/graphs"),
+				ghttp.RespondWith(http.StatusCreated, nil),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/2.0/workflows/graphs"),
+				ghttp.RespondWith(http.StatusOK, []byte(`[{"injectableName":"Graph.BOSH.Provision"}]`)),
+			),
+		)
+
+		err := rackhdapi.PublishTask(cpiConfig, []byte(`{"injectableName":"Task.BOSH.Provision"}`))
+		Expect(err).ToNot(HaveOccurred())
+		err = rackhdapi.PublishWorkflow(cpiConfig, []byte(`{"injectableName":"Graph.BOSH.Provision"}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.ReceivedRequests()).To(HaveLen(4))
+	})
+
+	It("posts a workflow and reads the instance id and status", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/api/2.0/nodes/55e79ea54e66816f6152fff9/workflows"),
+				ghttp.VerifyJSON(`{"name":"Graph.BOSH.Provision","options":{}}`),
+				ghttp.RespondWith(http.StatusCreated, []byte(`{"instanceId":"a8f3c6c1","injectableName":"Graph.BOSH.Provision","status":"running"}`)),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/2.0/workflows/a8f3c6c1"),
+				ghttp.RespondWith(http.StatusOK, []byte(`{"instanceId":"a8f3c6c1","injectableName":"Graph.BOSH.Provision","status":"succeeded","tasks":{"t1":{"injectableName":"Task.BOSH.Provision","state":"succeeded"}}}`)),
+			),
+		)
+
+		body := rackhdapi.RunWorkflowRequestBody{Name: "Graph.BOSH.Provision", Options: map[string]interface{}{}}
+		posted, err := rackhdapi.WorkflowPoster(cpiConfig, "55e79ea54e66816f6152fff9", body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(posted.ID).To(Equal("a8f3c6c1"))
+		Expect(posted.Status).To(Equal("running"))
+
+		fetched, err := rackhdapi.WorkflowFetcher(cpiConfig, posted.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fetched.Status).To(Equal("succeeded"))
+		Expect(fetched.Tasks).To(Equal(map[string]rackhdapi.TaskResponse{
+			"t1": {Name: "Task.BOSH.Provision", State: "succeeded"},
+		}))
+	})
+
+	It("keeps polling a running workflow until it finishes", func() {
+		cpiConfig.RunWorkflowTimeoutSeconds = 20
+		server.AppendHandlers(
+			ghttp.RespondWith(http.StatusCreated, []byte(`{"instanceId":"a8f3c6c1","status":"running"}`)),
+			ghttp.RespondWith(http.StatusOK, []byte(`{"instanceId":"a8f3c6c1","status":"running"}`)),
+			ghttp.RespondWith(http.StatusOK, []byte(`{"instanceId":"a8f3c6c1","status":"succeeded"}`)),
+		)
+
+		body := rackhdapi.RunWorkflowRequestBody{Name: "Graph.BOSH.Provision"}
+		err := rackhdapi.RunWorkflow(rackhdapi.WorkflowPoster, rackhdapi.WorkflowFetcher, cpiConfig, "55e79ea54e66816f6152fff9", body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+	})
+
+	It("cancels the active workflow with the cancel command", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/2.0/nodes/55e79ea54e66816f6152fff9/workflows/active"),
+				ghttp.RespondWith(http.StatusOK, []byte(`{"instanceId":"a8f3c6c1","status":"running"}`)),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PUT", "/api/2.0/nodes/55e79ea54e66816f6152fff9/workflows/action"),
+				ghttp.VerifyJSON(`{"command":"cancel"}`),
+				ghttp.RespondWith(http.StatusAccepted, nil),
+			),
+		)
+
+		active, err := rackhdapi.GetActiveWorkflows(cpiConfig, "55e79ea54e66816f6152fff9")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(active.ID).To(Equal("a8f3c6c1"))
+
+		err = rackhdapi.KillActiveWorkflow(cpiConfig, "55e79ea54e66816f6152fff9")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+	})
+
+	It("still uses the 1.1 routes by default", func() {
+		cpiConfig.ApiVersion = config.ApiVersion1
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("DELETE", fmt.Sprintf("/api/1.1/nodes/%s/workflows/active", "55e79ea54e66816f6152fff9")),
+				ghttp.RespondWith(http.StatusNoContent, nil),
+			),
+		)
+
+		err := rackhdapi.KillActiveWorkflow(cpiConfig, "55e79ea54e66816f6152fff9")
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
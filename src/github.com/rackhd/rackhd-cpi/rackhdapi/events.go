@@ -0,0 +1,162 @@
+package rackhdapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/streadway/amqp"
+
+	"github.com/rackhd/rackhd-cpi/config"
+)
+
+const (
+	rackHDEventsExchange  = "on.events"
+	graphFinishedEventKey = "graph.finished.#"
+	taskFinishedEventKey  = "task.finished.#"
+)
+
+// EventPollInterval is how often RunWorkflow fetches the status of a workflow
+// while it receives RackHD events, in case an event is lost
+var EventPollInterval = 30 * time.Second
+
+// WorkflowEvent is a graph-finished or task-finished event RackHD published
+// for a workflow instance
+type WorkflowEvent struct {
+	Type    string
+	GraphID string
+	Status  string
+}
+
+// EventSubscriber subscribes to the workflow events RackHD publishes. The
+// events channel is closed when the subscription is lost.
+type EventSubscriber interface {
+	Subscribe() (events <-chan WorkflowEvent, unsubscribe func(), err error)
+}
+
+// NewEventSubscriber returns the subscriber RunWorkflow uses when amqp_url is
+// set. Specs replace it with an in-process stand-in for the broker.
+var NewEventSubscriber = func(c config.Cpi) EventSubscriber {
+	return amqpSubscriber{url: c.AMQPURL, connectTimeout: time.Second * c.ConnectTimeoutSeconds}
+}
+
+type amqpSubscriber struct {
+	url            string
+	connectTimeout time.Duration
+}
+
+type rackHDEvent struct {
+	Type   string `json:"type"`
+	Action string `json:"action"`
+	TypeID string `json:"typeId"`
+	Data   struct {
+		GraphID string `json:"graphId"`
+		Status  string `json:"status"`
+		State   string `json:"state"`
+	} `json:"data"`
+}
+
+func (s amqpSubscriber) Subscribe() (<-chan WorkflowEvent, func(), error) {
+	conn, err := amqp.DialConfig(s.url, amqp.Config{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, s.connectTimeout)
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to amqp broker: %s", err)
+	}
+
+	deliveries, err := consumeWorkflowEvents(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	events := make(chan WorkflowEvent, 64)
+	go func() {
+		defer close(events)
+		for delivery := range deliveries {
+			event, err := decodeWorkflowEvent(delivery.Body)
+			if err != nil {
+				log.Debug(fmt.Sprintf("ignoring event with routing key %s: %s", delivery.RoutingKey, err))
+				continue
+			}
+
+			select {
+			case events <- event:
+			default:
+				log.Debug(fmt.Sprintf("dropping event for workflow %s, no one is listening", event.GraphID))
+			}
+		}
+	}()
+
+	return events, func() { conn.Close() }, nil
+}
+
+func consumeWorkflowEvents(conn *amqp.Connection) (<-chan amqp.Delivery, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("error opening amqp channel: %s", err)
+	}
+
+	queue, err := channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error declaring amqp queue: %s", err)
+	}
+
+	for _, key := range []string{graphFinishedEventKey, taskFinishedEventKey} {
+		err = channel.QueueBind(queue.Name, key, rackHDEventsExchange, false, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error binding to %s events on exchange %s: %s", key, rackHDEventsExchange, err)
+		}
+	}
+
+	deliveries, err := channel.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error consuming amqp queue: %s", err)
+	}
+
+	return deliveries, nil
+}
+
+// decodeWorkflowEvent reads a RackHD event. Graph events are identified by
+// the graph id; task events carry the id of their graph in their data.
+func decodeWorkflowEvent(body []byte) (WorkflowEvent, error) {
+	var e rackHDEvent
+	err := json.Unmarshal(body, &e)
+	if err != nil {
+		return WorkflowEvent{}, err
+	}
+
+	event := WorkflowEvent{Type: e.Type, GraphID: e.Data.GraphID, Status: e.Data.Status}
+	if e.Type == "graph" {
+		event.GraphID = e.TypeID
+	}
+	if event.Status == "" {
+		event.Status = e.Data.State
+	}
+
+	if event.GraphID == "" {
+		return WorkflowEvent{}, fmt.Errorf("%s event has no graph id", e.Type)
+	}
+
+	return event, nil
+}
+
+// subscribeToEvents returns the workflow events when amqp_url is set and the
+// broker can be reached, or nil to fall back to polling
+func subscribeToEvents(c config.Cpi) (<-chan WorkflowEvent, func()) {
+	if c.AMQPURL == "" {
+		return nil, func() {}
+	}
+
+	events, unsubscribe, err := NewEventSubscriber(c).Subscribe()
+	if err != nil {
+		log.Info(fmt.Sprintf("polling for workflow status, could not subscribe to RackHD events: %s", err))
+		return nil, func() {}
+	}
+
+	return events, unsubscribe
+}
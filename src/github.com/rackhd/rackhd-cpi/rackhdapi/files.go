@@ -22,7 +22,7 @@ type FileMetadataResponse []struct {
 }
 
 func UploadFile(c config.Cpi, baseName string, r io.Reader, contentLength int64) (string, error) {
-	url := fmt.Sprintf("%s/api/common/files/%s", c.ApiServer, baseName)
+	url := endpointsFor(c).file(baseName)
 	body := ioutil.NopCloser(r)
 	request, err := http.NewRequest("PUT", url, body)
 	if err != nil {
@@ -31,7 +31,7 @@ func UploadFile(c config.Cpi, baseName string, r io.Reader, contentLength int64)
 	request.ContentLength = contentLength
 
 	log.Debug(fmt.Sprintf("uploading file: %s to server", baseName))
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := clientFor(c).Upload(request)
 	if err != nil {
 		return "", fmt.Errorf("Error making request to api server: %s", err)
 	}
@@ -53,8 +53,8 @@ func UploadFile(c config.Cpi, baseName string, r io.Reader, contentLength int64)
 }
 
 func DeleteFile(c config.Cpi, baseName string) error {
-	url := fmt.Sprintf("%s/api/common/files/metadata/%s", c.ApiServer, baseName)
-	metadataResp, err := http.Get(url)
+	url := endpointsFor(c).fileMetadata(baseName)
+	metadataResp, err := clientFor(c).Get(url)
 	if err != nil {
 		return fmt.Errorf("error getting file metadata: %s", err)
 	}
@@ -76,16 +76,17 @@ func DeleteFile(c config.Cpi, baseName string) error {
 		return fmt.Errorf("error unmarshalling metadata response: %s", err)
 	}
 
-	url = fmt.Sprintf("%s/api/common/files/%s", c.ApiServer, metadata[0].UUID)
+	url = endpointsFor(c).file(metadata[0].UUID)
 	deleteReq, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
 		return fmt.Errorf("error creating delete request %s", err)
 	}
 
-	deleteResp, err := http.DefaultClient.Do(deleteReq)
+	deleteResp, err := clientFor(c).Do(deleteReq)
 	if err != nil {
 		return fmt.Errorf("error performing delete request %s", err)
 	}
+	defer deleteResp.Body.Close()
 
 	if deleteResp.StatusCode == 404 {
 		log.Error(fmt.Sprintf("File with basename: %s has already been deleted", baseName))
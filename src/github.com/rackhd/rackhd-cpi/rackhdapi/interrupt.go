@@ -0,0 +1,69 @@
+package rackhdapi
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type interruptCleanup struct {
+	description string
+	run         func() error
+}
+
+var (
+	cleanupsMutex sync.Mutex
+	nextCleanupID int
+	cleanups      = map[int]interruptCleanup{}
+)
+
+// OnInterrupt registers a cleanup that undoes work in progress on RackHD, such
+// as a running graph or an uploaded file, if the cpi is interrupted before the
+// returned function is called to unregister it.
+func OnInterrupt(description string, cleanup func() error) func() {
+	cleanupsMutex.Lock()
+	defer cleanupsMutex.Unlock()
+
+	id := nextCleanupID
+	nextCleanupID++
+	cleanups[id] = interruptCleanup{description: description, run: cleanup}
+
+	return func() {
+		cleanupsMutex.Lock()
+		defer cleanupsMutex.Unlock()
+
+		delete(cleanups, id)
+	}
+}
+
+// Interrupt runs the registered cleanups, the most recently registered first,
+// and returns the errors of those that failed
+func Interrupt() error {
+	cleanupsMutex.Lock()
+	pending := make([]interruptCleanup, 0, len(cleanups))
+	for id := nextCleanupID - 1; id >= 0; id-- {
+		if cleanup, registered := cleanups[id]; registered {
+			pending = append(pending, cleanup)
+			delete(cleanups, id)
+		}
+	}
+	cleanupsMutex.Unlock()
+
+	var failures []string
+	for _, cleanup := range pending {
+		log.Info(fmt.Sprintf("interrupted, cleaning up: %s", cleanup.description))
+		err := cleanup.run()
+		if err != nil {
+			log.Error(fmt.Sprintf("error cleaning up: %s: %s", cleanup.description, err))
+			failures = append(failures, fmt.Sprintf("%s: %s", cleanup.description, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("error cleaning up after interruption: %s", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
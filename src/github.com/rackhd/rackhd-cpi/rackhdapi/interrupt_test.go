@@ -0,0 +1,94 @@
+package rackhdapi_test
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Interrupt", func() {
+	It("runs the registered cleanups, the most recently registered first", func() {
+		var ran []string
+		defer rackhdapi.OnInterrupt("first", func() error {
+			ran = append(ran, "first")
+			return nil
+		})()
+		defer rackhdapi.OnInterrupt("second", func() error {
+			ran = append(ran, "second")
+			return nil
+		})()
+
+		Expect(rackhdapi.Interrupt()).To(Succeed())
+		Expect(ran).To(Equal([]string{"second", "first"}))
+
+		Expect(rackhdapi.Interrupt()).To(Succeed())
+		Expect(ran).To(HaveLen(2))
+	})
+
+	It("does not run cleanups that were unregistered", func() {
+		ran := false
+		rackhdapi.OnInterrupt("finished", func() error {
+			ran = true
+			return nil
+		})()
+
+		Expect(rackhdapi.Interrupt()).To(Succeed())
+		Expect(ran).To(BeFalse())
+	})
+
+	It("runs every cleanup and returns the errors of those that failed", func() {
+		defer rackhdapi.OnInterrupt("release node", func() error { return errors.New("node not found") })()
+		defer rackhdapi.OnInterrupt("delete file", func() error { return nil })()
+		defer rackhdapi.OnInterrupt("cancel workflow", func() error { return errors.New("connection refused") })()
+
+		err := rackhdapi.Interrupt()
+		Expect(err).To(MatchError("error cleaning up after interruption: cancel workflow: connection refused; release node: node not found"))
+	})
+
+	Context("while a workflow is running", func() {
+		var server *ghttp.Server
+		var cpiConfig config.Cpi
+
+		BeforeEach(func() {
+			server, _, cpiConfig, _ = helpers.SetUp("")
+			rackhdapi.WorkflowPollInterval = 10 * time.Millisecond
+		})
+
+		AfterEach(func() {
+			server.Close()
+			rackhdapi.WorkflowPollInterval = 3 * time.Second
+		})
+
+		It("cancels the active workflow on the node", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("DELETE", "/api/1.1/nodes/nodeID/workflows/active"),
+					ghttp.RespondWith(http.StatusNoContent, nil),
+				),
+			)
+
+			poster := func(config.Cpi, string, rackhdapi.RunWorkflowRequestBody) (rackhdapi.WorkflowResponse, error) {
+				go rackhdapi.Interrupt()
+				return rackhdapi.WorkflowResponse{ID: "graph-id", Status: "running"}, nil
+			}
+			fetcher := func(config.Cpi, string) (rackhdapi.WorkflowResponse, error) {
+				if len(server.ReceivedRequests()) == 0 {
+					return rackhdapi.WorkflowResponse{ID: "graph-id", Status: "running"}, nil
+				}
+				return rackhdapi.WorkflowResponse{ID: "graph-id", Status: "cancelled"}, nil
+			}
+
+			err := rackhdapi.RunWorkflow(poster, fetcher, cpiConfig, "nodeID", rackhdapi.RunWorkflowRequestBody{Name: "Graph.BOSH.ReserveNode"})
+			Expect(err).To(MatchError("workflow: Graph.BOSH.ReserveNode was cancelled against node: nodeID"))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+})
@@ -7,6 +7,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 
 	"github.com/rackhd/rackhd-cpi/config"
 )
@@ -30,6 +35,18 @@ const (
 	PersistentDiskLocation = "sdb"
 )
 
+const (
+	EnclosedByRelation = "enclosedBy"
+)
+
+const (
+	NodeClaimConflict = "node claim conflict"
+)
+
+// ClaimSettleTime is how long ClaimNode waits before re-reading a node. A
+// competing claim that lands within it is detected; one that lands later is not.
+var ClaimSettleTime = 100 * time.Millisecond
+
 type NodeCatalog struct {
 	Data CatalogData `json:"data"`
 }
@@ -41,6 +58,33 @@ type Device struct {
 type CatalogData struct {
 	NetworkData  NetworkCatalog    `json:"network"`
 	BlockDevices map[string]Device `json:"block_device"`
+	CPU          CPUCatalog        `json:"cpu"`
+	Memory       MemoryCatalog     `json:"memory"`
+}
+
+type CPUCatalog struct {
+	Total     int     `json:"total"`
+	Real      int     `json:"real"`
+	Cores     int     `json:"cores"`
+	Processor CPUInfo `json:"0"`
+}
+
+type CPUInfo struct {
+	ModelName string `json:"model_name"`
+}
+
+type MemoryCatalog struct {
+	Total string `json:"total"`
+}
+
+type LSHWCatalog struct {
+	Data LSHWDevice `json:"data"`
+}
+
+type LSHWDevice struct {
+	Class    string       `json:"class"`
+	Capacity int64        `json:"capacity"`
+	Children []LSHWDevice `json:"children"`
 }
 
 type NetworkCatalog struct {
@@ -48,6 +92,7 @@ type NetworkCatalog struct {
 }
 
 type Network struct {
+	Type          string                    `json:"type"`
 	Encapsulation string                    `json:"encapsulation"`
 	Number        string                    `json:"number"`
 	Addresses     map[string]NetworkAddress `json:"addresses"`
@@ -68,10 +113,37 @@ type PersistentDiskSettingsContainer struct {
 }
 
 type PersistentDiskSettings struct {
-	PregeneratedDiskCID string `json:"pregenerated_disk_cid"`
-	DiskCID             string `json:"disk_cid"`
-	Location            string `json:"location"`
-	IsAttached          bool   `json:"attached"`
+	PregeneratedDiskCID string   `json:"pregenerated_disk_cid"`
+	DiskCID             string   `json:"disk_cid"`
+	Location            string   `json:"location"`
+	IsAttached          bool     `json:"attached"`
+	Snapshots           []string `json:"snapshots,omitempty"`
+}
+
+type NodeClaim struct {
+	RequestID string `json:"request_id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func (claim NodeClaim) Expired(now time.Time) bool {
+	return now.Unix() >= claim.ExpiresAt
+}
+
+type NodeClaimContainer struct {
+	Claim *NodeClaim `json:"cpi_claim"`
+}
+
+type NodeLease struct {
+	RequestID  string `json:"request_id"`
+	ReservedAt int64  `json:"reserved_at"`
+}
+
+func (lease NodeLease) Expired(ttl time.Duration, now time.Time) bool {
+	return now.Sub(time.Unix(lease.ReservedAt, 0)) > ttl
+}
+
+type NodeLeaseContainer struct {
+	Lease *NodeLease `json:"cpi_lease"`
 }
 
 type Node struct {
@@ -80,17 +152,116 @@ type Node struct {
 	ID             string                 `json:"id"`
 	CID            string                 `json:"cid"`
 	OBMSettings    []OBMSetting           `json:"obmSettings"`
+	OBMs           []OBMSetting           `json:"obms,omitempty"`
+	SKU            string                 `json:"sku,omitempty"`
+	Tags           []string               `json:"tags,omitempty"`
+	Metadata       map[string]interface{} `json:"metadata,omitempty"`
+	Relations      []NodeRelation         `json:"relations,omitempty"`
 	PersistentDisk PersistentDiskSettings `json:"persistent_disk"`
+	Claim          *NodeClaim             `json:"cpi_claim,omitempty"`
+	Lease          *NodeLease             `json:"cpi_lease,omitempty"`
+}
+
+type NodeRelation struct {
+	RelationType string   `json:"relationType"`
+	Targets      []string `json:"targets"`
+}
+
+func (n Node) EnclosureID() string {
+	for _, relation := range n.Relations {
+		if relation.RelationType == EnclosedByRelation && len(relation.Targets) > 0 {
+			return relation.Targets[0]
+		}
+	}
+
+	return ""
+}
+
+func (n Node) IsClaimedByOther(c config.Cpi, now time.Time) bool {
+	return n.Claim != nil && n.Claim.RequestID != c.RequestID && !n.Claim.Expired(now)
+}
+
+// queryRejectedError reports that RackHD answered a filtered node listing
+// with a 400, which versions without query support do
+type queryRejectedError struct {
+	status string
+}
+
+func (e queryRejectedError) Error() string {
+	return fmt.Sprintf("Failed getting nodes with status: %s", e.status)
 }
 
 func GetNodes(c config.Cpi) ([]Node, error) {
-	nodesURL := fmt.Sprintf("%s/api/common/nodes", c.ApiServer)
-	resp, err := http.Get(nodesURL)
+	return listNodes(c, url.Values{})
+}
+
+// GetNodesWhere asks RackHD for the nodes whose fields match the filters, and
+// lists every node if RackHD rejects the query. Versions of RackHD that ignore
+// the filters also answer with every node, so callers still check each node.
+func GetNodesWhere(c config.Cpi, filters url.Values) ([]Node, error) {
+	nodes, err := listNodes(c, filters)
+	if _, rejected := err.(queryRejectedError); rejected && len(filters) > 0 {
+		log.Info(fmt.Sprintf("RackHD rejected node query %s, listing all nodes", filters.Encode()))
+		return listNodes(c, url.Values{})
+	}
+
+	return nodes, err
+}
+
+// listNodes fetches the nodes matching the query, node_page_size nodes at a
+// time when paging is configured. Paging stops at the first short page, or at
+// a page with no new nodes from a server that ignores the paging parameters.
+func listNodes(c config.Cpi, query url.Values) ([]Node, error) {
+	if c.NodePageSize == 0 {
+		return getNodePage(c, query)
+	}
+
+	nodes := []Node{}
+	seen := map[string]bool{}
+	for skip := 0; ; skip += c.NodePageSize {
+		pageQuery := url.Values{}
+		for key, values := range query {
+			pageQuery[key] = values
+		}
+		pageQuery.Set("$skip", strconv.Itoa(skip))
+		pageQuery.Set("$top", strconv.Itoa(c.NodePageSize))
+
+		page, err := getNodePage(c, pageQuery)
+		if err != nil {
+			return []Node{}, err
+		}
+
+		added := 0
+		for _, node := range page {
+			if !seen[node.ID] {
+				seen[node.ID] = true
+				nodes = append(nodes, node)
+				added++
+			}
+		}
+
+		if len(page) < c.NodePageSize || added == 0 {
+			return nodes, nil
+		}
+	}
+}
+
+func getNodePage(c config.Cpi, query url.Values) ([]Node, error) {
+	nodesURL := endpointsFor(c).nodes()
+	if len(query) > 0 {
+		nodesURL = fmt.Sprintf("%s?%s", nodesURL, query.Encode())
+	}
+
+	resp, err := clientFor(c).Get(nodesURL)
 	if err != nil {
 		return []Node{}, fmt.Errorf("error fetching nodes %s", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == 400 && len(query) > 0 {
+		return []Node{}, queryRejectedError{status: resp.Status}
+	}
+
 	if resp.StatusCode != 200 {
 		return []Node{}, fmt.Errorf("Failed getting nodes with status: %s, err: %s", resp.Status, err)
 	}
@@ -100,8 +271,7 @@ func GetNodes(c config.Cpi) ([]Node, error) {
 		return []Node{}, fmt.Errorf("error reading node response body %s", err)
 	}
 
-	var nodes []Node
-	err = json.Unmarshal(nodeBytes, &nodes)
+	nodes, err := endpointsFor(c).decodeNodes(nodeBytes)
 	if err != nil {
 		return []Node{}, fmt.Errorf("error unmarshalling /common/nodes response %s", err)
 	}
@@ -109,8 +279,18 @@ func GetNodes(c config.Cpi) ([]Node, error) {
 	return nodes, nil
 }
 
+// NotFoundError reports that no node carries a vm, disk or snapshot cid
+type NotFoundError struct {
+	Kind string
+	CID  string
+}
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("%s with cid: %s was not found", e.Kind, e.CID)
+}
+
 func GetNodeByVMCID(c config.Cpi, cid string) (Node, error) {
-	nodes, err := GetNodes(c)
+	nodes, err := GetNodesWhere(c, url.Values{"cid": {cid}})
 	if err != nil {
 		return Node{}, err
 	}
@@ -121,12 +301,44 @@ func GetNodeByVMCID(c config.Cpi, cid string) (Node, error) {
 		}
 	}
 
-	return Node{}, fmt.Errorf("vm with cid: %s was not found", cid)
+	return Node{}, NotFoundError{Kind: "vm", CID: cid}
+}
+
+func GetNodeByDiskCID(c config.Cpi, diskCID string) (Node, error) {
+	nodes, err := GetNodesWhere(c, url.Values{"persistent_disk.disk_cid": {diskCID}})
+	if err != nil {
+		return Node{}, err
+	}
+
+	for _, node := range nodes {
+		if node.PersistentDisk.DiskCID == diskCID {
+			return node, nil
+		}
+	}
+
+	return Node{}, NotFoundError{Kind: "disk", CID: diskCID}
+}
+
+func GetNodeBySnapshotCID(c config.Cpi, snapshotCID string) (Node, error) {
+	nodes, err := GetNodesWhere(c, url.Values{"persistent_disk.snapshots": {snapshotCID}})
+	if err != nil {
+		return Node{}, err
+	}
+
+	for _, node := range nodes {
+		for _, snapshot := range node.PersistentDisk.Snapshots {
+			if snapshot == snapshotCID {
+				return node, nil
+			}
+		}
+	}
+
+	return Node{}, NotFoundError{Kind: "snapshot", CID: snapshotCID}
 }
 
 func GetNode(c config.Cpi, nodeID string) (Node, error) {
-	nodeURL := fmt.Sprintf("%s/api/common/nodes/%s", c.ApiServer, nodeID)
-	resp, err := http.Get(nodeURL)
+	nodeURL := endpointsFor(c).node(nodeID)
+	resp, err := clientFor(c).Get(nodeURL)
 	if err != nil {
 		return Node{}, fmt.Errorf("error fetching node %s: %s", nodeID, err)
 	}
@@ -141,8 +353,7 @@ func GetNode(c config.Cpi, nodeID string) (Node, error) {
 		return Node{}, fmt.Errorf("error reading node %s response body %s", nodeID, err)
 	}
 
-	var node Node
-	err = json.Unmarshal(nodeBytes, &node)
+	node, err := endpointsFor(c).decodeNode(nodeBytes)
 	if err != nil {
 		return Node{}, fmt.Errorf("error unmarshalling /common/node/%s response %s", nodeID, err)
 	}
@@ -151,8 +362,8 @@ func GetNode(c config.Cpi, nodeID string) (Node, error) {
 }
 
 func GetOBMSettings(c config.Cpi, nodeID string) ([]OBMSetting, error) {
-	nodeURL := fmt.Sprintf("%s/api/common/nodes/%s", c.ApiServer, nodeID)
-	resp, err := http.Get(nodeURL)
+	nodeURL := endpointsFor(c).node(nodeID)
+	resp, err := clientFor(c).Get(nodeURL)
 	if err != nil {
 		return nil, fmt.Errorf("error getting node %s", err)
 	}
@@ -167,17 +378,17 @@ func GetOBMSettings(c config.Cpi, nodeID string) ([]OBMSetting, error) {
 		return nil, fmt.Errorf("error reading node body %s", err)
 	}
 
-	var node Node
-	err = json.Unmarshal(b, &node)
+	node, err := endpointsFor(c).decodeNode(b)
 	if err != nil {
 		return nil, fmt.Errorf("error unmarshal node body %s", err)
 	}
 
-	if len(node.OBMSettings) == 0 {
+	obmSettings := endpointsFor(c).obmSettings(node)
+	if len(obmSettings) == 0 {
 		return nil, errors.New("error: got empty obm settings")
 	}
 
-	return node.OBMSettings, nil
+	return obmSettings, nil
 }
 
 func GetOBMServiceName(c config.Cpi, nodeID string) (string, error) {
@@ -194,9 +405,119 @@ func ReleaseNode(c config.Cpi, nodeID string) error {
 	return PatchNode(c, nodeID, blockFlag)
 }
 
+func ReserveNode(c config.Cpi, nodeID string) error {
+	reserveFlag := []byte(fmt.Sprintf("{\"status\": \"%s\"}", Reserved))
+	return PatchNode(c, nodeID, reserveFlag)
+}
+
+// ClaimNode marks the node as claimed by this request, and reads it back after
+// ClaimSettleTime so that a competing claim is detected early. RackHD has no
+// conditional update, so the claim alone does not keep two requests from
+// taking the node: the reserve workflow checks it again while RackHD runs no
+// other workflow on the node, and only reserves the node for its holder.
+func ClaimNode(c config.Cpi, nodeID string) error {
+	node, err := GetNode(c, nodeID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if node.IsClaimedByOther(c, now) {
+		return fmt.Errorf("%s: node %s is claimed by request %s", NodeClaimConflict, nodeID, node.Claim.RequestID)
+	}
+
+	container := NodeClaimContainer{
+		Claim: &NodeClaim{
+			RequestID: c.RequestID,
+			ExpiresAt: now.Add(c.ClaimTimeoutSeconds * time.Second).Unix(),
+		},
+	}
+	bodyBytes, err := json.Marshal(container)
+	if err != nil {
+		return fmt.Errorf("error marshalling claim for node %s: %s", nodeID, err)
+	}
+
+	err = PatchNode(c, nodeID, bodyBytes)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(ClaimSettleTime)
+
+	node, err = GetNode(c, nodeID)
+	if err != nil {
+		return err
+	}
+
+	if node.Claim == nil {
+		return fmt.Errorf("%s: claim on node %s was removed", NodeClaimConflict, nodeID)
+	}
+
+	if node.Claim.RequestID != c.RequestID {
+		return fmt.Errorf("%s: node %s was claimed by request %s", NodeClaimConflict, nodeID, node.Claim.RequestID)
+	}
+
+	return nil
+}
+
+func UnclaimNode(c config.Cpi, nodeID string) error {
+	bodyBytes, err := json.Marshal(NodeClaimContainer{})
+	if err != nil {
+		return fmt.Errorf("error marshalling claim for node %s: %s", nodeID, err)
+	}
+
+	return PatchNode(c, nodeID, bodyBytes)
+}
+
+func LeaseNode(c config.Cpi, nodeID string) error {
+	container := NodeLeaseContainer{
+		Lease: &NodeLease{
+			RequestID:  c.RequestID,
+			ReservedAt: time.Now().Unix(),
+		},
+	}
+	bodyBytes, err := json.Marshal(container)
+	if err != nil {
+		return fmt.Errorf("error marshalling lease for node %s: %s", nodeID, err)
+	}
+
+	return PatchNode(c, nodeID, bodyBytes)
+}
+
+func ReleaseLeasedNode(c config.Cpi, nodeID string) error {
+	releaseFlag := []byte(fmt.Sprintf("{\"status\": \"%s\", \"cpi_lease\": null, \"cpi_claim\": null}", Available))
+	return PatchNode(c, nodeID, releaseFlag)
+}
+
+// ReleaseClaimedNode releases the node if this request still holds its claim
+// and it is not reserved. Otherwise another request won the node, which is
+// returned as a claim conflict and the node is left alone.
+func ReleaseClaimedNode(c config.Cpi, nodeID string) error {
+	node, err := GetNode(c, nodeID)
+	if err != nil {
+		return err
+	}
+
+	if node.Claim == nil || node.Claim.RequestID != c.RequestID {
+		return fmt.Errorf("%s: node %s is no longer claimed by request %s", NodeClaimConflict, nodeID, c.RequestID)
+	}
+
+	if node.Status == Reserved {
+		return fmt.Errorf("%s: node %s is already reserved", NodeClaimConflict, nodeID)
+	}
+
+	return ReleaseLeasedNode(c, nodeID)
+}
+
+// EndReservation removes the claim and lease from a node once its vm has been
+// created or deleted, so that other requests can claim it again
+func EndReservation(c config.Cpi, nodeID string) error {
+	return PatchNode(c, nodeID, []byte(`{"cpi_claim": null, "cpi_lease": null}`))
+}
+
 func GetNodeCatalog(c config.Cpi, nodeID string) (NodeCatalog, error) {
-	catalogURL := fmt.Sprintf("%s/api/common/nodes/%s/catalogs/ohai", c.ApiServer, nodeID)
-	resp, err := http.Get(catalogURL)
+	catalogURL := endpointsFor(c).nodeCatalog(nodeID, "ohai")
+	resp, err := clientFor(c).Get(catalogURL)
 	if err != nil {
 		return NodeCatalog{}, fmt.Errorf("error getting catalog %s", err)
 	}
@@ -220,6 +541,32 @@ func GetNodeCatalog(c config.Cpi, nodeID string) (NodeCatalog, error) {
 	return nodeCatalog, nil
 }
 
+func GetNodeLSHWCatalog(c config.Cpi, nodeID string) (LSHWCatalog, error) {
+	catalogURL := endpointsFor(c).nodeCatalog(nodeID, "lshw")
+	resp, err := clientFor(c).Get(catalogURL)
+	if err != nil {
+		return LSHWCatalog{}, fmt.Errorf("error getting lshw catalog %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return LSHWCatalog{}, fmt.Errorf("Failed getting node lshw catalog with status: %s", resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return LSHWCatalog{}, fmt.Errorf("error reading lshw catalog body %s", err)
+	}
+
+	var lshwCatalog LSHWCatalog
+	err = json.Unmarshal(b, &lshwCatalog)
+	if err != nil {
+		return LSHWCatalog{}, fmt.Errorf("error unmarshal lshw catalog body %s", err)
+	}
+
+	return lshwCatalog, nil
+}
+
 func BlockNode(c config.Cpi, nodeID string) error {
 	blockFlag := []byte(fmt.Sprintf("{\"status\": \"%s\", \"status_reason\": \"%s\"}", Blocked, DiskReason))
 	return PatchNode(c, nodeID, blockFlag)
@@ -231,7 +578,7 @@ func SetNodeMetadata(c config.Cpi, nodeID string, metadata string) error {
 }
 
 func PatchNode(c config.Cpi, nodeID string, body []byte) error {
-	url := fmt.Sprintf("%s/api/common/nodes/%s", c.ApiServer, nodeID)
+	url := endpointsFor(c).node(nodeID)
 
 	request, err := http.NewRequest("PATCH", url, bytes.NewReader(body))
 	if err != nil {
@@ -241,10 +588,11 @@ func PatchNode(c config.Cpi, nodeID string, body []byte) error {
 	request.Header.Set("Content-Type", "application/json")
 	request.ContentLength = int64(len(body))
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := clientFor(c).Do(request)
 	if err != nil {
 		return fmt.Errorf("Error making request to api server: %s", err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("Failed patching URL: %s with status: %s", url, resp.Status)
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/rackhd/rackhd-cpi/config"
 	"github.com/rackhd/rackhd-cpi/helpers"
@@ -94,6 +95,157 @@ var _ = Describe("Nodes", func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(node).To(Equal(expectedNodes[0]))
 		})
+
+		It("asks RackHD for the nodes with the cid", func() {
+			expectedNodes := helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json")
+			expectedNodesData, err := json.Marshal(expectedNodes[:1])
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes", "cid=vm-5678"),
+					ghttp.RespondWith(http.StatusOK, expectedNodesData),
+				),
+			)
+
+			node, err := rackhdapi.GetNodeByVMCID(cpiConfig, "vm-5678")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(node).To(Equal(expectedNodes[0]))
+		})
+
+		It("lists all nodes if RackHD rejects the query", func() {
+			expectedNodes := helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json")
+			expectedNodesData, err := json.Marshal(expectedNodes)
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes", "cid=vm-5678"),
+					ghttp.RespondWith(http.StatusBadRequest, nil),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes", ""),
+					ghttp.RespondWith(http.StatusOK, expectedNodesData),
+				),
+			)
+
+			node, err := rackhdapi.GetNodeByVMCID(cpiConfig, "vm-5678")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(node).To(Equal(expectedNodes[0]))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("returns a not found error if no node has the cid", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes", "cid=vm-missing"),
+					ghttp.RespondWith(http.StatusOK, []byte("[]")),
+				),
+			)
+
+			_, err := rackhdapi.GetNodeByVMCID(cpiConfig, "vm-missing")
+			Expect(err).To(Equal(rackhdapi.NotFoundError{Kind: "vm", CID: "vm-missing"}))
+		})
+	})
+
+	Describe("Getting nodes a page at a time", func() {
+		BeforeEach(func() {
+			cpiConfig.NodePageSize = 2
+		})
+
+		It("fetches pages until a short page", func() {
+			expectedNodes := helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json")
+			Expect(len(expectedNodes)).To(BeNumerically(">", 2))
+			firstPage, err := json.Marshal(expectedNodes[:2])
+			Expect(err).ToNot(HaveOccurred())
+			secondPage, err := json.Marshal(expectedNodes[2:3])
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes", "%24skip=0&%24top=2"),
+					ghttp.RespondWith(http.StatusOK, firstPage),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes", "%24skip=2&%24top=2"),
+					ghttp.RespondWith(http.StatusOK, secondPage),
+				),
+			)
+
+			nodes, err := rackhdapi.GetNodes(cpiConfig)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nodes).To(Equal(expectedNodes[:3]))
+		})
+
+		It("stops when the server ignores paging", func() {
+			expectedNodes := helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json")
+			page, err := json.Marshal(expectedNodes[:2])
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, page),
+				ghttp.RespondWith(http.StatusOK, page),
+			)
+
+			nodes, err := rackhdapi.GetNodes(cpiConfig)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nodes).To(Equal(expectedNodes[:2]))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+	})
+
+	Describe("Getting a single node by disk CID", func() {
+		It("returns the node holding the disk", func() {
+			expectedNodes := helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json")
+			expectedNodesData, err := json.Marshal(expectedNodes)
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, expectedNodesData),
+				),
+			)
+
+			node, err := rackhdapi.GetNodeByDiskCID(cpiConfig, "5665a65a0561790005b77b85-requestid")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(node).To(Equal(expectedNodes[0]))
+		})
+	})
+
+	Describe("Getting a single node by snapshot CID", func() {
+		It("returns the node holding the snapshot", func() {
+			expectedNodes := helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json")
+			expectedNodes[1].PersistentDisk.Snapshots = []string{"55e79eb14e66816f6152fffb-snapshot-requestid"}
+			expectedNodesData, err := json.Marshal(expectedNodes)
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, expectedNodesData),
+				),
+			)
+
+			node, err := rackhdapi.GetNodeBySnapshotCID(cpiConfig, "55e79eb14e66816f6152fffb-snapshot-requestid")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(node).To(Equal(expectedNodes[1]))
+		})
+
+		It("returns an error if no node holds the snapshot", func() {
+			expectedNodes := helpers.LoadNodes("../spec_assets/dummy_all_nodes_are_vms.json")
+			expectedNodesData, err := json.Marshal(expectedNodes)
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/common/nodes"),
+					ghttp.RespondWith(http.StatusOK, expectedNodesData),
+				),
+			)
+
+			_, err = rackhdapi.GetNodeBySnapshotCID(cpiConfig, "missing-snapshot")
+			Expect(err).To(MatchError("snapshot with cid: missing-snapshot was not found"))
+		})
 	})
 
 	Describe("Getting a single node by nodeID", func() {
@@ -136,6 +288,195 @@ var _ = Describe("Nodes", func() {
 		})
 	})
 
+	Describe("Claiming a node", func() {
+		var node rackhdapi.Node
+
+		BeforeEach(func() {
+			rackhdapi.ClaimSettleTime = 0
+			cpiConfig.RequestID = "my-request"
+			node = helpers.LoadNode("../spec_assets/dummy_create_vm_with_disk_response.json")
+		})
+
+		claimedBy := func(requestID string, expiresAt time.Time) []byte {
+			claimedNode := node
+			claimedNode.Claim = &rackhdapi.NodeClaim{RequestID: requestID, ExpiresAt: expiresAt.Unix()}
+			claimedNodeData, err := json.Marshal(claimedNode)
+			Expect(err).ToNot(HaveOccurred())
+			return claimedNodeData
+		}
+
+		It("claims the node for this request", func() {
+			nodeData, err := json.Marshal(node)
+			Expect(err).ToNot(HaveOccurred())
+
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.RespondWith(http.StatusOK, nodeData),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					func(w http.ResponseWriter, req *http.Request) {
+						var container rackhdapi.NodeClaimContainer
+						err := json.NewDecoder(req.Body).Decode(&container)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(container.Claim.RequestID).To(Equal("my-request"))
+						Expect(container.Claim.ExpiresAt).To(BeNumerically(">", time.Now().Unix()))
+					},
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.RespondWith(http.StatusOK, claimedBy("my-request", time.Now().Add(time.Hour))),
+				),
+			)
+
+			err = rackhdapi.ClaimNode(cpiConfig, node.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(3))
+		})
+
+		It("returns a conflict if another request holds an unexpired claim", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.RespondWith(http.StatusOK, claimedBy("other-request", time.Now().Add(time.Hour))),
+				),
+			)
+
+			err := rackhdapi.ClaimNode(cpiConfig, node.ID)
+			Expect(err).To(MatchError(fmt.Sprintf("node claim conflict: node %s is claimed by request other-request", node.ID)))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("takes over an expired claim", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.RespondWith(http.StatusOK, claimedBy("other-request", time.Now().Add(-time.Minute))),
+				),
+				ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.RespondWith(http.StatusOK, claimedBy("my-request", time.Now().Add(time.Hour))),
+				),
+			)
+
+			err := rackhdapi.ClaimNode(cpiConfig, node.ID)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns a conflict if another request wins the race", func() {
+			nodeData, err := json.Marshal(node)
+			Expect(err).ToNot(HaveOccurred())
+
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.RespondWith(http.StatusOK, nodeData),
+				),
+				ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.RespondWith(http.StatusOK, claimedBy("other-request", time.Now().Add(time.Hour))),
+				),
+			)
+
+			err = rackhdapi.ClaimNode(cpiConfig, node.ID)
+			Expect(err).To(MatchError(fmt.Sprintf("node claim conflict: node %s was claimed by request other-request", node.ID)))
+		})
+
+		It("clears the claim when unclaiming", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.VerifyJSON(`{"cpi_claim": null}`),
+				),
+			)
+
+			err := rackhdapi.UnclaimNode(cpiConfig, node.ID)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("releases a node it still holds the claim on", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.RespondWith(http.StatusOK, claimedBy("my-request", time.Now().Add(time.Hour))),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.VerifyJSON(`{"status": "available", "cpi_claim": null, "cpi_lease": null}`),
+				),
+			)
+
+			err := rackhdapi.ReleaseClaimedNode(cpiConfig, node.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("leaves a node claimed by another request alone", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.RespondWith(http.StatusOK, claimedBy("other-request", time.Now().Add(time.Hour))),
+				),
+			)
+
+			err := rackhdapi.ReleaseClaimedNode(cpiConfig, node.ID)
+			Expect(err).To(MatchError(fmt.Sprintf("node claim conflict: node %s is no longer claimed by request my-request", node.ID)))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("leaves a node that is already reserved alone", func() {
+			node.Status = rackhdapi.Reserved
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.RespondWith(http.StatusOK, claimedBy("my-request", time.Now().Add(time.Hour))),
+				),
+			)
+
+			err := rackhdapi.ReleaseClaimedNode(cpiConfig, node.ID)
+			Expect(err).To(MatchError(fmt.Sprintf("node claim conflict: node %s is already reserved", node.ID)))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("clears the claim and lease when ending the reservation", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", node.ID)),
+					ghttp.VerifyJSON(`{"cpi_claim": null, "cpi_lease": null}`),
+				),
+			)
+
+			err := rackhdapi.EndReservation(cpiConfig, node.ID)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("Leasing a node", func() {
+		It("records the reserving request and time", func() {
+			cpiConfig.RequestID = "my-request"
+			nodeID := "5665a65a0561790005b77b85"
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PATCH", fmt.Sprintf("/api/common/nodes/%s", nodeID)),
+					func(w http.ResponseWriter, req *http.Request) {
+						var container rackhdapi.NodeLeaseContainer
+						err := json.NewDecoder(req.Body).Decode(&container)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(container.Lease.RequestID).To(Equal("my-request"))
+						Expect(container.Lease.ReservedAt).To(BeNumerically("~", time.Now().Unix(), 5))
+					},
+				),
+			)
+
+			err := rackhdapi.LeaseNode(cpiConfig, nodeID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
 	Describe("Getting catalog", func() {
 		It("returns a catalog", func() {
 			expectedNodeCatalog := helpers.LoadNodeCatalog("../spec_assets/dummy_node_catalog_response.json")
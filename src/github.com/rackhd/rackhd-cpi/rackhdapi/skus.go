@@ -0,0 +1,55 @@
+package rackhdapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/rackhd/rackhd-cpi/config"
+)
+
+type SKU struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func GetSKUs(c config.Cpi) ([]SKU, error) {
+	skusURL := endpointsFor(c).skus()
+	resp, err := clientFor(c).Get(skusURL)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching skus %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed getting skus with status: %s", resp.Status)
+	}
+
+	skuBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sku response body %s", err)
+	}
+
+	var skus []SKU
+	err = json.Unmarshal(skuBytes, &skus)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling /common/skus response %s", err)
+	}
+
+	return skus, nil
+}
+
+func GetSKU(c config.Cpi, nameOrID string) (SKU, error) {
+	skus, err := GetSKUs(c)
+	if err != nil {
+		return SKU{}, err
+	}
+
+	for _, sku := range skus {
+		if sku.ID == nameOrID || sku.Name == nameOrID {
+			return sku, nil
+		}
+	}
+
+	return SKU{}, fmt.Errorf("sku: %s was not found", nameOrID)
+}
@@ -0,0 +1,49 @@
+package rackhdapi_test
+
+import (
+	"net/http"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("SKUs", func() {
+	var server *ghttp.Server
+	var cpiConfig config.Cpi
+
+	BeforeEach(func() {
+		server, _, cpiConfig, _ = helpers.SetUp("")
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/common/skus"),
+				ghttp.RespondWith(http.StatusOK, helpers.LoadJSON("../spec_assets/dummy_skus_response.json")),
+			),
+		)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("finds a sku by name", func() {
+		sku, err := rackhdapi.GetSKU(cpiConfig, "storage")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sku).To(Equal(rackhdapi.SKU{ID: "5666e4b2a3a8be2c53a2c6b1", Name: "storage"}))
+	})
+
+	It("finds a sku by id", func() {
+		sku, err := rackhdapi.GetSKU(cpiConfig, "5666e4b2a3a8be2c53a2c6b2")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sku.Name).To(Equal("compute"))
+	})
+
+	It("returns an error if no sku matches", func() {
+		_, err := rackhdapi.GetSKU(cpiConfig, "gpu")
+		Expect(err).To(MatchError("sku: gpu was not found"))
+	})
+})
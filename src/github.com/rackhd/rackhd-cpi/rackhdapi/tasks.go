@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -33,25 +34,78 @@ type WorkflowTask struct {
 }
 
 type TaskResponse struct {
-	Name  string `json:"name"`
-	State string `json:"state"`
+	Name  string     `json:"name"`
+	Label string     `json:"label,omitempty"`
+	State string     `json:"state"`
+	Error *TaskError `json:"error,omitempty"`
+}
+
+// TaskError is the error RackHD records on a task that did not succeed.
+// Tasks running commands on the node also record the failed command and its
+// output.
+type TaskError struct {
+	Name     string `json:"name,omitempty"`
+	Message  string `json:"message,omitempty"`
+	Command  string `json:"cmd,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+}
+
+// UnmarshalJSON also accepts errors that were recorded as a plain message
+func (e *TaskError) UnmarshalJSON(data []byte) error {
+	var message string
+	if json.Unmarshal(data, &message) == nil {
+		*e = TaskError{Message: message}
+		return nil
+	}
+
+	type taskError TaskError
+	return json.Unmarshal(data, (*taskError)(e))
+}
+
+// Details describes the failure of the task for errors and logs
+func (t TaskResponse) Details() string {
+	name := t.Name
+	if t.Label != "" {
+		name = fmt.Sprintf("%s (%s)", t.Label, t.Name)
+	}
+
+	details := fmt.Sprintf("task: %s %s", name, t.State)
+	if t.Error == nil || (t.Error.Message == "" && t.Error.Command == "" && t.Error.Stderr == "") {
+		return details + " with no error recorded"
+	}
+
+	if t.Error.Message != "" {
+		details += fmt.Sprintf(": %s", t.Error.Message)
+	}
+	if t.Error.Command != "" {
+		details += fmt.Sprintf(", command: %s", t.Error.Command)
+	}
+	if t.Error.ExitCode != nil {
+		details += fmt.Sprintf(", exit code: %d", *t.Error.ExitCode)
+	}
+	if stderr := strings.TrimSpace(t.Error.Stderr); stderr != "" {
+		details += fmt.Sprintf(", stderr: %s", stderr)
+	}
+
+	return details
 }
 
 func PublishTask(c config.Cpi, taskBytes []byte) error {
-	url := fmt.Sprintf("%s/api/1.1/workflows/tasks", c.ApiServer)
+	url := endpointsFor(c).tasks()
 	request, err := http.NewRequest("PUT", url, bytes.NewReader(taskBytes))
 	if err != nil {
 		return errors.New("error building publish task request")
 	}
 	request.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := clientFor(c).Do(request)
 	if err != nil {
 		return fmt.Errorf("error sending PUT request to %s", c.ApiServer)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	if resp.StatusCode != endpointsFor(c).publishedStatus() {
 		return fmt.Errorf("error publishing task; response status code: %s,\nresponse body: %+v", resp.Status, resp)
 	}
 
@@ -93,8 +147,8 @@ func PublishTask(c config.Cpi, taskBytes []byte) error {
 }
 
 func RetrieveTasks(c config.Cpi) ([]byte, error) {
-	url := fmt.Sprintf("%s/api/1.1/workflows/tasks/library", c.ApiServer)
-	resp, err := http.Get(url)
+	url := endpointsFor(c).taskLibrary()
+	resp, err := clientFor(c).Get(url)
 	if err != nil {
 		return nil, fmt.Errorf("Error: %s", err)
 	}
@@ -111,3 +165,8 @@ func RetrieveTasks(c config.Cpi) ([]byte, error) {
 
 	return body, nil
 }
+
+// DeleteTask removes a task from the library of a 2.0 API
+func DeleteTask(c config.Cpi, injectableName string) error {
+	return deleteLibraryEntry(c, "task", endpointsFor(c).taskDefinition(injectableName))
+}
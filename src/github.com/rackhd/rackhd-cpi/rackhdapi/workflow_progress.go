@@ -0,0 +1,135 @@
+package rackhdapi
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const taskPendingState = "pending"
+
+// ResponseLog is where the summary of a workflow is written when the log level
+// would drop it, so that it still reaches the log of the cpi response
+var ResponseLog io.Writer = ioutil.Discard
+
+// workflowProgress logs the transitions of the tasks of a workflow as they are
+// observed while polling it, and a summary of how long each task took once the
+// workflow is done. Times are those of the polls, so they are accurate to the
+// poll interval.
+type workflowProgress struct {
+	workflowName string
+	nodeID       string
+	started      time.Time
+	lastPoll     time.Time
+	status       string
+	tasks        map[string]*taskProgress
+	order        []string
+}
+
+type taskProgress struct {
+	name     string
+	state    string
+	started  time.Time
+	finished time.Time
+}
+
+func newWorkflowProgress(workflowName string, nodeID string, started time.Time) *workflowProgress {
+	return &workflowProgress{
+		workflowName: workflowName,
+		nodeID:       nodeID,
+		started:      started,
+		lastPoll:     started,
+		tasks:        map[string]*taskProgress{},
+	}
+}
+
+func (p *workflowProgress) observe(wr WorkflowResponse, now time.Time) {
+	p.status = wr.Status
+	labels := taskLabels(wr)
+
+	for id, task := range wr.Tasks {
+		tp, seen := p.tasks[id]
+		if !seen {
+			tp = &taskProgress{name: task.Name}
+			if task.Label != "" {
+				tp.name = fmt.Sprintf("%s (%s)", task.Label, task.Name)
+			} else if labels[task.Name] != "" {
+				tp.name = fmt.Sprintf("%s (%s)", labels[task.Name], task.Name)
+			}
+			p.tasks[id] = tp
+			p.order = append(p.order, id)
+		}
+
+		if seen && tp.state == task.State {
+			continue
+		}
+
+		if task.State != taskPendingState && tp.started.IsZero() {
+			tp.started = p.lastPoll
+			if seen {
+				tp.started = now
+			}
+		}
+
+		if isFinishedTaskState(task.State) && tp.finished.IsZero() {
+			tp.finished = now
+			log.Info(fmt.Sprintf("workflow: %s on node: %s task: %s %s at %s after %s",
+				p.workflowName, p.nodeID, tp.name, task.State, now.Format(time.RFC3339), roundDuration(tp.finished.Sub(tp.started))))
+		} else if seen {
+			log.Info(fmt.Sprintf("workflow: %s on node: %s task: %s went from %s to %s at %s",
+				p.workflowName, p.nodeID, tp.name, tp.state, task.State, now.Format(time.RFC3339)))
+		} else {
+			log.Info(fmt.Sprintf("workflow: %s on node: %s task: %s is %s at %s",
+				p.workflowName, p.nodeID, tp.name, task.State, now.Format(time.RFC3339)))
+		}
+		tp.state = task.State
+	}
+
+	p.lastPoll = now
+}
+
+// logSummary logs the duration of the workflow and of each of its tasks, in
+// the order they were first observed. Below the info level the summary is
+// written to ResponseLog instead.
+func (p *workflowProgress) logSummary(now time.Time) {
+	lines := []string{fmt.Sprintf("workflow: %s on node: %s ended with status: %s after %s",
+		p.workflowName, p.nodeID, p.status, roundDuration(now.Sub(p.started)))}
+
+	for _, id := range p.order {
+		tp := p.tasks[id]
+		switch {
+		case tp.started.IsZero():
+			lines = append(lines, fmt.Sprintf("  task: %s %s", tp.name, tp.state))
+		case tp.finished.IsZero():
+			lines = append(lines, fmt.Sprintf("  task: %s %s for %s", tp.name, tp.state, roundDuration(now.Sub(tp.started))))
+		default:
+			lines = append(lines, fmt.Sprintf("  task: %s %s in %s", tp.name, tp.state, roundDuration(tp.finished.Sub(tp.started))))
+		}
+	}
+
+	for _, line := range lines {
+		if log.GetLevel() >= log.InfoLevel {
+			log.Info(line)
+		} else {
+			fmt.Fprintln(ResponseLog, line)
+		}
+	}
+}
+
+func isFinishedTaskState(state string) bool {
+	switch state {
+	case workflowSuccessfulStatus, workflowFailedStatus, workflowCancelledStatus, taskTimeoutState:
+		return true
+	default:
+		return false
+	}
+}
+
+// roundDuration rounds the duration to the nearest second. Durations here are
+// never negative.
+func roundDuration(d time.Duration) time.Duration {
+	return (d + time.Second/2) / time.Second * time.Second
+}
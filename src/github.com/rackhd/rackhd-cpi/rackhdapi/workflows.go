@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -24,6 +26,7 @@ const (
 	workflowSuccessfulStatus = "succeeded"
 	workflowFailedStatus     = "failed"
 	workflowCancelledStatus  = "cancelled"
+	taskTimeoutState         = "timeout"
 )
 
 const (
@@ -59,6 +62,7 @@ type WorkflowResponse struct {
 	Status       string                  `json:"_status"`
 	ID           string                  `json:"id"`
 	PendingTasks []interface{}           `json:"pendingTasks"`
+	Definition   WorkflowStub            `json:"definition"`
 }
 
 type PropertyContainer struct {
@@ -74,12 +78,16 @@ type RunWorkflowRequestBody struct {
 	Options map[string]interface{} `json:"options"`
 }
 
+// WorkflowPollInterval is how often RunWorkflow fetches the status of the
+// workflow it is running
+var WorkflowPollInterval = 3 * time.Second
+
 type workflowFetcherFunc func(config.Cpi, string) (WorkflowResponse, error)
 
 type workflowPosterFunc func(config.Cpi, string, RunWorkflowRequestBody) (WorkflowResponse, error)
 
 func PublishWorkflow(c config.Cpi, workflowBytes []byte) error {
-	url := fmt.Sprintf("%s/api/1.1/workflows", c.ApiServer)
+	url := endpointsFor(c).graphs()
 
 	log.Debug(fmt.Sprintf("workflow to publish: %s", string(workflowBytes)))
 	request, err := http.NewRequest("PUT", url, bytes.NewReader(workflowBytes))
@@ -90,13 +98,13 @@ func PublishWorkflow(c config.Cpi, workflowBytes []byte) error {
 	}
 	request.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := clientFor(c).Do(request)
 	if err != nil {
 		return fmt.Errorf("error sending publishing workflow to %s", url)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	if resp.StatusCode != endpointsFor(c).publishedStatus() {
 		return fmt.Errorf("error publishing workflow; response status code: %s,\nresponse body: %+v", resp.Status, resp)
 	}
 
@@ -138,14 +146,14 @@ func PublishWorkflow(c config.Cpi, workflowBytes []byte) error {
 }
 
 func RetrieveWorkflows(c config.Cpi) ([]byte, error) {
-	url := fmt.Sprintf("%s/api/1.1/workflows/library", c.ApiServer)
+	url := endpointsFor(c).graphLibrary()
 	request, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error making request: %s", err)
 	}
 	request.Close = true
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := clientFor(c).Do(request)
 	if err != nil {
 		return nil, fmt.Errorf("Error: %s", err)
 	}
@@ -163,9 +171,38 @@ func RetrieveWorkflows(c config.Cpi) ([]byte, error) {
 	return body, nil
 }
 
+// DeleteWorkflow removes a graph from the library of a 2.0 API
+func DeleteWorkflow(c config.Cpi, injectableName string) error {
+	return deleteLibraryEntry(c, "workflow", endpointsFor(c).graphDefinition(injectableName))
+}
+
+func deleteLibraryEntry(c config.Cpi, kind string, url string) error {
+	if c.ApiVersion != config.ApiVersion2 {
+		return fmt.Errorf("deleting a %s from the library requires api_version %s", kind, config.ApiVersion2)
+	}
+
+	request, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return fmt.Errorf("error building http request: %s", err)
+	}
+
+	resp, err := clientFor(c).Do(request)
+	if err != nil {
+		return fmt.Errorf("error deleting %s at %s: %s", kind, url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 204 && resp.StatusCode != 404 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Failed deleting %s at %s with status: %s, message: %s", kind, url, resp.Status, string(msg))
+	}
+
+	return nil
+}
+
 func WorkflowFetcher(c config.Cpi, workflowID string) (WorkflowResponse, error) {
-	url := fmt.Sprintf("%s/api/common/workflows/%s", c.ApiServer, workflowID)
-	resp, err := http.Get(url)
+	url := endpointsFor(c).workflow(workflowID)
+	resp, err := clientFor(c).Get(url)
 	if err != nil {
 		return WorkflowResponse{}, fmt.Errorf("Error requesting workflow on node at url: %s, msg: %s", url, err)
 	}
@@ -177,8 +214,7 @@ func WorkflowFetcher(c config.Cpi, workflowID string) (WorkflowResponse, error)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
-	var workflow WorkflowResponse
-	err = json.Unmarshal(body, &workflow)
+	workflow, err := endpointsFor(c).decodeWorkflow(body)
 	if err != nil {
 		return WorkflowResponse{}, fmt.Errorf("Error unmarshalling workflow: %s", err)
 	}
@@ -187,7 +223,7 @@ func WorkflowFetcher(c config.Cpi, workflowID string) (WorkflowResponse, error)
 }
 
 func WorkflowPoster(c config.Cpi, nodeID string, req RunWorkflowRequestBody) (WorkflowResponse, error) {
-	url := fmt.Sprintf("%s/api/1.1/nodes/%s/workflows/", c.ApiServer, nodeID)
+	url := endpointsFor(c).nodeWorkflows(nodeID)
 	body, err := json.Marshal(req)
 	if err != nil {
 		return WorkflowResponse{}, fmt.Errorf("error marshalling workflow request body, %s", err)
@@ -198,7 +234,7 @@ func WorkflowPoster(c config.Cpi, nodeID string, req RunWorkflowRequestBody) (Wo
 	}
 	request.Header.Set("Content-Type", "application/json")
 	log.Debug("Posting workflow...")
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := clientFor(c).Do(request)
 	if err != nil {
 		return WorkflowResponse{}, fmt.Errorf("error running workflow at url %s", url)
 	}
@@ -214,8 +250,7 @@ func WorkflowPoster(c config.Cpi, nodeID string, req RunWorkflowRequestBody) (Wo
 		return WorkflowResponse{}, fmt.Errorf("error reading workflow response body %s", err)
 	}
 
-	workflowResp := WorkflowResponse{}
-	err = json.Unmarshal(wfRespBytes, &workflowResp)
+	workflowResp, err := endpointsFor(c).decodeWorkflow(wfRespBytes)
 	if err != nil {
 		return WorkflowResponse{}, fmt.Errorf("error unmarshalling /common/node/workflows response %s", err)
 	}
@@ -224,73 +259,173 @@ func WorkflowPoster(c config.Cpi, nodeID string, req RunWorkflowRequestBody) (Wo
 	return workflowResp, nil
 }
 
+// RunWorkflow posts the workflow and waits for it to finish. When amqp_url is
+// set it fetches the status of the workflow as RackHD publishes events for it,
+// and polls when the broker cannot be reached or the subscription is lost.
 func RunWorkflow(poster workflowPosterFunc, fetcher workflowFetcherFunc, c config.Cpi, nodeID string, req RunWorkflowRequestBody) error {
+	events, unsubscribe := subscribeToEvents(c)
+	defer unsubscribe()
+
 	postedWorkflow, err := poster(c, nodeID, req)
 	if err != nil {
 		return fmt.Errorf("Failed to post workflow: %s", err)
 	}
+	defer OnInterrupt(fmt.Sprintf("cancel workflow: %s on node: %s", req.Name, nodeID), func() error {
+		return KillActiveWorkflow(c, nodeID)
+	})()
+
+	progress := newWorkflowProgress(req.Name, nodeID, time.Now())
+	defer func() {
+		progress.logSummary(time.Now())
+	}()
+
+	pollInterval := WorkflowPollInterval
+	if events != nil {
+		pollInterval = EventPollInterval
+	}
 
 	timeoutChan := time.NewTimer(time.Second * c.RunWorkflowTimeoutSeconds).C
-	retryChan := time.NewTicker(time.Second * 3).C
+	retryTicker := time.NewTicker(pollInterval)
+	defer func() {
+		retryTicker.Stop()
+	}()
 
 	for {
 		select {
 		case <-timeoutChan:
+			progress.status = "timed out"
 			err := KillActiveWorkflow(c, nodeID)
 			if err != nil {
 				return fmt.Errorf("Could not abort timed out workflow on node: %s", nodeID)
 			}
 
 			return fmt.Errorf("Timed out running workflow: %s on node: %s", req.Name, nodeID)
-		case <-retryChan:
-			wr, err := fetcher(c, postedWorkflow.ID)
-			if err != nil {
-				return fmt.Errorf("Unable to fetch workflow status: %s", err)
+		case event, ok := <-events:
+			if !ok {
+				log.Info(fmt.Sprintf("lost the subscription to RackHD events, polling for the status of workflow: %s", req.Name))
+				events = nil
+				retryTicker.Stop()
+				retryTicker = time.NewTicker(WorkflowPollInterval)
+				continue
 			}
 
-			for _, value := range wr.Tasks {
-				log.Debug(fmt.Sprintf("task: %v", value))
+			if event.GraphID != postedWorkflow.ID {
+				continue
 			}
+			log.Debug(fmt.Sprintf("received %s event with status: %s for workflow: %s", event.Type, event.Status, req.Name))
+		case <-retryTicker.C:
+		}
 
-			log.Debug(fmt.Sprintf("workflow: %s with status: %s and pending tasks: %d", wr.Name, wr.Status, len(wr.PendingTasks)))
+		done, err := checkWorkflow(c, fetcher, postedWorkflow.ID, nodeID, req, progress)
+		if done {
+			return err
+		}
+	}
+}
 
-			switch wr.Status {
-			case workflowValidStatus:
-				if len(wr.PendingTasks) == 0 {
-					log.Info(fmt.Sprintf("workflow: %s completed with valid state against node: %s", req.Name, nodeID))
-					return nil
-				}
-				log.Debug(fmt.Sprintf("workflow: %s is still running against node: %s", req.Name, nodeID))
-				continue
-			case workflowSuccessfulStatus:
-				log.Info(fmt.Sprintf("workflow: %s completed successfully against node: %s", req.Name, nodeID))
-				return nil
-			case workflowFailedStatus:
-				return fmt.Errorf("workflow: %s failed against node: %s", req.Name, nodeID)
-			case workflowCancelledStatus:
-				log.Info(fmt.Sprintf("workflow: %s was cancelled against node: %s", req.Name, nodeID))
-				return nil
-			default:
-				return fmt.Errorf("workflow: %s has unexpected status %s on node: %s", req.Name, wr.Status, nodeID)
-			}
+// checkWorkflow fetches the workflow and reports whether it is done, and
+// whether it failed
+func checkWorkflow(c config.Cpi, fetcher workflowFetcherFunc, workflowID string, nodeID string, req RunWorkflowRequestBody, progress *workflowProgress) (bool, error) {
+	wr, err := fetcher(c, workflowID)
+	if err != nil {
+		return true, fmt.Errorf("Unable to fetch workflow status: %s", err)
+	}
+	progress.observe(wr, time.Now())
+
+	for _, value := range wr.Tasks {
+		log.Debug(fmt.Sprintf("task: %v", value))
+	}
+
+	log.Debug(fmt.Sprintf("workflow: %s with status: %s and pending tasks: %d", wr.Name, wr.Status, len(wr.PendingTasks)))
+
+	switch wr.Status {
+	case workflowValidStatus:
+		if len(wr.PendingTasks) == 0 {
+			log.Info(fmt.Sprintf("workflow: %s completed with valid state against node: %s", req.Name, nodeID))
+			return true, nil
 		}
+		log.Debug(fmt.Sprintf("workflow: %s is still running against node: %s", req.Name, nodeID))
+		return false, nil
+	case workflowRunningStatus, workflowPendingStatus:
+		log.Debug(fmt.Sprintf("workflow: %s is still running against node: %s", req.Name, nodeID))
+		return false, nil
+	case workflowSuccessfulStatus:
+		log.Info(fmt.Sprintf("workflow: %s completed successfully against node: %s", req.Name, nodeID))
+		return true, nil
+	case workflowFailedStatus:
+		return true, workflowFailedError(req.Name, nodeID, wr)
+	case workflowCancelledStatus:
+		return true, fmt.Errorf("workflow: %s was cancelled against node: %s", req.Name, nodeID)
+	default:
+		return true, fmt.Errorf("workflow: %s has unexpected status %s on node: %s", req.Name, wr.Status, nodeID)
 	}
 }
 
+// failedTasks are the tasks of the workflow that failed or timed out, rather
+// than those cancelled because of them. Tasks of the 1.1 API are labelled with
+// their label in the graph definition.
+func failedTasks(wr WorkflowResponse) []TaskResponse {
+	labels := taskLabels(wr)
+	failed := []TaskResponse{}
+	for _, task := range wr.Tasks {
+		if task.State != workflowFailedStatus && task.State != taskTimeoutState {
+			continue
+		}
+		if task.Label == "" {
+			task.Label = labels[task.Name]
+		}
+		failed = append(failed, task)
+	}
+
+	sort.Sort(byTaskLabel(failed))
+
+	return failed
+}
+
+type byTaskLabel []TaskResponse
+
+func (b byTaskLabel) Len() int           { return len(b) }
+func (b byTaskLabel) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byTaskLabel) Less(i, j int) bool { return b[i].Label < b[j].Label }
+
+// taskLabels maps the names of the tasks in the graph definition to their labels
+func taskLabels(wr WorkflowResponse) map[string]string {
+	labels := map[string]string{}
+	for _, task := range wr.Definition.Tasks {
+		labels[task.TaskName] = task.Label
+	}
+
+	return labels
+}
+
+func workflowFailedError(workflowName string, nodeID string, wr WorkflowResponse) error {
+	tasks := failedTasks(wr)
+	if len(tasks) == 0 {
+		return fmt.Errorf("workflow: %s failed against node: %s", workflowName, nodeID)
+	}
+
+	details := make([]string, len(tasks))
+	for i := range tasks {
+		details[i] = tasks[i].Details()
+		log.Error(fmt.Sprintf("workflow: %s on node: %s %s", workflowName, nodeID, details[i]))
+	}
+
+	return fmt.Errorf("workflow: %s failed against node: %s; %s", workflowName, nodeID, strings.Join(details, "; "))
+}
+
 func KillActiveWorkflow(c config.Cpi, nodeID string) error {
-	url := fmt.Sprintf("%s/api/1.1/nodes/%s/workflows/active", c.ApiServer, nodeID)
-	request, err := http.NewRequest("DELETE", url, nil)
+	request, err := endpointsFor(c).cancelActiveWorkflowRequest(nodeID)
 	if err != nil {
 		return fmt.Errorf("error: %s building http request to delete active workflows against node: %s", err, nodeID)
 	}
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := clientFor(c).Do(request)
 	if err != nil {
 		return fmt.Errorf("Error: %s deleting active workflows on node: %s", err, nodeID)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+	if resp.StatusCode != 200 && resp.StatusCode != 202 && resp.StatusCode != 204 {
 		msg, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			return fmt.Errorf("Error: %s reading response body from abort workflows request against node: %s", err, nodeID)
@@ -303,10 +438,8 @@ func KillActiveWorkflow(c config.Cpi, nodeID string) error {
 }
 
 func GetActiveWorkflows(c config.Cpi, nodeID string) (WorkflowResponse, error) {
-	var workflows WorkflowResponse
-
-	url := fmt.Sprintf("%s/api/1.1/nodes/%s/workflows/active", c.ApiServer, nodeID)
-	resp, err := http.Get(url)
+	url := endpointsFor(c).activeWorkflow(nodeID)
+	resp, err := clientFor(c).Get(url)
 	if err != nil {
 		return WorkflowResponse{}, fmt.Errorf("Error requesting active workflows on node at url: %s, msg: %s", url, err)
 	}
@@ -323,7 +456,7 @@ func GetActiveWorkflows(c config.Cpi, nodeID string) (WorkflowResponse, error) {
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
-	err = json.Unmarshal(body, &workflows)
+	workflows, err := endpointsFor(c).decodeWorkflow(body)
 	if err != nil {
 		return WorkflowResponse{}, fmt.Errorf("Error unmarshalling active workflows: %s %s", err, string(body))
 	}
@@ -1,6 +1,7 @@
 package rackhdapi_test
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/nu7hatch/gouuid"
 	"github.com/rackhd/rackhd-cpi/config"
 	"github.com/rackhd/rackhd-cpi/helpers"
@@ -190,6 +192,139 @@ var _ = Describe("Workflows", func() {
 			})
 		})
 
+		Context("when the workflow fails", func() {
+			It("returns the failed tasks with their labels", func() {
+				workflowResponseFile, err := os.Open("../spec_assets/dummy_workflow_response.json")
+				Expect(err).ToNot(HaveOccurred())
+				defer workflowResponseFile.Close()
+
+				workflowResponseBytes, err := ioutil.ReadAll(workflowResponseFile)
+				Expect(err).ToNot(HaveOccurred())
+
+				var wr rackhdapi.WorkflowResponse
+				err = json.Unmarshal(workflowResponseBytes, &wr)
+				Expect(err).ToNot(HaveOccurred())
+
+				fakeWorkflowPoster := func(config.Cpi, string, rackhdapi.RunWorkflowRequestBody) (rackhdapi.WorkflowResponse, error) {
+					return wr, nil
+				}
+
+				fakeWorkflowFetcher := func(config.Cpi, string) (rackhdapi.WorkflowResponse, error) {
+					return wr, nil
+				}
+
+				c := config.Cpi{RunWorkflowTimeoutSeconds: 5}
+				body := rackhdapi.RunWorkflowRequestBody{Name: "Graph.BOSH.ProvisionNode"}
+				err = rackhdapi.RunWorkflow(fakeWorkflowPoster, fakeWorkflowFetcher, c, "nodeID", body)
+				Expect(err).To(MatchError("workflow: Graph.BOSH.ProvisionNode failed against node: nodeID; " +
+					"task: provision-node (Task.BOSH.Provision.Node.82f995e2-b550-42cc-88ee-6bae74f9fb46) failed with no error recorded"))
+			})
+		})
+
+		Context("when the workflow is cancelled", func() {
+			It("returns an error", func() {
+				workflowID := "5665a788fd797bfc044efe6e"
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/workflows/%s", workflowID)),
+						ghttp.RespondWith(http.StatusOK, []byte(fmt.Sprintf(`{"id":"%s","_status":"cancelled"}`, workflowID))),
+					),
+				)
+
+				fakeWorkflowPoster := func(config.Cpi, string, rackhdapi.RunWorkflowRequestBody) (rackhdapi.WorkflowResponse, error) {
+					return rackhdapi.WorkflowResponse{ID: workflowID, Status: "running"}, nil
+				}
+
+				rackhdapi.WorkflowPollInterval = 10 * time.Millisecond
+				defer func() { rackhdapi.WorkflowPollInterval = 3 * time.Second }()
+
+				body := rackhdapi.RunWorkflowRequestBody{Name: "Graph.BOSH.ProvisionNode"}
+				err := rackhdapi.RunWorkflow(fakeWorkflowPoster, rackhdapi.WorkflowFetcher, cpiConfig, "nodeID", body)
+				Expect(err).To(MatchError("workflow: Graph.BOSH.ProvisionNode was cancelled against node: nodeID"))
+				Expect(server.ReceivedRequests()).To(HaveLen(1))
+			})
+		})
+
+		Context("while the workflow runs", func() {
+			var logOutput *bytes.Buffer
+
+			BeforeEach(func() {
+				rackhdapi.WorkflowPollInterval = 10 * time.Millisecond
+				logOutput = new(bytes.Buffer)
+				log.SetOutput(logOutput)
+			})
+
+			AfterEach(func() {
+				rackhdapi.WorkflowPollInterval = 3 * time.Second
+				log.SetOutput(ioutil.Discard)
+			})
+
+			It("logs each task transition and a summary of the task durations", func() {
+				definition := rackhdapi.WorkflowStub{Tasks: []rackhdapi.WorkflowTask{
+					{TaskName: "Task.BOSH.Provision.Node", Label: "provision-node"},
+				}}
+				polls := []rackhdapi.WorkflowResponse{
+					{ID: "graph-id", Status: "valid", PendingTasks: []interface{}{"task-id"}, Definition: definition,
+						Tasks: map[string]rackhdapi.TaskResponse{"task-id": {Name: "Task.BOSH.Provision.Node", State: "pending"}}},
+					{ID: "graph-id", Status: "valid", PendingTasks: []interface{}{"task-id"}, Definition: definition,
+						Tasks: map[string]rackhdapi.TaskResponse{"task-id": {Name: "Task.BOSH.Provision.Node", State: "running"}}},
+					{ID: "graph-id", Status: "succeeded", Definition: definition,
+						Tasks: map[string]rackhdapi.TaskResponse{"task-id": {Name: "Task.BOSH.Provision.Node", State: "succeeded"}}},
+				}
+
+				fakeWorkflowPoster := func(config.Cpi, string, rackhdapi.RunWorkflowRequestBody) (rackhdapi.WorkflowResponse, error) {
+					return polls[0], nil
+				}
+
+				fakeWorkflowFetcher := func(config.Cpi, string) (rackhdapi.WorkflowResponse, error) {
+					wr := polls[0]
+					polls = polls[1:]
+					return wr, nil
+				}
+
+				c := config.Cpi{RunWorkflowTimeoutSeconds: 5}
+				body := rackhdapi.RunWorkflowRequestBody{Name: "Graph.BOSH.ProvisionNode"}
+				err := rackhdapi.RunWorkflow(fakeWorkflowPoster, fakeWorkflowFetcher, c, "nodeID", body)
+				Expect(err).ToNot(HaveOccurred())
+
+				output := logOutput.String()
+				Expect(output).To(ContainSubstring("task: provision-node (Task.BOSH.Provision.Node) is pending at "))
+				Expect(output).To(ContainSubstring("task: provision-node (Task.BOSH.Provision.Node) went from pending to running at "))
+				Expect(output).To(ContainSubstring("task: provision-node (Task.BOSH.Provision.Node) succeeded at "))
+				Expect(output).To(ContainSubstring("workflow: Graph.BOSH.ProvisionNode on node: nodeID ended with status: succeeded after "))
+				Expect(output).To(ContainSubstring("  task: provision-node (Task.BOSH.Provision.Node) succeeded in 0s"))
+			})
+
+			It("writes the summary to the response log when the log level drops it", func() {
+				responseLog := new(bytes.Buffer)
+				rackhdapi.ResponseLog = responseLog
+				level := log.GetLevel()
+				log.SetLevel(log.ErrorLevel)
+				defer func() {
+					rackhdapi.ResponseLog = ioutil.Discard
+					log.SetLevel(level)
+				}()
+
+				wr := rackhdapi.WorkflowResponse{ID: "graph-id", Status: "succeeded",
+					Tasks: map[string]rackhdapi.TaskResponse{"task-id": {Name: "Task.BOSH.Provision.Node", State: "succeeded"}}}
+				fakeWorkflowPoster := func(config.Cpi, string, rackhdapi.RunWorkflowRequestBody) (rackhdapi.WorkflowResponse, error) {
+					return wr, nil
+				}
+				fakeWorkflowFetcher := func(config.Cpi, string) (rackhdapi.WorkflowResponse, error) {
+					return wr, nil
+				}
+
+				c := config.Cpi{RunWorkflowTimeoutSeconds: 5}
+				body := rackhdapi.RunWorkflowRequestBody{Name: "Graph.BOSH.ProvisionNode"}
+				err := rackhdapi.RunWorkflow(fakeWorkflowPoster, fakeWorkflowFetcher, c, "nodeID", body)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(logOutput.String()).To(BeEmpty())
+				Expect(responseLog.String()).To(ContainSubstring("workflow: Graph.BOSH.ProvisionNode on node: nodeID ended with status: succeeded after "))
+				Expect(responseLog.String()).To(ContainSubstring("  task: Task.BOSH.Provision.Node succeeded"))
+			})
+		})
+
 		Describe("INTEGRATION", func() {
 			var idleNodes []rackhdapi.Node
 			var cpiConfig config.Cpi
@@ -331,4 +466,35 @@ var _ = Describe("Workflows", func() {
 			})
 		})
 	})
+
+	Describe("TaskResponse", func() {
+		It("describes the command that failed and its output", func() {
+			var task rackhdapi.TaskResponse
+			err := json.Unmarshal([]byte(`{
+				"name": "Task.BOSH.Provision.Node",
+				"label": "provision-node",
+				"state": "failed",
+				"error": {
+					"name": "Error",
+					"message": "Encountered a failure running remote commands",
+					"cmd": "test $(cat /opt/downloads/stemcellFileCalculatedMd5) = $(cat /opt/downloads/stemcellFileExpectedMd5)",
+					"exitCode": 1,
+					"stderr": "md5 mismatch\n"
+				}
+			}`), &task)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(task.Details()).To(Equal("task: provision-node (Task.BOSH.Provision.Node) failed: Encountered a failure running remote commands, " +
+				"command: test $(cat /opt/downloads/stemcellFileCalculatedMd5) = $(cat /opt/downloads/stemcellFileExpectedMd5), " +
+				"exit code: 1, stderr: md5 mismatch"))
+		})
+
+		It("reads errors recorded as a message", func() {
+			var task rackhdapi.TaskResponse
+			err := json.Unmarshal([]byte(`{"name": "Task.Obm.Node.Reboot", "state": "timeout", "error": "timed out after 60000ms"}`), &task)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(task.Details()).To(Equal("task: Task.Obm.Node.Reboot timeout: timed out after 60000ms"))
+		})
+	})
 })
@@ -0,0 +1,186 @@
+package workflows
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+// definitionTemplates are the templates of every task and graph the cpi
+// publishes. Published names are suffixed with a hash of them, so each cpi
+// release publishes its definitions once and all of its requests reuse them.
+var definitionTemplates = [][]byte{
+	reserveNodeTaskTemplate,
+	reserveNodeWorkflowTemplate,
+	provisionNodeTemplate,
+	setNodeIDTemplate,
+	provisionNodeWorkflowTemplate,
+	deprovisionNodeTaskTemplate,
+	deprovisionNodeWorkflowTemplate,
+	rebootNodeWorkflowTemplate,
+}
+
+var definitionVersion = hashTemplates(definitionTemplates)
+
+// DefinitionVersion is the suffix of the task and graph names published by
+// this cpi
+func DefinitionVersion() string {
+	return definitionVersion
+}
+
+func hashTemplates(templates [][]byte) string {
+	hash := sha256.New()
+	for i := range templates {
+		hash.Write(templates[i])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+// publishDefinitions publishes the tasks and then the graph, unless the graph
+// library already holds the graph. The graph is published last, so its
+// presence means its tasks were published too.
+func publishDefinitions(c config.Cpi, tasks [][]byte, workflow []byte) (string, error) {
+	w := rackhdapi.WorkflowStub{}
+	err := json.Unmarshal(workflow, &w)
+	if err != nil {
+		return "", fmt.Errorf("error umarshalling workflow: %s", err)
+	}
+
+	published, err := publishedWorkflowNames(c)
+	if err != nil {
+		return "", err
+	}
+
+	if published[w.Name] {
+		log.Debug(fmt.Sprintf("workflow %s is already published", w.Name))
+		return w.Name, nil
+	}
+
+	for i := range tasks {
+		err = rackhdapi.PublishTask(c, tasks[i])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = rackhdapi.PublishWorkflow(c, workflow)
+	if err != nil {
+		return "", err
+	}
+
+	return w.Name, nil
+}
+
+func publishedWorkflowNames(c config.Cpi) (map[string]bool, error) {
+	workflowsBytes, err := rackhdapi.RetrieveWorkflows(c)
+	if err != nil {
+		return nil, err
+	}
+
+	workflows := []rackhdapi.WorkflowStub{}
+	err = json.Unmarshal(workflowsBytes, &workflows)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling published workflows: %s", err)
+	}
+
+	names := map[string]bool{}
+	for i := range workflows {
+		names[workflows[i].Name] = true
+	}
+
+	return names, nil
+}
+
+// currentDefinitionNames are the names of the tasks and graphs published by
+// this cpi
+func currentDefinitionNames() (map[string]bool, error) {
+	names := map[string]bool{}
+	for i := range definitionTemplates {
+		stub := rackhdapi.TaskStub{}
+		err := json.Unmarshal(definitionTemplates[i], &stub)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling definition template: %s", err)
+		}
+		names[fmt.Sprintf("%s.%s", stub.Name, definitionVersion)] = true
+	}
+
+	return names, nil
+}
+
+func isStaleDefinition(stub rackhdapi.TaskStub, current map[string]bool) bool {
+	return strings.HasSuffix(stub.UnusedName, "."+rackhdapi.DefaultUnusedName) && !current[stub.Name]
+}
+
+// CleanupStaleDefinitions deletes the graphs and then the tasks uploaded by
+// the cpi whose names are not those of the current definitions, such as the
+// per-request definitions of earlier releases, and returns their names. It
+// requires the 2.0 API.
+func CleanupStaleDefinitions(c config.Cpi) ([]string, error) {
+	if c.ApiVersion != config.ApiVersion2 {
+		return nil, fmt.Errorf("cleaning up stale definitions requires api_version %s, not %s", config.ApiVersion2, c.ApiVersion)
+	}
+
+	current, err := currentDefinitionNames()
+	if err != nil {
+		return nil, err
+	}
+
+	workflowsBytes, err := rackhdapi.RetrieveWorkflows(c)
+	if err != nil {
+		return nil, err
+	}
+
+	workflows := []rackhdapi.WorkflowStub{}
+	err = json.Unmarshal(workflowsBytes, &workflows)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling published workflows: %s", err)
+	}
+
+	deleted := []string{}
+	for _, w := range workflows {
+		if !isStaleDefinition(rackhdapi.TaskStub{Name: w.Name, UnusedName: w.UnusedName}, current) {
+			continue
+		}
+
+		err = rackhdapi.DeleteWorkflow(c, w.Name)
+		if err != nil {
+			return deleted, err
+		}
+		log.Info(fmt.Sprintf("deleted stale workflow %s", w.Name))
+		deleted = append(deleted, w.Name)
+	}
+
+	tasksBytes, err := rackhdapi.RetrieveTasks(c)
+	if err != nil {
+		return deleted, err
+	}
+
+	tasks := []rackhdapi.TaskStub{}
+	err = json.Unmarshal(tasksBytes, &tasks)
+	if err != nil {
+		return deleted, fmt.Errorf("error unmarshalling published tasks: %s", err)
+	}
+
+	for _, t := range tasks {
+		if !isStaleDefinition(t, current) {
+			continue
+		}
+
+		err = rackhdapi.DeleteTask(c, t.Name)
+		if err != nil {
+			return deleted, err
+		}
+		log.Info(fmt.Sprintf("deleted stale task %s", t.Name))
+		deleted = append(deleted, t.Name)
+	}
+
+	return deleted, nil
+}
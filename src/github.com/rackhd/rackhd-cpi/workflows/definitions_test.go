@@ -0,0 +1,103 @@
+package workflows_test
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/workflows"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Definitions", func() {
+	var server *ghttp.Server
+	var cpiConfig config.Cpi
+
+	BeforeEach(func() {
+		server, _, cpiConfig, _ = helpers.SetUp("")
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("names definitions after the templates rather than the request", func() {
+		Expect(workflows.DefinitionVersion()).To(MatchRegexp("^[0-9a-f]{12}$"))
+
+		server.AppendHandlers(helpers.MakePublishHandlers("Graph.BOSH.RebootNode.", 0)...)
+		cpiConfig.RequestID = "first-request"
+		name, err := workflows.PublishRebootNodeWorkflow(cpiConfig)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(name).To(Equal(fmt.Sprintf("Graph.BOSH.RebootNode.%s", workflows.DefinitionVersion())))
+	})
+
+	It("does not publish definitions the library already holds", func() {
+		published := fmt.Sprintf(`[{"injectableName":"Graph.BOSH.RebootNode.%s"}]`, workflows.DefinitionVersion())
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/1.1/workflows/library"),
+				ghttp.RespondWith(http.StatusOK, []byte(published)),
+			),
+		)
+
+		name, err := workflows.PublishRebootNodeWorkflow(cpiConfig)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(name).To(Equal(fmt.Sprintf("Graph.BOSH.RebootNode.%s", workflows.DefinitionVersion())))
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	Describe("CleanupStaleDefinitions", func() {
+		BeforeEach(func() {
+			cpiConfig.ApiVersion = config.ApiVersion2
+		})
+
+		It("deletes the stale graphs and then the stale tasks uploaded by the cpi", func() {
+			graphs := fmt.Sprintf(`[
+				{"injectableName":"Graph.BOSH.ReserveNode.%s","friendlyName":"BOSH Reserve Node.UPLOADED_BY_RACKHD_CPI"},
+				{"injectableName":"Graph.BOSH.ReserveNode.f0b8e7f2","friendlyName":"BOSH Reserve Node.UPLOADED_BY_RACKHD_CPI"},
+				{"injectableName":"Graph.Discovery","friendlyName":"Discovery Graph"}
+			]`, workflows.DefinitionVersion())
+			tasks := fmt.Sprintf(`[
+				{"injectableName":"Task.BOSH.Reserve.Node.%s","friendlyName":"Reserve Node.UPLOADED_BY_RACKHD_CPI"},
+				{"injectableName":"Task.BOSH.Reserve.Node.f0b8e7f2","friendlyName":"Reserve Node.UPLOADED_BY_RACKHD_CPI"},
+				{"injectableName":"Task.Linux.Bootstrap.Ubuntu","friendlyName":"Bootstrap Ubuntu"}
+			]`, workflows.DefinitionVersion())
+
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/2.0/workflows/graphs"),
+					ghttp.RespondWith(http.StatusOK, []byte(graphs)),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("DELETE", "/api/2.0/workflows/graphs/Graph.BOSH.ReserveNode.f0b8e7f2"),
+					ghttp.RespondWith(http.StatusNoContent, nil),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/2.0/workflows/tasks"),
+					ghttp.RespondWith(http.StatusOK, []byte(tasks)),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("DELETE", "/api/2.0/workflows/tasks/Task.BOSH.Reserve.Node.f0b8e7f2"),
+					ghttp.RespondWith(http.StatusNoContent, nil),
+				),
+			)
+
+			deleted, err := workflows.CleanupStaleDefinitions(cpiConfig)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleted).To(Equal([]string{"Graph.BOSH.ReserveNode.f0b8e7f2", "Task.BOSH.Reserve.Node.f0b8e7f2"}))
+			Expect(server.ReceivedRequests()).To(HaveLen(4))
+		})
+
+		It("returns an error on the 1.1 API without touching the library", func() {
+			cpiConfig.ApiVersion = config.ApiVersion1
+
+			_, err := workflows.CleanupStaleDefinitions(cpiConfig)
+			Expect(err).To(MatchError("cleaning up stale definitions requires api_version 2.0, not 1.1"))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+	})
+})
@@ -90,30 +90,12 @@ func RunDeprovisionNodeWorkflow(c config.Cpi, nodeID string, workflowName string
 }
 
 func PublishDeprovisionNodeWorkflow(c config.Cpi) (string, error) {
-	tasks, workflow, err := generateDeprovisionNodeWorkflow(c.RequestID)
+	tasks, workflow, err := generateDeprovisionNodeWorkflow(definitionVersion)
 	if err != nil {
 		return "", err
 	}
 
-	for i := range tasks {
-		err = rackhdapi.PublishTask(c, tasks[i])
-		if err != nil {
-			return "", err
-		}
-	}
-
-	w := deprovisionNodeWorkflow{}
-	err = json.Unmarshal(workflow, &w)
-	if err != nil {
-		return "", fmt.Errorf("error umarshalling workflow: %s", err)
-	}
-
-	err = rackhdapi.PublishWorkflow(c, workflow)
-	if err != nil {
-		return "", err
-	}
-
-	return w.Name, nil
+	return publishDefinitions(c, tasks, workflow)
 }
 
 func generateDeprovisionNodeWorkflow(uuid string) ([][]byte, []byte, error) {
@@ -79,7 +79,7 @@ var _ = Describe("DeprovisionNodeWorkflow", func() {
 
 			workflowName, err := PublishDeprovisionNodeWorkflow(c)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(workflowName).To(ContainSubstring(uID))
+			Expect(workflowName).To(HaveSuffix(definitionVersion))
 		})
 	})
 
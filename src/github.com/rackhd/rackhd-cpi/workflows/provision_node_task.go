@@ -21,6 +21,10 @@ var provisionNodeTemplate = []byte(`{
       "md5sum {{ options.downloadDir }}/{{ options.agentSettingsFile }} | cut -d' ' -f1 > /opt/downloads/agentSettingsCalculatedMd5",
       "test $(cat /opt/downloads/stemcellFileCalculatedMd5) = $(cat /opt/downloads/stemcellFileExpectedMd5)",
       "test $(cat /opt/downloads/agentSettingsCalculatedMd5) = $(cat /opt/downloads/agentSettingsExpectedMd5)",
+      "if [ -n \"{{ options.interfacesFile }}\" ]; then curl --retry 3 {{ options.interfacesUri }} -o {{ options.downloadDir }}/interfaces; fi",
+      "if [ -n \"{{ options.interfacesFile }}\" ]; then curl {{ options.interfacesMd5Uri }} | tr -d '\"' > /opt/downloads/interfacesExpectedMd5; fi",
+      "if [ -n \"{{ options.interfacesFile }}\" ]; then md5sum {{ options.downloadDir }}/interfaces | cut -d' ' -f1 > /opt/downloads/interfacesCalculatedMd5; fi",
+      "if [ -n \"{{ options.interfacesFile }}\" ]; then test $(cat /opt/downloads/interfacesCalculatedMd5) = $(cat /opt/downloads/interfacesExpectedMd5); fi",
       "sudo umount {{ options.device }} || true",
       "sudo tar --to-stdout -xvf {{ options.downloadDir }}/{{ options.stemcellFile }} | sudo dd of={{ options.device }}",
       "sudo sfdisk -R {{ options.device }}",
@@ -28,10 +32,15 @@ var provisionNodeTemplate = []byte(`{
       "sudo dd if=/dev/zero of={{ options.device }}2 bs=1M count=100",
       "sudo dd if=/dev/zero of={{ options.device }}3 bs=1M count=100",
       "sudo cp {{ options.downloadDir }}/{{ options.agentSettingsFile }} /mnt/{{ options.agentSettingsPath }}",
+      "if [ -n \"{{ options.interfacesFile }}\" ]; then sudo mkdir -p /mnt/etc/network/interfaces.d && sudo cp {{ options.downloadDir }}/interfaces /mnt/etc/network/interfaces.d/rackhd-cpi.cfg; fi",
+      "if [ -n \"{{ options.interfacesFile }}\" ] && ! grep -Eqs '^source(-directory)? +/etc/network/interfaces.d' /mnt/etc/network/interfaces; then echo 'source /etc/network/interfaces.d/*.cfg' | sudo tee -a /mnt/etc/network/interfaces > /dev/null; fi",
       "sudo sync"
     ],
     "device": "/dev/sda",
     "downloadDir": "/opt/downloads",
+    "interfacesFile": null,
+    "interfacesMd5Uri": "{{ api.files }}/md5/{{ options.interfacesFile }}/latest",
+    "interfacesUri": "{{ api.files }}/{{ options.interfacesFile }}/latest",
     "persistent": "/dev/sdb",
     "stemcellFile": null,
     "stemcellFileMd5Uri": "{{ api.files }}/md5/{{ options.stemcellFile }}/latest",
@@ -49,6 +58,9 @@ type provisionNodeOptions struct {
 	Commands            []string `json:"commands"`
 	Device              string   `json:"device"`
 	DownloadDir         string   `json:"downloadDir"`
+	InterfacesFile      *string  `json:"interfacesFile"`
+	InterfacesMd5Uri    string   `json:"interfacesMd5Uri"`
+	InterfacesURI       string   `json:"interfacesUri"`
 	Persistent          string   `json:"persistent"`
 	StemcellFileMd5Uri  string   `json:"stemcellFileMd5Uri"`
 	StemcellFile        *string  `json:"stemcellFile"`
@@ -20,6 +20,7 @@ var provisionNodeWorkflowTemplate = []byte(`{
       "agentSettingsPath": null,
       "cid": null,
       "downloadDir": "/opt/downloads",
+      "interfacesFile": null,
 			"obmServiceName": null,
       "registrySettingsFile": null,
       "registrySettingsPath": null,
@@ -62,6 +63,7 @@ type ProvisionNodeWorkflowOptions struct {
 	AgentSettingsPath    *string `json:"agentSettingsPath"`
 	CID                  *string `json:"cid"`
 	DownloadDir          string  `json:"downloadDir,omitempty"`
+	InterfacesFile       *string `json:"interfacesFile"`
 	OBMServiceName       *string `json:"obmServiceName"`
 	RegistrySettingsFile *string `json:"registrySettingsFile"`
 	RegistrySettingsPath *string `json:"registrySettingsPath"`
@@ -83,8 +85,8 @@ type provisionNodeWorkflow struct {
 	Tasks []rackhdapi.WorkflowTask `json:"tasks"`
 }
 
-func RunProvisionNodeWorkflow(c config.Cpi, nodeID string, workflowName string, vmCID string, stemcellCID string, wipeDisk bool) error {
-	options, err := buildProvisionWorkflowOptions(c, nodeID, vmCID, stemcellCID, wipeDisk)
+func RunProvisionNodeWorkflow(c config.Cpi, nodeID string, workflowName string, vmCID string, stemcellCID string, wipeDisk bool, interfacesFile string) error {
+	options, err := buildProvisionWorkflowOptions(c, nodeID, vmCID, stemcellCID, wipeDisk, interfacesFile)
 	if err != nil {
 		return err
 	}
@@ -98,31 +100,12 @@ func RunProvisionNodeWorkflow(c config.Cpi, nodeID string, workflowName string,
 }
 
 func PublishProvisionNodeWorkflow(c config.Cpi) (string, error) {
-	tasks, workflow, err := generateProvisionNodeWorkflow(c.RequestID)
+	tasks, workflow, err := generateProvisionNodeWorkflow(definitionVersion)
 	if err != nil {
 		return "", err
 	}
 
-	for i := range tasks {
-		err = rackhdapi.PublishTask(c, tasks[i])
-		if err != nil {
-			return "", err
-		}
-	}
-
-	w := provisionNodeWorkflow{}
-	err = json.Unmarshal(workflow, &w)
-	if err != nil {
-		log.Error(fmt.Sprintf("error umarshalling workflow: %s", err))
-		return "", err
-	}
-
-	err = rackhdapi.PublishWorkflow(c, workflow)
-	if err != nil {
-		return "", err
-	}
-
-	return w.Name, nil
+	return publishDefinitions(c, tasks, workflow)
 }
 
 func generateProvisionNodeWorkflow(uuid string) ([][]byte, []byte, error) {
@@ -179,7 +162,7 @@ func generateProvisionNodeWorkflow(uuid string) ([][]byte, []byte, error) {
 	return [][]byte{pBytes, sBytes}, wBytes, nil
 }
 
-func buildProvisionWorkflowOptions(c config.Cpi, nodeID string, vmCID string, stemcellCID string, wipeDisk bool) (ProvisionNodeWorkflowOptions, error) {
+func buildProvisionWorkflowOptions(c config.Cpi, nodeID string, vmCID string, stemcellCID string, wipeDisk bool, interfacesFile string) (ProvisionNodeWorkflowOptions, error) {
 	envPath := rackhdapi.RackHDEnvPath
 	options := ProvisionNodeWorkflowOptions{
 		AgentSettingsFile: &nodeID,
@@ -189,6 +172,10 @@ func buildProvisionWorkflowOptions(c config.Cpi, nodeID string, vmCID string, st
 		WipeDisk:          strconv.FormatBool(wipeDisk),
 	}
 
+	if interfacesFile != "" {
+		options.InterfacesFile = &interfacesFile
+	}
+
 	obmServiceName, err := rackhdapi.GetOBMServiceName(c, nodeID)
 	if err != nil {
 		return ProvisionNodeWorkflowOptions{}, fmt.Errorf("error retrieving obm settings from node: %s", nodeID)
@@ -79,7 +79,7 @@ var _ = Describe("ProvisionNodeWorkflow", func() {
 
 			workflowName, err := PublishProvisionNodeWorkflow(c)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(workflowName).To(ContainSubstring(uID))
+			Expect(workflowName).To(HaveSuffix(definitionVersion))
 		})
 	})
 
@@ -151,7 +151,7 @@ var _ = Describe("ProvisionNodeWorkflow", func() {
 					OBMServiceName:    &ipmiServiceName,
 				}
 
-				options, err := buildProvisionWorkflowOptions(cpiConfig, nodeID, vmCID, stemcellCID, false)
+				options, err := buildProvisionWorkflowOptions(cpiConfig, nodeID, vmCID, stemcellCID, false, "")
 				Expect(err).ToNot(HaveOccurred())
 				Expect(options).To(Equal(expectedOptions))
 			})
@@ -185,10 +185,30 @@ var _ = Describe("ProvisionNodeWorkflow", func() {
 					OBMServiceName:    &ipmiServiceName,
 				}
 
-				options, err := buildProvisionWorkflowOptions(cpiConfig, nodeID, vmCID, stemcellCID, false)
+				options, err := buildProvisionWorkflowOptions(cpiConfig, nodeID, vmCID, stemcellCID, false, "")
 				Expect(err).ToNot(HaveOccurred())
 				Expect(options).To(Equal(expectedOptions))
 			})
 		})
+
+		Context("when the node needs an interfaces file", func() {
+			It("passes the interfaces file to the provision task", func() {
+				expectedNode := helpers.LoadNode("../spec_assets/dummy_one_node_response.json")
+				expectedNodeData, err := json.Marshal(expectedNode)
+				Expect(err).ToNot(HaveOccurred())
+
+				nodeID := "5665a65a0561790005b77b85"
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", nodeID)),
+						ghttp.RespondWith(http.StatusOK, expectedNodeData),
+					),
+				)
+
+				options, err := buildProvisionWorkflowOptions(cpiConfig, nodeID, "vmCID", "stemcellCID", false, "5665a65a0561790005b77b85-interfaces")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(*options.InterfacesFile).To(Equal("5665a65a0561790005b77b85-interfaces"))
+			})
+		})
 	})
 })
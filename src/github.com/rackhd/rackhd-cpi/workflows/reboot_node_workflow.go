@@ -0,0 +1,96 @@
+package workflows
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+var rebootNodeWorkflowTemplate = []byte(fmt.Sprintf(`{
+  "friendlyName": "BOSH Reboot Node",
+  "injectableName": "Graph.BOSH.RebootNode",
+  "options": {
+    "defaults": {
+      "obmServiceName": null
+    }
+  },
+  "tasks": [
+    {
+      "label": "reboot",
+      "taskName": "%s"
+    }
+  ]
+}`, RebootNodeTaskName))
+
+type rebootNodeWorkflowOptions struct {
+	OBMServiceName *string `json:"obmServiceName"`
+}
+
+type rebootNodeWorkflowDefaultOptionsContainer struct {
+	Defaults rebootNodeWorkflowOptions `json:"defaults"`
+}
+
+type rebootNodeWorkflowOptionsContainer struct {
+	Options rebootNodeWorkflowDefaultOptionsContainer `json:"options"`
+}
+
+type rebootNodeWorkflow struct {
+	*rackhdapi.WorkflowStub
+	rebootNodeWorkflowOptionsContainer
+	Tasks []rackhdapi.WorkflowTask `json:"tasks"`
+}
+
+func RunRebootNodeWorkflow(c config.Cpi, nodeID string, workflowName string) error {
+	options, err := buildRebootNodeWorkflowOptions(c, nodeID)
+	if err != nil {
+		return err
+	}
+
+	req := rackhdapi.RunWorkflowRequestBody{
+		Name:    workflowName,
+		Options: map[string]interface{}{"defaults": options},
+	}
+
+	return rackhdapi.RunWorkflow(rackhdapi.WorkflowPoster, rackhdapi.WorkflowFetcher, c, nodeID, req)
+}
+
+func PublishRebootNodeWorkflow(c config.Cpi) (string, error) {
+	workflow, err := generateRebootNodeWorkflow(definitionVersion)
+	if err != nil {
+		return "", err
+	}
+
+	return publishDefinitions(c, nil, workflow)
+}
+
+func generateRebootNodeWorkflow(uuid string) ([]byte, error) {
+	w := rebootNodeWorkflow{}
+	err := json.Unmarshal(rebootNodeWorkflowTemplate, &w)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling reboot node workflow template: %s", err)
+	}
+
+	w.Name = fmt.Sprintf("%s.%s", w.Name, uuid)
+	w.UnusedName = fmt.Sprintf("%s.%s", w.UnusedName, rackhdapi.DefaultUnusedName)
+
+	wBytes, err := json.Marshal(w)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling reboot node workflow template: %s", err)
+	}
+
+	return wBytes, nil
+}
+
+func buildRebootNodeWorkflowOptions(c config.Cpi, nodeID string) (rebootNodeWorkflowOptions, error) {
+	options := rebootNodeWorkflowOptions{}
+
+	obmServiceName, err := rackhdapi.GetOBMServiceName(c, nodeID)
+	if err != nil {
+		return rebootNodeWorkflowOptions{}, err
+	}
+	options.OBMServiceName = &obmServiceName
+
+	return options, nil
+}
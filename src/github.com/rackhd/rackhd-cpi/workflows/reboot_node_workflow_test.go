@@ -0,0 +1,112 @@
+package workflows
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/nu7hatch/gouuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/rackhd/rackhd-cpi/config"
+	"github.com/rackhd/rackhd-cpi/helpers"
+	"github.com/rackhd/rackhd-cpi/rackhdapi"
+)
+
+var _ = Describe("RebootNodeWorkflow", func() {
+	Describe("RebootNodeWorkflow", func() {
+		It("have the expected structure", func() {
+			vendoredWorkflow := rebootNodeWorkflow{}
+			err := json.Unmarshal(rebootNodeWorkflowTemplate, &vendoredWorkflow)
+			Expect(err).ToNot(HaveOccurred())
+
+			rebootNodeWorkflowFile, err := os.Open("../templates/reboot_node_workflow.json")
+			Expect(err).ToNot(HaveOccurred())
+			defer rebootNodeWorkflowFile.Close()
+
+			b, err := ioutil.ReadAll(rebootNodeWorkflowFile)
+			Expect(err).ToNot(HaveOccurred())
+
+			expectedWorkflow := rebootNodeWorkflow{}
+			err = json.Unmarshal(b, &expectedWorkflow)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(vendoredWorkflow).To(Equal(expectedWorkflow))
+		})
+
+		It("marshalls into the expected JSON document", func() {
+			vendoredWorkflow := rebootNodeWorkflow{}
+			err := json.Unmarshal(rebootNodeWorkflowTemplate, &vendoredWorkflow)
+			Expect(err).ToNot(HaveOccurred())
+
+			vendoredWorkflowJSON, err := json.Marshal(vendoredWorkflow)
+			Expect(err).ToNot(HaveOccurred())
+
+			rebootNodeWorkflowFile, err := os.Open("../templates/reboot_node_workflow.json")
+			Expect(err).ToNot(HaveOccurred())
+			defer rebootNodeWorkflowFile.Close()
+
+			expectedWorkflowJSON, err := ioutil.ReadAll(rebootNodeWorkflowFile)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(vendoredWorkflowJSON).To(MatchJSON(expectedWorkflowJSON))
+		})
+	})
+
+	Describe("generateRebootNodeWorkflow", func() {
+		It("generates the workflow with a unique name that only reboots the node", func() {
+			u, err := uuid.NewV4()
+			Expect(err).ToNot(HaveOccurred())
+			uID := u.String()
+
+			wBytes, err := generateRebootNodeWorkflow(uID)
+			Expect(err).ToNot(HaveOccurred())
+
+			w := rebootNodeWorkflow{}
+			err = json.Unmarshal(wBytes, &w)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Name).To(ContainSubstring(uID))
+			Expect(w.Tasks).To(HaveLen(1))
+			Expect(w.Tasks[0].TaskName).To(Equal(RebootNodeTaskName))
+		})
+	})
+
+	Describe("buildRebootNodeWorkflowOptions", func() {
+		var server *ghttp.Server
+		var cpiConfig config.Cpi
+
+		BeforeEach(func() {
+			server, _, cpiConfig, _ = helpers.SetUp("")
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("sets the OBM settings to the service of the node", func() {
+			expectedNode := helpers.LoadNode("../spec_assets/dummy_one_node_with_ipmi_response.json")
+			expectedNodeData, err := json.Marshal(expectedNode)
+			Expect(err).ToNot(HaveOccurred())
+
+			nodeID := "5665a65a0561790005b77b85"
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", fmt.Sprintf("/api/common/nodes/%s", nodeID)),
+					ghttp.RespondWith(http.StatusOK, expectedNodeData),
+				),
+			)
+
+			ipmiServiceName := rackhdapi.OBMSettingIPMIServiceName
+			expectedOptions := rebootNodeWorkflowOptions{
+				OBMServiceName: &ipmiServiceName,
+			}
+
+			options, err := buildRebootNodeWorkflowOptions(cpiConfig, nodeID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(options).To(Equal(expectedOptions))
+		})
+	})
+})
@@ -8,14 +8,19 @@ var reserveNodeTaskTemplate = []byte(`{
   "implementsTask": "Task.Base.Linux.Commands",
   "options": {
     "commands":[
+      "curl -s {{ api.base }}/nodes/{{ task.nodeId }} > /tmp/node.json",
+      "grep -Eq '\"cpi_claim\" *: *\\{[^}]*\"request_id\" *: *\"{{ options.requestId }}\"' /tmp/node.json",
+      "! grep -Eq '\"status\" *: *\"reserved\"' /tmp/node.json",
       "curl -X PATCH {{ api.base }}/nodes/{{ task.nodeId }} -H \"Content-Type: application/json\" -d '{\"status\": \"reserved\" }'"
-    ]
+    ],
+    "requestId": null
   },
   "properties": {}
 }`)
 
 type reserveNodeTaskOptions struct {
-	Commands []string `json:"commands"`
+	Commands  []string `json:"commands"`
+	RequestID *string  `json:"requestId"`
 }
 
 type reserveNodeTask struct {
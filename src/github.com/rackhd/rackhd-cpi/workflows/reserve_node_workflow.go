@@ -13,7 +13,8 @@ var reserveNodeWorkflowTemplate = []byte(`{
   "injectableName": "Graph.BOSH.ReserveNode",
 	"options": {
     "defaults": {
-      "obmServiceName": null
+      "obmServiceName": null,
+      "requestId": null
     }
   },
   "tasks": [
@@ -48,6 +49,7 @@ var reserveNodeWorkflowTemplate = []byte(`{
 
 type reserveNodeWorkflowOptions struct {
 	OBMServiceName *string `json:"obmServiceName"`
+	RequestID      *string `json:"requestId"`
 }
 
 type reserveNodeWorkflowDefaultOptionsContainer struct {
@@ -64,6 +66,10 @@ type reserveNodeWorkflow struct {
 	Tasks []rackhdapi.WorkflowTask `json:"tasks"`
 }
 
+// RunReserveNodeWorkflow reserves the node for the request, which must hold its
+// claim. RackHD runs one workflow on a node at a time, so the claim is checked
+// and the node reserved from within the workflow: of the requests racing for
+// a node, only the one holding the last claim on it can reserve it.
 func RunReserveNodeWorkflow(c config.Cpi, nodeID string, workflowName string) error {
 	options, err := buildReserveNodeWorkflowOptions(c, nodeID)
 	if err != nil {
@@ -79,30 +85,12 @@ func RunReserveNodeWorkflow(c config.Cpi, nodeID string, workflowName string) er
 }
 
 func PublishReserveNodeWorkflow(c config.Cpi) (string, error) {
-	tasks, workflow, err := generateReserveNodeWorkflow(c.RequestID)
+	tasks, workflow, err := generateReserveNodeWorkflow(definitionVersion)
 	if err != nil {
 		return "", err
 	}
 
-	for i := range tasks {
-		err = rackhdapi.PublishTask(c, tasks[i])
-		if err != nil {
-			return "", err
-		}
-	}
-
-	w := reserveNodeWorkflow{}
-	err = json.Unmarshal(workflow, &w)
-	if err != nil {
-		return "", fmt.Errorf("error umarshalling workflow: %s", err)
-	}
-
-	err = rackhdapi.PublishWorkflow(c, workflow)
-	if err != nil {
-		return "", err
-	}
-
-	return w.Name, nil
+	return publishDefinitions(c, tasks, workflow)
 }
 
 func generateReserveNodeWorkflow(uuid string) ([][]byte, []byte, error) {
@@ -146,6 +134,7 @@ func buildReserveNodeWorkflowOptions(c config.Cpi, nodeID string) (reserveNodeWo
 		return reserveNodeWorkflowOptions{}, err
 	}
 	options.OBMServiceName = &obmServiceName
+	options.RequestID = &c.RequestID
 
 	return options, nil
 }
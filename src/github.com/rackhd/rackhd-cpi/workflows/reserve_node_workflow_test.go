@@ -79,7 +79,7 @@ var _ = Describe("ReserveNodeWorkflow", func() {
 
 			workflowName, err := PublishReserveNodeWorkflow(c)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(workflowName).To(ContainSubstring(uID))
+			Expect(workflowName).To(HaveSuffix(definitionVersion))
 		})
 	})
 
@@ -135,6 +135,7 @@ var _ = Describe("ReserveNodeWorkflow", func() {
 				ipmiServiceName := rackhdapi.OBMSettingIPMIServiceName
 				expectedOptions := reserveNodeWorkflowOptions{
 					OBMServiceName: &ipmiServiceName,
+					RequestID:      &cpiConfig.RequestID,
 				}
 
 				options, err := buildReserveNodeWorkflowOptions(cpiConfig, nodeID)
@@ -160,6 +161,7 @@ var _ = Describe("ReserveNodeWorkflow", func() {
 				ipmiServiceName := rackhdapi.OBMSettingAMTServiceName
 				expectedOptions := reserveNodeWorkflowOptions{
 					OBMServiceName: &ipmiServiceName,
+					RequestID:      &cpiConfig.RequestID,
 				}
 
 				options, err := buildReserveNodeWorkflowOptions(cpiConfig, nodeID)